@@ -0,0 +1,14 @@
+package main
+
+import "strings"
+
+// XEP-0245 messages starting with this describe what the sender is doing
+const actionPrefix = "/me "
+
+// action returns what the sender of body is doing if it is a /me message.
+func action(body string) (string, bool) {
+	if !strings.HasPrefix(body, actionPrefix) {
+		return body, false
+	}
+	return strings.TrimPrefix(body, actionPrefix), true
+}
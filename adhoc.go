@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/disco/items"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+const nsCommands = "http://jabber.org/protocol/commands"
+
+// errCancelled is returned by a prompter when the user gives up.
+var errCancelled = errors.New("cancelled")
+
+// XEP-0050 command response
+type adhocCommand struct {
+	XMLName   xml.Name `xml:"http://jabber.org/protocol/commands command"`
+	Node      string   `xml:"node,attr"`
+	SessionID string   `xml:"sessionid,attr"`
+	// executing, completed or canceled
+	Status  string `xml:"status,attr"`
+	Actions *struct {
+		Execute  string    `xml:"execute,attr"`
+		Complete *struct{} `xml:"complete"`
+	} `xml:"actions"`
+	Notes []struct {
+		Type string `xml:"type,attr"`
+		Text string `xml:",chardata"`
+	} `xml:"note"`
+	Form *form.Data `xml:"jabber:x:data x"`
+}
+
+// listCommands returns the commands that to offers, sorted by node.
+func (c *client) listCommands(ctx context.Context, to jid.JID) ([]items.Item, error) {
+	found, err := c.discoNodeItems(ctx, to, nsCommands)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Node < found[j].Node })
+	return found, nil
+}
+
+func printCommands(to jid.JID, found []items.Item) {
+	w := newBlock()
+	defer w.Flush()
+	if len(found) == 0 {
+		fmt.Fprintf(w, "%s offers no commands\n", to)
+		return
+	}
+	fmt.Fprintf(w, "Commands of %s:\n", to)
+	for _, item := range found {
+		fmt.Fprintf(w, "  %s\t%s\n", item.Node, item.Name)
+	}
+}
+
+// runCommand executes the command node of to, filling in the forms of each
+// stage with ask until the command completes. Answering with /cancel at any
+// prompt cancels the command.
+func (c *client) runCommand(ctx context.Context, to jid.JID, node string, ask prompter) error {
+	send := func(sessionID, action string, payload xml.TokenReader) (adhocCommand, error) {
+		attrs := []xml.Attr{
+			{Name: xml.Name{Local: "node"}, Value: node},
+			{Name: xml.Name{Local: "action"}, Value: action},
+		}
+		if sessionID != "" {
+			attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "sessionid"}, Value: sessionID})
+		}
+		var resp adhocCommand
+		err := c.sendIQ(ctx, to, stanza.SetIQ, xmlstream.Wrap(payload, xml.StartElement{
+			Name: xml.Name{Space: nsCommands, Local: "command"},
+			Attr: attrs,
+		}), &resp)
+		return resp, err
+	}
+
+	resp, err := send("", "execute", nil)
+	for {
+		if err != nil {
+			return err
+		}
+		for _, note := range resp.Notes {
+			switch note.Type {
+			case "warn":
+				fmt.Printf("Warning: %s\n", note.Text)
+			case "error":
+				fmt.Printf("Error: %s\n", note.Text)
+			default:
+				fmt.Println(note.Text)
+			}
+		}
+		if resp.Status != "executing" {
+			if resp.Form != nil {
+				printForm(resp.Form)
+			}
+			if resp.Status == "canceled" {
+				return errCancelled
+			}
+			return nil
+		}
+
+		var payload xml.TokenReader
+		if resp.Form != nil {
+			if err := fillForm(resp.Form, ask, nil); errors.Is(err, errCancelled) {
+				send(resp.SessionID, "cancel", nil)
+				return err
+			} else if err != nil {
+				return err
+			}
+			payload, _ = resp.Form.Submit()
+		}
+		action := "execute"
+		if resp.Actions != nil && resp.Actions.Execute != "" {
+			action = resp.Actions.Execute
+		} else if resp.Actions != nil && resp.Actions.Complete != nil {
+			action = "complete"
+		}
+		resp, err = send(resp.SessionID, action, payload)
+	}
+}
+
+// printForm shows the fields of a form that only carries data, like the result
+// of a command, with their values.
+func printForm(f *form.Data) {
+	w := newBlock()
+	defer w.Flush()
+	if title := f.Title(); title != "" {
+		fmt.Fprintln(w, title)
+	}
+	if instructions := f.Instructions(); instructions != "" {
+		fmt.Fprintln(w, instructions)
+	}
+	f.ForFields(func(field form.FieldData) {
+		switch {
+		case field.Type == form.TypeHidden:
+		case field.Type == form.TypeFixed || field.Var == "":
+			fmt.Fprintln(w, strings.Join(field.Raw, "\n"))
+		default:
+			label := field.Label
+			if label == "" {
+				label = field.Var
+			}
+			fmt.Fprintf(w, "%s:\t%s\n", label, strings.Join(field.Raw, ", "))
+		}
+	})
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+const nsAttention = "urn:xmpp:attention:0"
+
+// buzz asks to for the attention of its user (XEP-0224).
+func (c *client) buzz(ctx context.Context, to jid.JID) error {
+	return c.Encode(ctx, messageBody{
+		Message: stanza.Message{
+			ID:   newID(),
+			To:   to,
+			From: c.LocalAddr(),
+			Type: stanza.HeadlineMessage,
+		},
+		Attention: &struct{}{},
+	})
+}
+
+// handleAttention alerts the user to an attention request, which only
+// contacts in the roster may send so that strangers can't ring the bell.
+func (c *client) handleAttention(msg messageBody) {
+	c.mu.Lock()
+	_, known := c.roster[msg.From.Bare().String()]
+	c.mu.Unlock()
+	if !known {
+		c.logger.Printf("Ignored a request for your attention from %s, who is not in your roster", msg.From)
+		return
+	}
+	bell := ""
+	if c.bell {
+		bell = "\a"
+	}
+	c.report(event{Type: "attention", From: msg.From.String(), Body: msg.Body},
+		"%s*** %s wants your attention ***\n", bell, msg.From.Bare())
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+const (
+	nsAvatarData     = "urn:xmpp:avatar:data"
+	nsAvatarMetadata = "urn:xmpp:avatar:metadata"
+)
+
+// XEP-0084 avatar metadata, only the info about images we can download
+type avatarMetadata struct {
+	Info []struct {
+		ID   string `xml:"id,attr"`
+		Type string `xml:"type,attr"`
+		URL  string `xml:"url,attr"`
+	} `xml:"urn:xmpp:avatar:metadata info"`
+}
+
+// Extensions for the usual avatar types, mime.ExtensionsByType has several
+// for some of them
+var avatarExtensions = map[string]string{
+	"image/png":     ".png",
+	"image/jpeg":    ".jpg",
+	"image/gif":     ".gif",
+	"image/webp":    ".webp",
+	"image/svg+xml": ".svg",
+}
+
+var errNoAvatar = errors.New("no avatar published")
+
+// fetchAvatar gets the avatar of owner, or our own if owner is empty, from
+// PEP or else from the vCard and returns the image and its MIME type.
+func (c *client) fetchAvatar(ctx context.Context, owner jid.JID) ([]byte, string, error) {
+	data, typ, err := c.fetchPEPAvatar(ctx, owner)
+	var se stanza.Error
+	if err == nil || !(errors.Is(err, errNoAvatar) || errors.As(err, &se)) {
+		return data, typ, err
+	}
+
+	card, err := c.fetchVCard(ctx, owner)
+	if err != nil {
+		return nil, "", err
+	}
+	if card.Photo.BinVal == "" {
+		return nil, "", errNoAvatar
+	}
+	return decodeAvatar(card.Photo.BinVal, card.Photo.Type)
+}
+
+func (c *client) fetchPEPAvatar(ctx context.Context, owner jid.JID) ([]byte, string, error) {
+	items, err := c.fetchItems(ctx, owner.Bare(), nsAvatarMetadata, "")
+	if err != nil {
+		return nil, "", err
+	}
+	if len(items) == 0 {
+		return nil, "", errNoAvatar
+	}
+	var meta avatarMetadata
+	err = items[0].decode(&meta)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Images hosted elsewhere aren't in the data node
+	for _, info := range meta.Info {
+		if info.URL != "" {
+			continue
+		}
+		items, err = c.fetchItems(ctx, owner.Bare(), nsAvatarData, info.ID)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(items) == 0 {
+			return nil, "", errNoAvatar
+		}
+		var b64 string
+		err = items[0].decode(&b64)
+		if err != nil {
+			return nil, "", err
+		}
+		return decodeAvatar(b64, info.Type)
+	}
+	return nil, "", errNoAvatar
+}
+
+// decodeAvatar decodes base64 image data and works out its MIME type, going by
+// the data itself rather than what the publisher claimed where possible.
+func decodeAvatar(b64, typ string) ([]byte, string, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(b64), ""))
+	if err != nil {
+		return nil, "", fmt.Errorf("decoding avatar: %w", err)
+	}
+	if sniffed := http.DetectContentType(data); sniffed != "application/octet-stream" {
+		typ = sniffed
+	}
+	typ, _, _ = mime.ParseMediaType(typ)
+	return data, typ, nil
+}
+
+// saveAvatar writes the avatar of owner to the download directory and returns
+// the name of the new file.
+func (c *client) saveAvatar(owner jid.JID, data []byte, typ string) (string, error) {
+	ext, ok := avatarExtensions[typ]
+	if !ok {
+		exts, _ := mime.ExtensionsByType(typ)
+		ext = ".bin"
+		if len(exts) > 0 {
+			ext = exts[0]
+		}
+	}
+	f, err := createUnique(c.downloadDir, owner.Bare().String()+ext)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+	"mellium.im/xmpp/stream"
+)
+
+const nsBind = "urn:ietf:params:xml:ns:xmpp-bind"
+
+// bindResource is xmpp.BindResource with a working resource request, the
+// library puts the (still empty) bound JID in the resource element instead
+// of the resourcepart of the session address. Binding is also where XEP-0198
+// stream management is enabled, or where the previous stream is resumed
+// instead, if sm is not nil.
+func bindResource(sm *streamManagement) xmpp.StreamFeature {
+	feature := xmpp.BindResource()
+	feature.Negotiate = func(ctx context.Context, session *xmpp.Session, data interface{}) (xmpp.SessionState, io.ReadWriter, error) {
+		var err error
+		if sm != nil {
+			err = sm.negotiate(session, func() error {
+				return bind(session)
+			})
+		} else {
+			err = bind(session)
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		return xmpp.Ready, nil, nil
+	}
+	return feature
+}
+
+// bind asks the server to bind the resourcepart of the session address, or
+// one of its choosing if there is none, and updates the address to the bound
+// one.
+func bind(session *xmpp.Session) error {
+	r := session.TokenReader()
+	defer r.Close()
+	w := session.TokenWriter()
+	defer w.Close()
+
+	var payload xml.TokenReader
+	if res := session.LocalAddr().Resourcepart(); res != "" {
+		payload = xmlstream.Wrap(
+			xmlstream.Token(xml.CharData(res)),
+			xml.StartElement{Name: xml.Name{Local: "resource"}},
+		)
+	}
+	id := newID()
+	// Stanzas have to be qualified over WebSocket where there is no stream
+	// namespace to inherit
+	iq := stanza.IQ{XMLName: xml.Name{Space: stanza.NSClient, Local: "iq"}, ID: id, Type: stanza.SetIQ}
+	_, err := xmlstream.Copy(w, iq.Wrap(xmlstream.Wrap(payload, xml.StartElement{Name: xml.Name{Space: nsBind, Local: "bind"}})))
+	if err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+
+	// Nothing else can arrive before the bind response
+	d := xml.NewTokenDecoder(r)
+	tok, err := d.Token()
+	if err != nil {
+		return err
+	}
+	start, ok := tok.(xml.StartElement)
+	if !ok || start.Name.Local != "iq" {
+		return stream.BadFormat
+	}
+	var resp struct {
+		stanza.IQ
+		JID jid.JID      `xml:"urn:ietf:params:xml:ns:xmpp-bind bind>jid"`
+		Err stanza.Error `xml:"error"`
+	}
+	if err = d.DecodeElement(&resp, &start); err != nil {
+		return err
+	}
+	switch {
+	case resp.ID != id:
+		return stream.UndefinedCondition
+	case resp.Type == stanza.ErrorIQ:
+		return resp.Err
+	case resp.Type != stanza.ResultIQ:
+		return stanza.Error{Condition: stanza.BadRequest}
+	}
+	session.UpdateAddr(resp.JID)
+	return nil
+}
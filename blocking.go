@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+const nsBlocking = "urn:xmpp:blocking"
+
+// XEP-0191 block list, also used for block and unblock requests and pushes
+type blockList struct {
+	XMLName xml.Name
+	Items   []struct {
+		JID jid.JID `xml:"jid,attr"`
+	} `xml:"item"`
+}
+
+// blockingPayload returns a block, unblock or blocklist element with an item
+// for each JID.
+func blockingPayload(name string, jids []jid.JID) xml.TokenReader {
+	var items []xml.TokenReader
+	for _, j := range jids {
+		items = append(items, xmlstream.Wrap(nil, xml.StartElement{
+			Name: xml.Name{Local: "item"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "jid"}, Value: j.String()}},
+		}))
+	}
+	return xmlstream.Wrap(
+		xmlstream.MultiReader(items...),
+		xml.StartElement{Name: xml.Name{Space: nsBlocking, Local: name}},
+	)
+}
+
+func (c *client) block(ctx context.Context, jids []jid.JID) error {
+	return c.sendIQ(ctx, jid.JID{}, stanza.SetIQ, blockingPayload("block", jids), nil)
+}
+
+func (c *client) unblock(ctx context.Context, jids []jid.JID) error {
+	return c.sendIQ(ctx, jid.JID{}, stanza.SetIQ, blockingPayload("unblock", jids), nil)
+}
+
+func (c *client) fetchBlocklist(ctx context.Context) ([]jid.JID, error) {
+	var list blockList
+	err := c.sendIQ(ctx, jid.JID{}, stanza.GetIQ, blockingPayload("blocklist", nil), &list)
+	if err != nil {
+		return nil, err
+	}
+	jids := make([]jid.JID, 0, len(list.Items))
+	for _, item := range list.Items {
+		jids = append(jids, item.JID)
+	}
+	return jids, nil
+}
+
+// handleBlockPush reports changes to the block list made by us or our other
+// clients and acknowledges them.
+func (c *client) handleBlockPush(t xmlstream.TokenReadEncoder, iq stanza.IQ, payload xml.StartElement) error {
+	// Only our server may change our block list
+	if iq.Type != stanza.SetIQ || (iq.From.String() != "" && !iq.From.Equal(c.LocalAddr().Bare())) {
+		return nil
+	}
+
+	var list blockList
+	d := xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(payload), t))
+	err := d.Decode(&list)
+	if err != nil {
+		c.logger.Printf("Error decoding block list push: %v", err)
+		return nil
+	}
+	switch list.XMLName.Local {
+	case "block":
+		for _, item := range list.Items {
+			c.report(event{Type: "block", From: item.JID.String()}, "Blocked %s\n", item.JID)
+		}
+	case "unblock":
+		if len(list.Items) == 0 {
+			c.report(event{Type: "unblock"}, "Unblocked everyone\n")
+		}
+		for _, item := range list.Items {
+			c.report(event{Type: "unblock", From: item.JID.String()}, "Unblocked %s\n", item.JID)
+		}
+	default:
+		return nil
+	}
+
+	_, err = xmlstream.Copy(t, iq.Result(nil))
+	return err
+}
+
+func printBlocklist(jids []jid.JID) {
+	if len(jids) == 0 {
+		printf("You haven't blocked anyone\n")
+		return
+	}
+	w := newBlock()
+	defer w.Flush()
+	fmt.Fprintln(w, "Blocked:")
+	for _, j := range jids {
+		fmt.Fprintf(w, "  %s\n", j)
+	}
+}
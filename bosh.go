@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/jid"
+)
+
+const (
+	nsBOSH      = "http://jabber.org/protocol/httpbind"
+	nsXBOSH     = "urn:xmpp:xbosh"
+	boshWait    = 60
+	boshVersion = "1.6"
+)
+
+// boshBody is the <body/> wrapper of XEP-0124 responses.
+type boshBody struct {
+	XMLName   xml.Name
+	Type      string `xml:"type,attr"`
+	Condition string `xml:"condition,attr"`
+	SID       string `xml:"sid,attr"`
+	Wait      int    `xml:"wait,attr"`
+	Requests  int    `xml:"requests,attr"`
+	Inner     []byte `xml:",innerxml"`
+}
+
+// boshRequest is a batch of complete elements to send in one request.
+type boshRequest struct {
+	payload   []byte
+	restart   bool
+	terminate bool
+}
+
+// boshConn makes an XEP-0124/XEP-0206 BOSH session look like a stream
+// connection. Elements written to it are sent in HTTP requests, and the
+// payloads of the responses can be read back. The stream headers written by
+// the session start or restart the BOSH session, and matching headers are
+// made up for the session to read since BOSH doesn't have any.
+type boshConn struct {
+	url    string
+	domain jid.JID
+	client *http.Client
+	// The dial context, which bounds creating the session
+	ctx context.Context
+
+	// Elements written so far that aren't complete yet
+	wbuf []byte
+	wmu  sync.Mutex
+
+	rid  uint64
+	sid  string
+	reqs int
+	wait int
+	out  chan boshRequest
+
+	// Received payloads waiting to be read
+	rmu   sync.Mutex
+	rcond *sync.Cond
+	rbuf  bytes.Buffer
+	rerr  error
+
+	readDeadline  connDeadline
+	writeDeadline connDeadline
+
+	done  chan struct{}
+	close sync.Once
+}
+
+// dialBOSH returns a connection that will create a BOSH session at rawURL for
+// domain once the XMPP session starts the stream. As with WebSocket only https:
+// connections are secure. Requests go through proxyURL if it isn't empty and
+// otherwise through the proxy from the environment.
+func dialBOSH(ctx context.Context, rawURL, proxyURL string, domain jid.JID, tlsConfig *tls.Config) (net.Conn, xmpp.SessionState, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, 0, err
+	}
+	proxy := http.ProxyFromEnvironment
+	if proxyURL != "" {
+		pu, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, 0, err
+		}
+		proxy = http.ProxyURL(pu)
+	}
+	var state xmpp.SessionState
+	switch u.Scheme {
+	case "https":
+		state = xmpp.Secure
+	case "http":
+	default:
+		return nil, 0, fmt.Errorf("unsupported BOSH URL scheme %q", u.Scheme)
+	}
+
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.ServerName = u.Hostname()
+	c := &boshConn{
+		url:    u.String(),
+		domain: domain,
+		ctx:    ctx,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           proxy,
+				TLSClientConfig: tlsConfig,
+			},
+		},
+		// Request IDs start at a random number
+		rid:  uint64(rand.Int63n(1 << 32)),
+		out:  make(chan boshRequest),
+		done: make(chan struct{}),
+	}
+	c.rcond = sync.NewCond(&c.rmu)
+	c.readDeadline.expire = func() {
+		c.rmu.Lock()
+		c.rcond.Broadcast()
+		c.rmu.Unlock()
+	}
+	return c, state, nil
+}
+
+func (c *boshConn) Read(p []byte) (int, error) {
+	expired := c.readDeadline.wait()
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for c.rbuf.Len() == 0 && c.rerr == nil {
+		if isDone(expired) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.rcond.Wait()
+	}
+	if c.rbuf.Len() > 0 {
+		return c.rbuf.Read(p)
+	}
+	return 0, c.rerr
+}
+
+// received queues data for Read, or ends reading with err if it isn't nil.
+func (c *boshConn) received(data []byte, err error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	c.rbuf.Write(data)
+	if err != nil && c.rerr == nil {
+		c.rerr = err
+	}
+	c.rcond.Broadcast()
+}
+
+// Write collects what the session writes into whole elements and stream
+// headers and acts on them.
+func (c *boshConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	expired := c.writeDeadline.wait()
+	if isDone(expired) {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	c.wbuf = append(c.wbuf, p...)
+	var batch []byte
+	for {
+		c.wbuf = bytes.TrimLeft(c.wbuf, " \t\r\n")
+		switch {
+		case len(c.wbuf) == 0:
+			return len(p), c.flush(batch, expired)
+		case bytes.HasPrefix(c.wbuf, []byte("<?")):
+			end := bytes.Index(c.wbuf, []byte("?>"))
+			if end < 0 {
+				return len(p), c.flush(batch, expired)
+			}
+			c.wbuf = c.wbuf[end+2:]
+		case bytes.HasPrefix(c.wbuf, []byte("<stream:stream")):
+			end := bytes.IndexByte(c.wbuf, '>')
+			if end < 0 {
+				return len(p), c.flush(batch, expired)
+			}
+			c.wbuf = c.wbuf[end+1:]
+			if err := c.flush(batch, expired); err != nil {
+				return 0, err
+			}
+			batch = nil
+			if err := c.open(expired); err != nil {
+				return 0, err
+			}
+		case bytes.HasPrefix(c.wbuf, []byte("</stream:stream")):
+			c.wbuf = nil
+			if err := c.flush(batch, expired); err != nil {
+				return 0, err
+			}
+			return len(p), c.send(boshRequest{terminate: true}, expired)
+		default:
+			n := elementLen(c.wbuf)
+			if n == 0 {
+				return len(p), c.flush(batch, expired)
+			}
+			batch = append(batch, c.wbuf[:n]...)
+			c.wbuf = c.wbuf[n:]
+		}
+	}
+}
+
+// elementLen returns the length of the first element in b, or 0 if it isn't
+// complete yet.
+func elementLen(b []byte) int {
+	depth := 0
+	for i := 0; i < len(b); i++ {
+		if b[i] != '<' {
+			continue
+		}
+		end := bytes.IndexByte(b[i:], '>')
+		if end < 0 {
+			return 0
+		}
+		tag := b[i : i+end+1]
+		switch {
+		case bytes.HasPrefix(tag, []byte("</")):
+			depth--
+		case bytes.HasPrefix(tag, []byte("<?")), bytes.HasSuffix(tag, []byte("/>")):
+		default:
+			depth++
+		}
+		i += end
+		if depth == 0 {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// flush sends batch unless it is empty. Like send it gives up once expired is
+// closed.
+func (c *boshConn) flush(batch []byte, expired <-chan struct{}) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	return c.send(boshRequest{payload: batch}, expired)
+}
+
+func (c *boshConn) send(req boshRequest, expired <-chan struct{}) error {
+	select {
+	case c.out <- req:
+		return nil
+	case <-c.done:
+		return net.ErrClosed
+	case <-expired:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// open creates the BOSH session the first time the stream is started and
+// restarts it after that, in both cases making up the stream header that the
+// session expects to read. Creating the session stops when the dial context
+// is done or expired is closed.
+func (c *boshConn) open(expired <-chan struct{}) error {
+	header := fmt.Sprintf(`<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' version='1.0' from='%s' id='%s'>`, c.domain, newID())
+	if c.sid != "" {
+		c.received([]byte(header), nil)
+		return c.send(boshRequest{restart: true}, expired)
+	}
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-expired:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	resp, err := c.post(ctx, fmt.Sprintf(
+		`<body content='text/xml; charset=utf-8' hold='1' rid='%d' to='%s' ver='%s' wait='%d' xml:lang='en' xmpp:version='1.0' xmlns='%s' xmlns:xmpp='%s'/>`,
+		c.nextRID(), c.domain, boshVersion, boshWait, nsBOSH, nsXBOSH))
+	if err != nil {
+		if isDone(expired) && c.ctx.Err() == nil {
+			return os.ErrDeadlineExceeded
+		}
+		return err
+	}
+	if resp.SID == "" {
+		return errors.New("bosh: no session ID in response")
+	}
+	c.sid = resp.SID
+	c.wait = resp.Wait
+	if c.wait == 0 {
+		c.wait = boshWait
+	}
+	c.reqs = resp.Requests
+	if c.reqs < 1 {
+		c.reqs = 1
+	}
+
+	c.received([]byte(header), nil)
+	c.received(resp.Inner, nil)
+	go c.loop()
+	return nil
+}
+
+func (c *boshConn) nextRID() uint64 {
+	c.rid++
+	return c.rid
+}
+
+// loop keeps a request waiting at the connection manager so that it can push
+// data to us, and sends anything written as soon as the number of requests
+// in flight allows it.
+func (c *boshConn) loop() {
+	type result struct {
+		body boshBody
+		err  error
+	}
+	results := make(chan result)
+	inflight := 0
+	var pending []boshRequest
+
+	start := func(req boshRequest) {
+		attrs := fmt.Sprintf(`rid='%d' sid='%s' xmlns='%s'`, c.nextRID(), c.sid, nsBOSH)
+		switch {
+		case req.restart:
+			attrs += fmt.Sprintf(` to='%s' xml:lang='en' xmpp:restart='true' xmlns:xmpp='%s'`, c.domain, nsXBOSH)
+		case req.terminate:
+			attrs += ` type='terminate'`
+		}
+		body := fmt.Sprintf("<body %s>%s</body>", attrs, req.payload)
+		inflight++
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.wait)*time.Second+requestTimeout)
+			defer cancel()
+			resp, err := c.post(ctx, body)
+			select {
+			case results <- result{body: resp, err: err}:
+			case <-c.done:
+			}
+		}()
+	}
+
+	for {
+		// Always keep one request open to poll for incoming data
+		if inflight == 0 {
+			req := boshRequest{}
+			if len(pending) > 0 {
+				req, pending = pending[0], pending[1:]
+			}
+			start(req)
+		}
+
+		select {
+		case req := <-c.out:
+			pending = append(pending, req)
+		case res := <-results:
+			inflight--
+			if res.err != nil {
+				c.fail(res.err)
+				return
+			}
+			if res.body.Type == "terminate" {
+				if res.body.Condition != "" {
+					c.fail(fmt.Errorf("bosh: session terminated: %s", res.body.Condition))
+				} else {
+					c.fail(io.EOF)
+				}
+				return
+			}
+			c.received(res.body.Inner, nil)
+		case <-c.done:
+			return
+		}
+
+		// Restarts and terminations have to go in a request of their own, but
+		// other payloads can be sent together
+		for len(pending) > 0 && inflight < c.reqs {
+			req := pending[0]
+			pending = pending[1:]
+			if !req.restart && !req.terminate {
+				for len(pending) > 0 && !pending[0].restart && !pending[0].terminate {
+					req.payload = append(req.payload, pending[0].payload...)
+					pending = pending[1:]
+				}
+			}
+			start(req)
+		}
+	}
+}
+
+func (c *boshConn) post(ctx context.Context, body string) (boshBody, error) {
+	var resp boshBody
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, strings.NewReader(body))
+	if err != nil {
+		return resp, err
+	}
+	req.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	httpResp, err := c.client.Do(req)
+	if err != nil {
+		return resp, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return resp, fmt.Errorf("bosh: unexpected status %s", httpResp.Status)
+	}
+	err = xml.NewDecoder(httpResp.Body).Decode(&resp)
+	if err != nil {
+		return resp, err
+	}
+	if resp.XMLName.Space != nsBOSH || resp.XMLName.Local != "body" {
+		return resp, fmt.Errorf("bosh: unexpected response element %s", resp.XMLName.Local)
+	}
+	return resp, nil
+}
+
+func (c *boshConn) fail(err error) {
+	c.received(nil, err)
+	c.Close()
+}
+
+func (c *boshConn) Close() error {
+	c.close.Do(func() {
+		close(c.done)
+		c.received(nil, net.ErrClosed)
+	})
+	return nil
+}
+
+type boshAddr string
+
+func (a boshAddr) Network() string { return "bosh" }
+func (a boshAddr) String() string  { return string(a) }
+
+func (c *boshConn) LocalAddr() net.Addr  { return boshAddr("") }
+func (c *boshConn) RemoteAddr() net.Addr { return boshAddr(c.url) }
+
+func (c *boshConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *boshConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *boshConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// connDeadline is a read or write deadline for a connection that has to keep
+// track of its own. Operations take the channel from wait when they start and
+// fail once it is closed, which happens when the deadline passes, even if a
+// new deadline was set since.
+type connDeadline struct {
+	mu    sync.Mutex
+	timer *time.Timer
+	done  chan struct{}
+	// Called when the deadline passes, to wake up waiting operations
+	expire func()
+}
+
+func (d *connDeadline) set(t time.Time) {
+	d.mu.Lock()
+	if d.timer != nil && !d.timer.Stop() {
+		// Already firing
+		<-d.done
+	}
+	d.timer = nil
+	if d.done == nil || isDone(d.done) {
+		d.done = make(chan struct{})
+	}
+	if t.IsZero() {
+		d.mu.Unlock()
+		return
+	}
+	done := d.done
+	fire := func() {
+		close(done)
+		if d.expire != nil {
+			d.expire()
+		}
+	}
+	if dur := time.Until(t); dur > 0 {
+		d.timer = time.AfterFunc(dur, fire)
+		d.mu.Unlock()
+		return
+	}
+	d.mu.Unlock()
+	fire()
+}
+
+// wait returns a channel that is closed when the current deadline passes.
+func (d *connDeadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.done == nil {
+		d.done = make(chan struct{})
+	}
+	return d.done
+}
+
+func isDone(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/xml"
+	"sync"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/crypto"
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// capsNode identifies this client in XEP-0115 entity capabilities
+const capsNode = "https://github.com/TA-23-24/xmpp-client"
+
+// XEP-0115 entity capabilities in presence. Unlike disco.Caps a hash we
+// don't know doesn't make the whole presence fail to decode.
+type capsElement struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/caps c"`
+	Hash    string   `xml:"hash,attr"`
+	Node    string   `xml:"node,attr"`
+	Ver     string   `xml:"ver,attr"`
+}
+
+func (c *capsElement) TokenReader() xml.TokenReader {
+	return xmlstream.Wrap(nil, xml.StartElement{
+		Name: c.XMLName,
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "hash"}, Value: c.Hash},
+			{Name: xml.Name{Local: "node"}, Value: c.Node},
+			{Name: xml.Name{Local: "ver"}, Value: c.Ver},
+		},
+	})
+}
+
+// capsCache is what devices with each hash and verification string support.
+// It is shared by all accounts as they mostly see the same clients.
+var (
+	capsMu    sync.Mutex
+	capsCache = make(map[string]disco.Info)
+)
+
+// ownCaps is the entity capabilities element for our presence. It is worked
+// out each time as -omemo adds a feature at startup.
+func ownCaps() *capsElement {
+	return &capsElement{
+		XMLName: xml.Name{Space: disco.NSCaps, Local: "c"},
+		Hash:    crypto.SHA1.String(),
+		Node:    capsNode,
+		Ver:     clientInfo().Hash(crypto.SHA1.New()),
+	}
+}
+
+// recordCaps remembers the capabilities a device advertised in its presence,
+// or forgets them when it goes offline.
+func (c *client) recordCaps(p presenceBody) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p.Type != stanza.AvailablePresence || p.Caps == nil {
+		delete(c.deviceCaps, p.From.String())
+		return
+	}
+	if c.deviceCaps == nil {
+		c.deviceCaps = make(map[string]capsElement)
+	}
+	c.deviceCaps[p.From.String()] = *p.Caps
+}
+
+// cachedInfo is like discoInfo but doesn't ask a device that advertised the
+// same capabilities as one that was asked before. Unknown capabilities are
+// only cached if what the device answers matches their hash, so that nobody
+// can make other devices look like they support something.
+func (c *client) cachedInfo(ctx context.Context, to jid.JID) (disco.Info, error) {
+	c.mu.Lock()
+	caps, ok := c.deviceCaps[to.String()]
+	c.mu.Unlock()
+	h, err := crypto.Parse(caps.Hash)
+	if !ok || caps.Ver == "" || err != nil || !h.Available() {
+		return c.discoInfo(ctx, to)
+	}
+	key := caps.Hash + " " + caps.Ver
+
+	capsMu.Lock()
+	info, ok := capsCache[key]
+	capsMu.Unlock()
+	if ok {
+		return info, nil
+	}
+
+	session := c.Session()
+	if session == nil {
+		return disco.Info{}, errDisconnected
+	}
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	info, err = disco.GetInfo(ctx, caps.Node+"#"+caps.Ver, to, session)
+	if err != nil {
+		return disco.Info{}, err
+	}
+	if got := info.Hash(h.New()); got != caps.Ver {
+		c.logger.Printf("Not caching the capabilities of %s, they hash to %s rather than %s", to, got, caps.Ver)
+		return info, nil
+	}
+	capsMu.Lock()
+	capsCache[key] = info
+	capsMu.Unlock()
+	return info, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+// XEP-0297 forwarded message, used by archives and carbons
+type forwarded struct {
+	Delay   delay       `xml:"urn:xmpp:delay delay"`
+	Message messageBody `xml:"jabber:client message"`
+}
+
+// XEP-0280 carbon copy
+type carbon struct {
+	Forwarded forwarded `xml:"urn:xmpp:forward:0 forwarded"`
+}
+
+// handleCarbon prints a message that was sent or received by another client
+// logged in to our account.
+func (c *client) handleCarbon(msg messageBody) {
+	// Carbons can only come from our own account, which the session reports
+	// as an empty from address
+	if msg.From.String() != "" && !msg.From.Bare().Equal(c.LocalAddr().Bare()) {
+		c.logger.Printf("Ignoring carbon from %s", msg.From)
+		return
+	}
+
+	switch {
+	case msg.CarbonSent != nil:
+		inner := msg.CarbonSent.Forwarded.Message
+		inner.Delay = forwardedDelay(msg.CarbonSent.Forwarded, inner)
+		c.decryptBody(&inner)
+		if inner.Body == "" {
+			return
+		}
+		e := event{Type: "carbon", To: inner.To.String(), ID: inner.ID, Body: inner.Body, Encrypted: inner.Encrypted, Verified: inner.Verified}
+		if text, ok := action(inner.Body); ok {
+			c.report(e, "%s[carbon] %s* me %s (to %s)\n", c.timestamp(sentAt(inner)), encryptionLabel(inner), text, inner.To.Bare())
+		} else {
+			c.report(e, "%s[carbon] %sme -> %s: %s\n", c.timestamp(sentAt(inner)), encryptionLabel(inner), inner.To.Bare(), inner.Body)
+		}
+		c.recordHistory("out", inner.To.Bare(), inner.Body)
+	case msg.CarbonReceived != nil:
+		inner := msg.CarbonReceived.Forwarded.Message
+		inner.Delay = forwardedDelay(msg.CarbonReceived.Forwarded, inner)
+		c.decryptBody(&inner)
+		if inner.Body == "" {
+			return
+		}
+		e := event{Type: "carbon", From: inner.From.String(), ID: inner.ID, Body: inner.Body, Encrypted: inner.Encrypted, Verified: inner.Verified}
+		if text, ok := action(inner.Body); ok {
+			c.report(e, "%s[carbon] %s* %s %s\n", c.timestamp(sentAt(inner)), encryptionLabel(inner), inner.From.Bare(), text)
+		} else {
+			c.report(e, "%s[carbon] %s%s: %s\n", c.timestamp(sentAt(inner)), encryptionLabel(inner), inner.From.Bare(), inner.Body)
+		}
+		c.recordHistory("in", inner.From.Bare(), inner.Body)
+	}
+}
+
+// forwardedDelay returns the delay of a forwarded message, which is usually on
+// the forwarded element rather than the message itself.
+func forwardedDelay(f forwarded, msg messageBody) *delay {
+	if msg.Delay == nil && !f.Delay.Stamp.IsZero() {
+		return &f.Delay
+	}
+	return msg.Delay
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"os"
+)
+
+// loadCertPool adds the PEM encoded certificates in path to the system roots.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found")
+	}
+	return pool, nil
+}
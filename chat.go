@@ -0,0 +1,1103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// chat is the state of the interactive read loop. Messages go to the current
+// target, which is a room while groupchat is set.
+type chat struct {
+	ctx       context.Context
+	c         *client
+	defaultTo jid.JID
+	to        jid.JID
+	groupchat bool
+	commands  commandRegistry
+	// Where lines are read from, the editor of /edit borrows its terminal
+	input lineReader
+	// Every account we are logged into, c is the one messages are sent from
+	accounts []*client
+
+	// ID of the last message sent to each bare JID, for /correct
+	lastSent map[string]string
+	// Whether the current target knows we are typing
+	typing typingState
+}
+
+func newChat(ctx context.Context, c *client, to jid.JID) *chat {
+	ch := &chat{
+		ctx:       ctx,
+		c:         c,
+		defaultTo: to,
+		to:        to,
+	}
+
+	ch.commands.register("/account", "[name]", "Show the accounts you are logged into or send from the one called name", ch.cmdAccount)
+	ch.commands.register("/to", "<JID>", "Send messages to JID", ch.cmdTo)
+	ch.commands.registerText("/msg", "<JID> <message>", "Send one message to JID without changing who messages go to", ch.cmdMsg)
+	ch.commands.registerText("/me", "<action>", "Tell the current target what you are doing, shown as \"* you action\"", ch.cmdMe)
+	ch.commands.register("/edit", "", "Write a message with several lines in $VISUAL or $EDITOR and send it", ch.cmdEdit)
+	ch.commands.registerText("/reply", "[message]", "Send messages to the device that last messaged you", ch.cmdReply)
+	ch.commands.registerText("/correct", "<message>", "Replace the last message you sent to the current target", ch.cmdCorrect)
+	ch.commands.register("/upload", "<file>", "Upload a file to your server and send the link to the current target", ch.cmdUpload)
+	ch.commands.register("/sendfile", "<JID> <file>", "Send a file directly to a device of a contact, for when there is no upload service", ch.cmdSendFile)
+	ch.commands.register("/buzz", "[JID]", "Ask a contact, or the current target, for their attention", ch.cmdBuzz)
+	ch.commands.register("/join", "<room@service[/nick]>", "Join a multi-user chat room and send messages to it", ch.cmdJoin)
+	ch.commands.register("/leave", "[room]", "Leave the current or given room", ch.cmdLeave)
+	ch.commands.register("/occupants", "[room]", "Show who is in the current or given room", ch.cmdOccupants)
+	ch.commands.registerText("/pm", "<nick> [message]", "Message an occupant of the current room privately, or switch to doing so", ch.cmdPM)
+	ch.commands.registerText("/kick", "<nick> [reason]", "Remove an occupant from the current room", ch.roleCommand("none"))
+	ch.commands.registerText("/ban", "<JID> [reason]", "Ban a user from the current room", ch.cmdBan)
+	ch.commands.registerText("/voice", "<nick> [reason]", "Let a visitor of the current room speak", ch.roleCommand("participant"))
+	ch.commands.registerText("/mute", "<nick> [reason]", "Stop an occupant of the current room from speaking", ch.roleCommand("visitor"))
+	ch.commands.register("/affiliation", "<JID> <owner|admin|member|none>", "Change the affiliation of a user with the current room", ch.cmdAffiliation)
+	ch.commands.registerText("/subject", "[text]", "Set the topic of the current room or the subject of the chat, clear it if no text is given", ch.cmdSubject)
+	ch.commands.register("/thread", "[new|off|thread]", "Show the thread messages to the current target go in, start a new one, stop using one or continue one by its #tag or ID", ch.cmdThread)
+	ch.commands.register("/status", "", "Show how healthy the connection to your server is", ch.cmdStatus)
+	ch.commands.register("/reconnect", "", "Connect to your server again now, for example after the network changed", ch.cmdReconnect)
+	ch.commands.register("/roster", "", "Show your contact list", ch.cmdRoster)
+	ch.commands.register("/who", "", "Show which contacts are online", ch.cmdWho)
+	ch.commands.register("/history", "[JID]", "Fetch messages from the server archive", ch.cmdHistory)
+	ch.commands.register("/search", "[-i] [-with JID] [-since YYYY-MM-DD] [-until YYYY-MM-DD] <text>", "Search the local history, -i ignores case", ch.cmdSearch)
+	ch.commands.register("/disco", "[JID]", "Show the features and items of an entity, by default your server", ch.cmdDisco)
+	ch.commands.register("/version", "[JID]", "Show which software an entity runs, by default your server", ch.cmdVersion)
+	ch.commands.register("/time", "[JID]", "Show the local time of an entity, by default your server", ch.cmdTime)
+	ch.commands.register("/vcard", "[JID]", "Show the contact details of JID, by default your own", ch.cmdVCard)
+	ch.commands.register("/avatar", "[JID]", "Save the avatar of JID, by default your own, in the -download directory or the current one", ch.cmdAvatar)
+	ch.commands.register("/nick", "<name>", "Set the nickname your contacts see", ch.cmdNick)
+	ch.commands.register("/command", "<JID> [node]", "List the ad-hoc commands of JID or run one, answer /cancel to stop it", ch.cmdCommand)
+	ch.commands.register("/passwd", "<new password>", "Change the password of your account on the server", ch.cmdPasswd)
+	ch.commands.registerText("/raw", "<stanza>", "Send a message, presence or iq written in XML as it is, use -v to see the reply", ch.cmdRaw)
+	ch.commands.registerText("/publish", "<node> <data>", "Publish data, XML or text, to a node of your personal eventing service", ch.cmdPublish)
+	ch.commands.register("/subscribe", "<node> [JID]", "Get notified of items published to a node of JID, by default yourself", ch.cmdSubscribe)
+	ch.commands.registerText("/away", "[status]", "Set your presence to away", ch.showCommand("away"))
+	ch.commands.registerText("/dnd", "[status]", "Set your presence to do not disturb", ch.showCommand("dnd"))
+	ch.commands.registerText("/back", "[status]", "Set your presence to available", ch.showCommand(""))
+	ch.commands.register("/add", "<JID>", "Ask to see the presence of JID", ch.cmdAdd)
+	ch.commands.register("/accept", "[JID]", "Accept a presence subscription request", ch.subscriptionCommand(true))
+	ch.commands.register("/deny", "[JID]", "Deny a presence subscription request", ch.subscriptionCommand(false))
+	ch.commands.register("/block", "<JID>...", "Stop receiving anything from JID", ch.cmdBlock)
+	ch.commands.register("/unblock", "<JID>...", "Receive messages from JID again", ch.cmdUnblock)
+	ch.commands.register("/blocklist", "", "Show who you have blocked", ch.cmdBlocklist)
+	ch.commands.register("/trust", "[JID [fingerprint]]", "Show your OMEMO fingerprint or the devices of JID, or verify the device of JID with that fingerprint", ch.cmdTrust)
+	ch.commands.register("/help", "", "Show this list", ch.cmdHelp)
+	return ch
+}
+
+// handle sends line to the current target or runs it as a command.
+func (ch *chat) handle(line string) {
+	if strings.HasPrefix(line, "/") {
+		if err := ch.commands.dispatch(line); err != nil {
+			ch.c.reportError(err)
+		}
+		return
+	}
+	ch.send(line)
+}
+
+// prompt shows where typed messages go, and from which account if there is
+// more than one.
+func (ch *chat) prompt() string {
+	if len(ch.accounts) > 1 {
+		return "[" + ch.c.account + "] " + ch.to.String() + "> "
+	}
+	return ch.to.String() + "> "
+}
+
+func parseJID(s string) (jid.JID, error) {
+	j, err := jid.Parse(s)
+	if err != nil {
+		return jid.JID{}, fmt.Errorf("parsing %q as a JID: %w", s, err)
+	}
+	return j, nil
+}
+
+// optionalJID parses the only argument, if there is one.
+func optionalJID(args []string) (jid.JID, error) {
+	switch len(args) {
+	case 0:
+		return jid.JID{}, nil
+	case 1:
+		return parseJID(args[0])
+	}
+	return jid.JID{}, errUsage
+}
+
+func (ch *chat) cmdAccount(args []string) error {
+	switch len(args) {
+	case 0:
+		w := newBlock()
+		defer w.Flush()
+		for _, c := range ch.accounts {
+			active := " "
+			if c == ch.c {
+				active = "*"
+			}
+			name := c.account
+			if name == "" {
+				name = c.addr.Bare().String()
+			}
+			fmt.Fprintf(w, "%s %s\t%s\n", active, name, c.LocalAddr())
+		}
+		return nil
+	case 1:
+	default:
+		return errUsage
+	}
+
+	for _, c := range ch.accounts {
+		if c.account != args[0] && c.addr.Bare().String() != args[0] {
+			continue
+		}
+		ch.c = c
+		// Rooms are joined by one account only
+		c.mu.Lock()
+		_, joined := c.rooms[ch.to.String()]
+		c.mu.Unlock()
+		if ch.groupchat && !joined {
+			ch.to = ch.defaultTo
+			ch.groupchat = false
+		}
+		ch.lastSent = nil
+		fmt.Printf("Sending from %s to %s\n", c.LocalAddr().Bare(), ch.to)
+		return nil
+	}
+	return fmt.Errorf("not logged into an account called %s", args[0])
+}
+
+func (ch *chat) cmdTo(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	to, err := parseJID(args[0])
+	if err != nil {
+		return err
+	}
+	ch.to = to
+	ch.groupchat = false
+	fmt.Printf("Now messaging %s\n", ch.to)
+	return nil
+}
+
+// cmdMsg sends a single message and keeps the current target.
+func (ch *chat) cmdMsg(args []string, text string) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	to, err := parseJID(args[0])
+	if err != nil {
+		return err
+	}
+	// Rooms we are in get a groupchat message
+	ch.c.mu.Lock()
+	_, groupchat := ch.c.rooms[to.String()]
+	ch.c.mu.Unlock()
+	ch.sendMessage(to, groupchat, skipFields(text, 1), nil, nil)
+	return nil
+}
+
+func (ch *chat) cmdMe(args []string, text string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	ch.sendMessage(ch.to, ch.groupchat, actionPrefix+text, nil, nil)
+	// Rooms send our messages back, everyone else has to be shown what we sent
+	// as it doesn't look like what was typed
+	if !ch.groupchat && ch.c.events == nil {
+		me := ch.c.Nick()
+		if me == "" {
+			me = ch.c.LocalAddr().Bare().String()
+		}
+		ch.c.printf("%s* %s %s\n", ch.c.timestamp(time.Now()), me, text)
+	}
+	return nil
+}
+
+func (ch *chat) cmdEdit(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	msg, err := compose(ch.input)
+	if err != nil {
+		return err
+	}
+	ch.send(msg)
+	return nil
+}
+
+// cmdReply targets the full JID of the last incoming message so that the
+// conversation stays on the device the contact is using.
+func (ch *chat) cmdReply(args []string, text string) error {
+	ch.c.mu.Lock()
+	from := ch.c.lastFrom
+	ch.c.mu.Unlock()
+	if from.Equal(jid.JID{}) {
+		return errors.New("nobody has messaged you yet")
+	}
+
+	if !ch.to.Equal(from) || ch.groupchat {
+		ch.to = from
+		ch.groupchat = false
+		fmt.Printf("Now messaging %s\n", ch.to)
+	}
+	if len(args) > 0 {
+		ch.send(text)
+	}
+	return nil
+}
+
+func (ch *chat) cmdCorrect(args []string, text string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	id, ok := ch.lastSent[ch.to.Bare().String()]
+	if !ok {
+		return fmt.Errorf("correcting message: nothing sent to %s yet", ch.to.Bare())
+	}
+	ch.sendMessage(ch.to, ch.groupchat, text, &correction{ID: id}, nil)
+	return nil
+}
+
+func (ch *chat) cmdUpload(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	name := strings.Join(args, " ")
+	url, err := ch.c.uploadFile(ch.ctx, name)
+	if err != nil {
+		return fmt.Errorf("uploading %s: %w", name, err)
+	}
+	ch.c.report(event{Type: "upload", To: ch.to.String(), URL: url, File: name}, "Uploaded %s to %s\n", name, url)
+	ch.sendMessage(ch.to, ch.groupchat, url, nil, &oobData{URL: url})
+	return nil
+}
+
+// cmdSendFile sends a file in-band. That needs a full JID, which for a bare
+// one is taken from the last message it sent us.
+func (ch *chat) cmdSendFile(args []string) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	to, err := parseJID(args[0])
+	if err != nil {
+		return err
+	}
+	if to.Resourcepart() == "" {
+		ch.c.mu.Lock()
+		from := ch.c.lastFrom
+		ch.c.mu.Unlock()
+		if !from.Bare().Equal(to) {
+			return fmt.Errorf("%s is not a full JID, sending a file needs the device to send it to, e.g. %[1]s/phone", to)
+		}
+		to = from
+	}
+	name := strings.Join(args[1:], " ")
+	if err := ch.c.sendFileIBB(ch.ctx, to, name); err != nil {
+		return fmt.Errorf("sending %s to %s: %w", name, to, err)
+	}
+	ch.c.report(event{Type: "transfer", To: to.String(), File: name}, "Sent %s to %s\n", name, to)
+	return nil
+}
+
+func (ch *chat) cmdBuzz(args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	to := ch.to
+	if len(args) == 1 {
+		var err error
+		if to, err = parseJID(args[0]); err != nil {
+			return err
+		}
+	} else if ch.groupchat {
+		return errors.New("asking a whole room for attention is not supported, give the JID of a contact")
+	}
+	// Only a device can say whether it supports attention requests, so use the
+	// one that last messaged us if it belongs to the contact
+	if to.Resourcepart() == "" {
+		ch.c.mu.Lock()
+		from := ch.c.lastFrom
+		ch.c.mu.Unlock()
+		if from.Bare().Equal(to) {
+			to = from
+		}
+	}
+	if to.Resourcepart() != "" {
+		ok, err := ch.c.supports(ch.ctx, to, nsAttention)
+		switch {
+		case err != nil:
+			ch.c.logger.Printf("Error checking whether %s supports attention requests: %s", to, explainError(err))
+		case !ok:
+			fmt.Printf("Warning: %s does not say it supports attention requests, it may ignore this one\n", to)
+		}
+	}
+	if err := ch.c.buzz(ch.ctx, to); err != nil {
+		return fmt.Errorf("asking %s for attention: %w", to, err)
+	}
+	ch.c.report(event{Type: "attention", To: to.String()}, "Asked %s for their attention\n", to)
+	return nil
+}
+
+func (ch *chat) cmdJoin(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	return ch.join(args[0])
+}
+
+func (ch *chat) join(arg string) error {
+	room, err := parseJID(arg)
+	if err != nil {
+		return err
+	}
+	occupant, err := ch.c.occupantJID(room)
+	if err != nil {
+		return fmt.Errorf("joining %s: %w", room, err)
+	}
+	err = ch.c.joinRoom(ch.ctx, occupant)
+	if err != nil {
+		return fmt.Errorf("joining %s: %w", room, err)
+	}
+	ch.to = occupant.Bare()
+	ch.groupchat = true
+	fmt.Printf("Joined %s as %s\n", ch.to, occupant.Resourcepart())
+	return nil
+}
+
+func (ch *chat) cmdLeave(args []string) error {
+	room, err := optionalJID(args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		room = ch.to
+	}
+	err = ch.c.leaveRoom(ch.ctx, room)
+	if err != nil {
+		return fmt.Errorf("leaving room: %w", err)
+	}
+	fmt.Printf("Left %s\n", room.Bare())
+	if ch.groupchat && room.Bare().Equal(ch.to) {
+		ch.to = ch.defaultTo
+		ch.groupchat = false
+		fmt.Printf("Now messaging %s\n", ch.to)
+	}
+	return nil
+}
+
+// room is the room messages currently go to.
+func (ch *chat) room() (jid.JID, error) {
+	if !ch.groupchat {
+		return jid.JID{}, errors.New("not messaging a room, /join one first")
+	}
+	return ch.to.Bare(), nil
+}
+
+func (ch *chat) cmdOccupants(args []string) error {
+	room, err := optionalJID(args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		if room, err = ch.room(); err != nil {
+			return err
+		}
+	}
+	return ch.c.printOccupants(room.Bare())
+}
+
+// cmdPM messages someone in the current room without the rest of the room
+// seeing it. Without a message it makes them the target so that the
+// conversation stays private.
+func (ch *chat) cmdPM(args []string, text string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	room, err := ch.room()
+	if err != nil {
+		return err
+	}
+	to, err := room.WithResource(args[0])
+	if err != nil {
+		return err
+	}
+	ch.c.mu.Lock()
+	_, present := ch.c.occupants[room.String()][args[0]]
+	ch.c.mu.Unlock()
+	if !present {
+		return fmt.Errorf("nobody called %s is in %s", args[0], room)
+	}
+	if len(args) > 1 {
+		ch.sendMessage(to, false, skipFields(text, 1), nil, nil)
+		return nil
+	}
+	ch.to = to
+	ch.groupchat = false
+	fmt.Printf("Now messaging %s in %s privately\n", args[0], room)
+	return nil
+}
+
+// roleCommand returns a command that gives the occupant with a nickname in
+// the current room a role.
+func (ch *chat) roleCommand(role string) func([]string, string) error {
+	return func(args []string, text string) error {
+		if len(args) == 0 {
+			return errUsage
+		}
+		room, err := ch.room()
+		if err != nil {
+			return err
+		}
+		return ch.c.setOccupant(ch.ctx, room, args[0], jid.JID{}, "role", role, skipFields(text, 1))
+	}
+}
+
+func (ch *chat) cmdBan(args []string, text string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	room, err := ch.room()
+	if err != nil {
+		return err
+	}
+	user, err := parseJID(args[0])
+	if err != nil {
+		return err
+	}
+	err = ch.c.setOccupant(ch.ctx, room, "", user, "affiliation", "outcast", skipFields(text, 1))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Banned %s from %s\n", user.Bare(), room)
+	return nil
+}
+
+func (ch *chat) cmdAffiliation(args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	switch args[1] {
+	case "owner", "admin", "member", "none":
+	default:
+		return errUsage
+	}
+	room, err := ch.room()
+	if err != nil {
+		return err
+	}
+	user, err := parseJID(args[0])
+	if err != nil {
+		return err
+	}
+	err = ch.c.setOccupant(ch.ctx, room, "", user, "affiliation", args[1], "")
+	if err != nil {
+		return err
+	}
+	if args[1] == "none" {
+		fmt.Printf("%s is no longer affiliated with %s\n", user.Bare(), room)
+	} else {
+		fmt.Printf("%s is now %s of %s\n", user.Bare(), article(args[1]), room)
+	}
+	return nil
+}
+
+func (ch *chat) cmdSubject(args []string, subject string) error {
+	if len(args) == 0 {
+		subject = ""
+	}
+	if err := ch.c.setSubject(ch.ctx, ch.to, ch.groupchat, subject); err != nil {
+		return err
+	}
+	// Rooms tell everyone about the new topic, us included
+	switch {
+	case ch.groupchat:
+	case subject == "":
+		fmt.Printf("Cleared the subject of the chat with %s\n", ch.to)
+	default:
+		fmt.Printf("Subject of the chat with %s is now: %s\n", ch.to, subject)
+	}
+	return nil
+}
+
+func (ch *chat) cmdThread(args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	peer := ch.to.Bare().String()
+	if len(args) == 1 {
+		switch args[0] {
+		case "new":
+			ch.c.setThread(peer, newID())
+		case "off":
+			ch.c.setThread(peer, "")
+		default:
+			ch.c.setThread(peer, ch.c.lookupThread(args[0]))
+		}
+	}
+	if t := ch.c.currentThread(peer); t != nil {
+		fmt.Printf("Messages to %s go in thread %s (%s)\n", peer, threadTag(t.ID), t.ID)
+	} else {
+		fmt.Printf("Messages to %s are not in a thread\n", peer)
+	}
+	return nil
+}
+
+func (ch *chat) cmdStatus(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	ch.c.printStatus(ch.ctx)
+	return nil
+}
+
+func (ch *chat) cmdReconnect(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	return ch.c.restart(ch.ctx)
+}
+
+func (ch *chat) cmdRoster([]string) error {
+	items, err := ch.c.fetchRoster(ch.ctx)
+	switch {
+	case errors.Is(err, errDisconnected) && ch.c.rosterCache != nil:
+		fmt.Println("Not connected, showing the cached roster")
+		items = ch.c.rosterItems()
+	case err != nil:
+		return fmt.Errorf("fetching roster: %w", err)
+	}
+	printRoster(items)
+	return nil
+}
+
+func (ch *chat) cmdWho([]string) error {
+	ch.c.printContacts()
+	return nil
+}
+
+func (ch *chat) cmdHistory(args []string) error {
+	with, err := optionalJID(args)
+	if err != nil {
+		return err
+	}
+	results, err := ch.c.fetchArchive(ch.ctx, with)
+	if err != nil {
+		return fmt.Errorf("fetching archive: %w", err)
+	}
+	ch.c.printArchive(results)
+	return nil
+}
+
+// cmdSearch looks for messages in the -history file, which unlike /history
+// works offline and with servers that don't archive messages.
+func (ch *chat) cmdSearch(args []string) error {
+	if ch.c.history == nil {
+		return errors.New("no history is kept, start with -history to keep one")
+	}
+	var q historyQuery
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		opt := args[0]
+		if opt == "-i" {
+			q.ignoreCase = true
+			args = args[1:]
+			continue
+		}
+		if len(args) < 2 {
+			return errUsage
+		}
+		var err error
+		switch opt {
+		case "-with":
+			q.with, err = parseJID(args[1])
+		case "-since":
+			q.since, err = time.ParseInLocation(time.DateOnly, args[1], time.Local)
+		case "-until":
+			// Until the end of that day
+			q.until, err = time.ParseInLocation(time.DateOnly, args[1], time.Local)
+			q.until = q.until.AddDate(0, 0, 1)
+		default:
+			return errUsage
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", opt, err)
+		}
+		args = args[2:]
+	}
+	if len(args) == 0 {
+		return errUsage
+	}
+	q.term = strings.Join(args, " ")
+
+	results, err := ch.c.history.search(q)
+	if err != nil {
+		return fmt.Errorf("searching history: %w", err)
+	}
+	if len(results) == 0 {
+		fmt.Printf("No messages containing %q\n", q.term)
+		return nil
+	}
+	printSearch(results)
+	return nil
+}
+
+func (ch *chat) cmdPasswd(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	if err := ch.c.changePassword(ch.ctx, args[0]); err != nil {
+		return fmt.Errorf("changing password: %w", err)
+	}
+	fmt.Printf("Changed the password of %s\n", ch.c.addr.Bare())
+	return nil
+}
+
+func (ch *chat) cmdCommand(args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errUsage
+	}
+	to, err := parseJID(args[0])
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 {
+		found, err := ch.c.listCommands(ch.ctx, to)
+		if err != nil {
+			return fmt.Errorf("listing commands of %s: %w", to, err)
+		}
+		printCommands(to, found)
+		return nil
+	}
+	err = ch.c.runCommand(ch.ctx, to, args[1], ch.ask)
+	if errors.Is(err, errCancelled) {
+		fmt.Printf("Cancelled %s\n", args[1])
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("running %s: %w", args[1], err)
+	}
+	return nil
+}
+
+// ask is a prompter that reads the answer from the chat input, for commands
+// that need more than their arguments.
+func (ch *chat) ask(prompt string, private bool) (string, error) {
+	var answer string
+	var err error
+	if t, ok := ch.input.(interface {
+		ReadPassword(prompt string) (string, error)
+	}); ok && private {
+		answer, err = t.ReadPassword(prompt)
+	} else {
+		// Without line editing there is no prompt
+		if _, ok := ch.input.(plainInput); ok {
+			fmt.Print(prompt)
+		}
+		ch.input.SetPrompt(prompt)
+		answer, err = ch.input.ReadLine()
+	}
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(answer) == "/cancel" {
+		return "", errCancelled
+	}
+	return answer, nil
+}
+
+func (ch *chat) cmdDisco(args []string) error {
+	entity, err := optionalJID(args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		entity = ch.c.addr.Domain()
+	}
+	info, err := ch.c.discoInfo(ch.ctx, entity)
+	if err != nil {
+		return fmt.Errorf("querying %s: %w", entity, err)
+	}
+	found, err := ch.c.discoItems(ch.ctx, entity)
+	if err != nil {
+		fmt.Printf("Error listing items of %s: %s\n", entity, explainError(err))
+	}
+	printDisco(entity, info, found)
+	return nil
+}
+
+func (ch *chat) cmdVersion(args []string) error {
+	entity, err := optionalJID(args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		entity = ch.c.LocalAddr().Domain()
+	}
+	q, err := ch.c.fetchVersion(ch.ctx, entity)
+	if err != nil {
+		return fmt.Errorf("querying %s: %w", entity, err)
+	}
+	printVersion(entity, q)
+	return nil
+}
+
+func (ch *chat) cmdTime(args []string) error {
+	entity, err := optionalJID(args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		entity = ch.c.LocalAddr().Domain()
+	}
+	t, err := ch.c.fetchTime(ch.ctx, entity)
+	if err != nil {
+		return fmt.Errorf("querying %s: %w", entity, err)
+	}
+	printTime(entity, t)
+	return nil
+}
+
+func (ch *chat) cmdVCard(args []string) error {
+	owner, err := optionalJID(args)
+	if err != nil {
+		return err
+	}
+	// Our own vCard is fetched without a to address
+	card, err := ch.c.fetchVCard(ch.ctx, owner)
+	if err != nil {
+		return fmt.Errorf("fetching vCard: %w", err)
+	}
+	if len(args) == 0 {
+		owner = ch.c.LocalAddr().Bare()
+	}
+	printVCard(owner, card)
+	return nil
+}
+
+func (ch *chat) cmdAvatar(args []string) error {
+	owner, err := optionalJID(args)
+	if err != nil {
+		return err
+	}
+	data, typ, err := ch.c.fetchAvatar(ch.ctx, owner)
+	if err != nil {
+		return fmt.Errorf("fetching avatar: %w", err)
+	}
+	if len(args) == 0 {
+		owner = ch.c.LocalAddr()
+	}
+	name, err := ch.c.saveAvatar(owner, data, typ)
+	if err != nil {
+		return fmt.Errorf("saving avatar: %w", err)
+	}
+	fmt.Printf("Saved avatar of %s to %s\n", owner.Bare(), name)
+	return nil
+}
+
+func (ch *chat) cmdNick(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	nick := strings.Join(args, " ")
+	err := ch.c.setNick(ch.ctx, nick)
+	if err != nil {
+		return fmt.Errorf("publishing nickname: %w", err)
+	}
+	fmt.Printf("Your nickname is now %s\n", nick)
+	if ch.c.configPath != "" {
+		err = setConfigValue(ch.c.configPath, "nick", nick)
+		if err != nil {
+			return fmt.Errorf("saving nickname: %w", err)
+		}
+	}
+	return nil
+}
+
+func (ch *chat) cmdPublish(args []string, text string) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	node := args[0]
+	payload, err := parsePayload(node, skipFields(text, 1))
+	if err != nil {
+		return fmt.Errorf("parsing payload: %w", err)
+	}
+	err = ch.c.publish(ch.ctx, node, payload)
+	if err != nil {
+		return fmt.Errorf("publishing to %s: %w", node, err)
+	}
+	fmt.Printf("Published to %s\n", node)
+	return nil
+}
+
+func (ch *chat) cmdRaw(args []string, text string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	s, err := parseStanza(text)
+	if err != nil {
+		return fmt.Errorf("parsing stanza: %w", err)
+	}
+	if err := ch.c.Send(ch.ctx, s.TokenReader()); err != nil {
+		return fmt.Errorf("sending stanza: %w", err)
+	}
+	sent, err := formatXML(s.TokenReader())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Sent %s\n", sent)
+	return nil
+}
+
+func (ch *chat) cmdSubscribe(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	node := args[0]
+	owner, err := optionalJID(args[1:])
+	if err != nil {
+		return err
+	}
+	pending, err := ch.c.subscribe(ch.ctx, owner.Bare(), node)
+	if err != nil {
+		return fmt.Errorf("subscribing to %s: %w", node, err)
+	}
+	if len(args) == 1 {
+		owner = ch.c.LocalAddr()
+	}
+	if pending {
+		fmt.Printf("Subscription to %s of %s is waiting for approval\n", node, owner.Bare())
+	} else {
+		fmt.Printf("Subscribed to %s of %s\n", node, owner.Bare())
+	}
+	return nil
+}
+
+// showCommand returns a command that sets our presence to show, or plain
+// available if it's empty, with the rest of the line as status message.
+func (ch *chat) showCommand(show string) func([]string, string) error {
+	return func(args []string, status string) error {
+		if len(args) == 0 {
+			status = ""
+		}
+		err := ch.c.setPresence(ch.ctx, show, status)
+		if err != nil {
+			return fmt.Errorf("setting presence: %w", err)
+		}
+		fmt.Printf("You are now %s\n", contactPresence{Online: true, Show: show, Status: status})
+		return nil
+	}
+}
+
+func (ch *chat) cmdAdd(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	contact, err := parseJID(args[0])
+	if err != nil {
+		return err
+	}
+	err = ch.c.sendSubscription(ch.ctx, contact, stanza.SubscribePresence)
+	if err != nil {
+		return fmt.Errorf("sending subscription request: %w", err)
+	}
+	fmt.Printf("Sent subscription request to %s\n", contact.Bare())
+	return nil
+}
+
+// subscriptionCommand returns a command that accepts or denies a pending
+// subscription request.
+func (ch *chat) subscriptionCommand(accept bool) func([]string) error {
+	return func(args []string) error {
+		contact, err := optionalJID(args)
+		if err != nil {
+			return err
+		}
+		contact, err = ch.c.answerSubscription(ch.ctx, contact, accept)
+		if err != nil {
+			return fmt.Errorf("answering subscription request: %w", err)
+		}
+		if accept {
+			fmt.Printf("Accepted subscription from %s\n", contact.Bare())
+		} else {
+			fmt.Printf("Denied subscription from %s\n", contact.Bare())
+		}
+		return nil
+	}
+}
+
+// parseJIDs parses one or more JID arguments.
+func parseJIDs(args []string) ([]jid.JID, error) {
+	if len(args) == 0 {
+		return nil, errUsage
+	}
+	jids := make([]jid.JID, 0, len(args))
+	for _, arg := range args {
+		j, err := parseJID(arg)
+		if err != nil {
+			return nil, err
+		}
+		jids = append(jids, j)
+	}
+	return jids, nil
+}
+
+func (ch *chat) cmdBlock(args []string) error {
+	jids, err := parseJIDs(args)
+	if err != nil {
+		return err
+	}
+	err = ch.c.block(ch.ctx, jids)
+	if err != nil {
+		return fmt.Errorf("blocking: %w", err)
+	}
+	// The server confirms with a push, but only if it implements blocking
+	ok, err := ch.c.supports(ch.ctx, ch.c.LocalAddr().Domain(), nsBlocking)
+	switch {
+	case err != nil:
+		fmt.Printf("Error checking for blocking support: %s\n", explainError(err))
+	case !ok:
+		fmt.Printf("Warning: %s does not advertise blocking support, you may not be blocking anyone\n", ch.c.LocalAddr().Domain())
+	}
+	return nil
+}
+
+func (ch *chat) cmdUnblock(args []string) error {
+	jids, err := parseJIDs(args)
+	if err != nil {
+		return err
+	}
+	err = ch.c.unblock(ch.ctx, jids)
+	if err != nil {
+		return fmt.Errorf("unblocking: %w", err)
+	}
+	return nil
+}
+
+func (ch *chat) cmdBlocklist([]string) error {
+	jids, err := ch.c.fetchBlocklist(ch.ctx)
+	if err != nil {
+		return fmt.Errorf("fetching block list: %w", err)
+	}
+	printBlocklist(jids)
+	return nil
+}
+
+func (ch *chat) cmdTrust(args []string) error {
+	if ch.c.omemo == nil {
+		return errors.New("OMEMO is off, start with -omemo to use it")
+	}
+	if len(args) == 0 {
+		fmt.Printf("Your OMEMO device is %d with fingerprint %s\n", ch.c.omemo.DeviceID, ch.c.omemo.Fingerprint())
+		return nil
+	}
+	owner, err := parseJID(args[0])
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 {
+		err = ch.c.printOMEMODevices(ch.ctx, owner)
+		if err != nil {
+			return fmt.Errorf("fetching OMEMO devices: %w", err)
+		}
+		return nil
+	}
+	id, err := ch.c.trustDevice(owner, strings.Join(args[1:], ""))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Verified device %d of %s, messages to %[2]s are now only encrypted for verified devices\n", id, owner.Bare())
+	return nil
+}
+
+func (ch *chat) cmdHelp([]string) error {
+	ch.commands.printCommands()
+	return nil
+}
+
+// send sends msg to the current target.
+func (ch *chat) send(msg string) {
+	ch.sendMessage(ch.to, ch.groupchat, msg, nil, nil)
+}
+
+// sendMessage sends msg to to, a room if groupchat is set, replacing an
+// earlier message if replace is set and sharing a link if oob is set.
+func (ch *chat) sendMessage(to jid.JID, groupchat bool, msg string, replace *correction, oob *oobData) {
+	c := ch.c
+	id := newID()
+	var msgBody messageBody
+	// Receipts aren't requested for groupchat messages
+	if groupchat {
+		msgBody = messageBody{
+			Message: stanza.Message{
+				ID:   id,
+				To:   to,
+				From: c.LocalAddr(),
+				Type: stanza.GroupChatMessage,
+			},
+			Body:    msg,
+			Thread:  c.currentThread(to.Bare().String()),
+			Active:  &struct{}{},
+			Replace: replace,
+			OOB:     oob,
+		}
+	} else {
+		c.receipts.add(id, msg)
+		c.markers.add(id, msg)
+		msgBody = messageBody{
+			Message: stanza.Message{
+				ID:   id,
+				To:   to,
+				From: c.LocalAddr(),
+				Type: stanza.ChatMessage,
+			},
+			Body:     msg,
+			Thread:   c.currentThread(to.Bare().String()),
+			Active:   &struct{}{},
+			Request:  &struct{}{},
+			Markable: &struct{}{},
+			Replace:  replace,
+			OOB:      oob,
+			Nick:     c.Nick(),
+		}
+		// Occupants of rooms know us by our nickname in the room
+		if c.isOccupant(to) {
+			msgBody.MUCUser = &struct{}{}
+			msgBody.Nick = ""
+		}
+	}
+	if !groupchat {
+		ch.stoppedTyping()
+	}
+	queued, err := c.sendMessage(ch.ctx, msgBody)
+	if err != nil {
+		c.receipts.done(id)
+		c.markers.done(id)
+	}
+	if err == nil {
+		c.recordHistory("out", to, msg)
+		// Corrections always refer to the original message
+		if replace == nil {
+			if ch.lastSent == nil {
+				ch.lastSent = make(map[string]string)
+			}
+			ch.lastSent[to.Bare().String()] = id
+		}
+	}
+	switch {
+	case queued:
+		c.report(event{Type: "queued", To: to.String(), ID: id, Body: msg},
+			"%s(queued) %s\n", c.timestamp(time.Now()), msg)
+	case errors.Is(err, errQueueFull):
+		c.report(event{Type: "error", To: to.String(), ID: id, Error: "not connected and too many messages queued, message was not sent"},
+			"Not connected and %d messages are already queued, message was not sent\n", maxQueued)
+	case err != nil:
+		c.logger.Printf("Error sending message: %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// How long after the last key press we tell the contact we stopped typing
+const pausedAfter = 5 * time.Second
+
+// typingState is what we last told a contact about typing to them with
+// XEP-0085 chat states.
+type typingState struct {
+	mu sync.Mutex
+	// Contact we told we are composing, the zero JID if nobody
+	to    jid.JID
+	timer *time.Timer
+	// Counts key presses so that a timer that fired late can tell it is stale
+	gen int
+}
+
+// typed tells the current target that we are composing a message when the
+// first character of it is typed, and that we paused once nothing else was
+// typed for a while. Commands and room messages aren't announced.
+func (ch *chat) typed(line string, pos int, key rune) {
+	if ch.groupchat || ch.c.dryRun != nil {
+		return
+	}
+	if text := line[:pos] + string(key) + line[pos:]; strings.HasPrefix(text, "/") {
+		return
+	}
+
+	t := &ch.typing
+	to := ch.to
+	t.mu.Lock()
+	start := !t.to.Equal(to)
+	t.to = to
+	t.gen++
+	gen := t.gen
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.timer = time.AfterFunc(pausedAfter, func() {
+		t.mu.Lock()
+		if t.gen != gen {
+			t.mu.Unlock()
+			return
+		}
+		t.to = jid.JID{}
+		t.mu.Unlock()
+		ch.sendChatState(to, messageBody{Paused: &struct{}{}})
+	})
+	t.mu.Unlock()
+
+	if start {
+		ch.sendChatState(to, messageBody{Composing: &struct{}{}})
+	}
+}
+
+// stoppedTyping forgets that we are composing, for when the message was sent
+// with <active/>.
+func (ch *chat) stoppedTyping() {
+	t := &ch.typing
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.gen++
+	t.to = jid.JID{}
+}
+
+// sendChatState sends a message with nothing but the chat state set in state.
+// It isn't queued while disconnected as it would be out of date by the time it
+// arrives.
+func (ch *chat) sendChatState(to jid.JID, state messageBody) {
+	state.Message = stanza.Message{
+		ID:   newID(),
+		To:   to,
+		Type: stanza.ChatMessage,
+	}
+	if err := ignoreDisconnected(ch.c.Encode(ch.ctx, state)); err != nil {
+		ch.c.logger.Printf("Error sending chat state: %v", err)
+	}
+}
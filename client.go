@@ -0,0 +1,531 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"text/template"
+	"time"
+
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/carbons"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/roster"
+	"mellium.im/xmpp/stanza"
+	"mellium.im/xmpp/stream"
+)
+
+const (
+	maxBackoff = 60 * time.Second
+	// Least time to wait before reconnecting after being replaced by another
+	// session or told off by the server
+	conflictBackoff = 15 * time.Second
+)
+
+// How long to wait for the response to a request, tests make it shorter
+var requestTimeout = 30 * time.Second
+
+// Stream error conditions after which connecting again won't help until
+// something is fixed (RFC 6120 section 4.9.3). After the others, like
+// system-shutdown, reconnecting is worth a try.
+var fatalStreamErrors = map[string]bool{
+	stream.BadFormat.Err:             true,
+	stream.BadNamespacePrefix.Err:    true,
+	stream.HostGone.Err:              true,
+	stream.HostUnknown.Err:           true,
+	stream.ImproperAddressing.Err:    true,
+	stream.InvalidFrom.Err:           true,
+	stream.InvalidNamespace.Err:      true,
+	stream.InvalidXML.Err:            true,
+	stream.NotAuthorized.Err:         true,
+	stream.NotWellFormed.Err:         true,
+	stream.RestrictedXML.Err:         true,
+	stream.UnsupportedEncoding.Err:   true,
+	stream.UnsupportedFeature.Err:    true,
+	stream.UnsupportedStanzaType.Err: true,
+	stream.UnsupportedVersion.Err:    true,
+}
+
+var errDisconnected = errors.New("not connected to the server")
+
+// client owns the current XMPP session and re-establishes it when the
+// connection drops.
+type client struct {
+	logger *log.Logger
+	addr   jid.JID
+	// Shown in front of what happens on this account when logged into more
+	// than one, empty otherwise
+	account    string
+	negotiator xmpp.Negotiator
+	dial       func(ctx context.Context) (net.Conn, xmpp.SessionState, error)
+	carbons    bool
+	// Connects to a host:port a see-other-host error sent us to, nil where the
+	// transport can't
+	dialHost func(ctx context.Context, host string) (net.Conn, xmpp.SessionState, error)
+	// Where the server last sent us, empty to connect as usual
+	otherHost string
+	redirects *redirectWatcher
+	// How long dialing and logging in may take, see -timeout
+	timeout time.Duration
+	// Called to exit after an error that reconnecting won't fix, if set
+	quit func()
+	// Send displayed chat markers for messages that ask for them
+	readMarkers bool
+	// Ring the terminal bell when asked for our attention
+	bell bool
+	// Layout of the time shown in front of messages, empty to not show it
+	timeFormat string
+	// -format template messages are shown with
+	format *template.Template
+	// Where to save files shared with us, empty to not download them
+	downloadDir string
+	// Stanzas go here instead of to a session when set, see -dry-run
+	dryRun stanzaWriter
+	// Incoming messages and other events are written here as JSON instead of
+	// being printed when set, see -json
+	events *eventWriter
+
+	receipts receiptTracker
+	// Sent messages waiting for a displayed marker
+	markers receiptTracker
+	history *historyLog
+
+	mu      sync.Mutex
+	session *xmpp.Session
+	closed  bool
+	backoff time.Duration
+	rooms   map[string]jid.JID
+	// Role, affiliation and JID of everyone in the rooms we are in by room and
+	// nickname
+	occupants map[string]map[string]occupant
+	// Messages typed while disconnected, sent once we are connected again
+	outbox []messageBody
+	// Set while reconnect runs or is about to, so that /reconnect doesn't start
+	// another attempt, and whether the last connection was dropped by it
+	reconnecting bool
+	restarting   bool
+	// Wakes reconnect up from waiting for its backoff
+	retry chan struct{}
+
+	subscriptionRequests map[string]jid.JID
+	contacts             map[string]contactPresence
+	// XEP-0115 capabilities advertised by each full JID
+	deviceCaps map[string]capsElement
+	mamQueries map[string][]mamResult
+	// Roster by bare JID, kept up to date by pushes, and its XEP-0237 version
+	roster    map[string]roster.Item
+	rosterVer string
+	// Where the roster is kept between runs, if anywhere
+	rosterCache *rosterCache
+
+	// Thread our messages to each bare JID go in, and the IDs of threads we
+	// have seen by their tag
+	threads    map[string]string
+	threadTags map[string]string
+
+	// Files being sent to us in-band by sender and session ID
+	transfers map[string]*ibbTransfer
+
+	// Connection health shown by /status
+	connectedAt  time.Time
+	lastReceived time.Time
+	lastPing     time.Time
+	pingRTT      time.Duration
+
+	// Full JID of the last contact that messaged us, for /reply
+	lastFrom jid.JID
+
+	// Our own availability, restored after a reconnect
+	show   string
+	status string
+	// Set while we are away only because nothing was typed, see -idle
+	idleAway bool
+	// XEP-0172 nickname sent along with messages
+	nick string
+	// Password we log in with, which /passwd changes
+	password string
+	// Config file that settings changed at runtime are saved to, if any
+	configPath string
+	// Our OMEMO device, nil unless -omemo is set
+	omemo *omemoStore
+	// Our OpenPGP key, nil unless -pgp is set
+	pgp *openPGP
+	// Which messages to show a notification for, nil unless -notify is set
+	notifier *notifier
+	// Mechanism we authenticated with
+	saslUsed *saslTracker
+	// XEP-0198 state that lets a new connection resume the stream
+	sm *streamManagement
+}
+
+// connect dials the server and either resumes the previous stream or
+// negotiates a new session and sends our initial presence.
+func (c *client) connect(ctx context.Context) error {
+	dialCtx, dialCtxCancel := context.WithTimeout(ctx, c.timeout)
+	defer dialCtxCancel()
+
+	var session *xmpp.Session
+	for redirects := 0; ; redirects++ {
+		conn, state, err := c.dialServer(dialCtx)
+		if err != nil {
+			return fmt.Errorf("error dialing connection: %w", err)
+		}
+		c.sm.reset()
+
+		session, err = xmpp.NewSession(dialCtx, c.addr.Domain(), c.addr, conn, state, c.negotiator)
+		if err == nil {
+			break
+		}
+		conn.Close()
+		host := c.redirectedTo(err)
+		if host == "" {
+			return fmt.Errorf("error logging in: %w", err)
+		}
+		if redirects == maxRedirects {
+			c.mu.Lock()
+			c.otherHost = ""
+			c.mu.Unlock()
+			return fmt.Errorf("error logging in: the server sent us elsewhere %d times, last to %s", redirects+1, host)
+		}
+		c.logger.Printf("The server sent us to %s", host)
+		c.mu.Lock()
+		c.otherHost = host
+		c.mu.Unlock()
+	}
+	// The server kept our presence, rooms and carbons for a resumed stream
+	resumed := c.sm.isResumed()
+	if !resumed {
+		if want := c.addr.Resourcepart(); want != "" && session.LocalAddr().Resourcepart() != want {
+			c.logger.Printf("Asked for resource %s but the server bound %s", want, session.LocalAddr())
+		}
+		fmt.Printf("Connected as %s\n", session.LocalAddr())
+		c.saslUsed.check(c.logger)
+
+		// Send initial presence to let us receive message from server
+		err := session.Send(ctx, c.ownPresence())
+		if err != nil {
+			session.Conn().Close()
+			return fmt.Errorf("error sending initial presence: %w", err)
+		}
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		session.Close()
+		session.Conn().Close()
+		return errDisconnected
+	}
+	c.session = session
+	c.connectedAt = time.Now()
+	var occupants []jid.JID
+	if !resumed {
+		for _, occupant := range c.rooms {
+			occupants = append(occupants, occupant)
+		}
+		// Rejoining tells us who is in the rooms again
+		c.occupants = nil
+	}
+	c.mu.Unlock()
+
+	// Rejoin any rooms we were in before the connection dropped
+	for _, occupant := range occupants {
+		if err := c.joinRoom(ctx, occupant); err != nil {
+			c.logger.Printf("Error rejoining %s: %v", occupant.Bare(), err)
+		}
+	}
+
+	go c.serve(ctx, session)
+	c.resendUnacked(ctx)
+
+	// IQs need the session to be served so that we can read the response
+	if c.carbons && !resumed {
+		carbonsCtx, carbonsCancel := context.WithTimeout(ctx, requestTimeout)
+		err := carbons.Enable(carbonsCtx, session)
+		carbonsCancel()
+		if err != nil {
+			c.logger.Printf("Error enabling message carbons: %v", err)
+		}
+	}
+	if !resumed {
+		if _, err := c.fetchRoster(ctx); err != nil {
+			c.logger.Printf("Error fetching roster: %v", err)
+		}
+	}
+	if c.omemo != nil && !resumed {
+		if err := c.setupOMEMO(ctx); err != nil {
+			c.logger.Printf("Error setting up OMEMO: %v", err)
+		}
+	}
+	c.flushQueue(ctx)
+	return nil
+}
+
+// serve handles incoming stanzas until the session ends and then starts
+// reconnecting unless we are shutting down.
+func (c *client) serve(ctx context.Context, session *xmpp.Session) {
+	started := time.Now()
+	err := session.Serve(c)
+	session.Conn().Close()
+
+	c.mu.Lock()
+	if c.session == session {
+		c.session = nil
+	}
+	// Only start over with a short backoff if the session was up for a while,
+	// otherwise a server that drops us right after login is hammered.
+	if time.Since(started) > maxBackoff {
+		c.backoff = 0
+	}
+	closed, restarting := c.closed, c.restarting
+	c.reconnecting, c.restarting = !closed, false
+	c.mu.Unlock()
+
+	if closed || ctx.Err() != nil {
+		return
+	}
+	var se stream.Error
+	switch {
+	case restarting:
+		// Asked for by /reconnect, the error is from closing the connection
+	case errors.As(err, &se):
+		c.logger.Printf("Server ended the stream: %s", explainError(err))
+		if host := c.redirectedTo(err); host != "" {
+			c.logger.Printf("The server sent us to %s", host)
+			c.mu.Lock()
+			c.otherHost = host
+			c.mu.Unlock()
+		}
+		if fatalStreamErrors[se.Err] {
+			c.logger.Printf("Not reconnecting, restart once this is fixed")
+			c.mu.Lock()
+			c.reconnecting = false
+			c.mu.Unlock()
+			if c.quit != nil {
+				c.quit()
+			}
+			return
+		}
+		// Coming straight back would take over from the session that replaced
+		// us, which may then do the same
+		if se.Err == stream.Conflict.Err || se.Err == stream.PolicyViolation.Err {
+			c.mu.Lock()
+			c.backoff = max(c.backoff, conflictBackoff)
+			c.mu.Unlock()
+		}
+	case err != nil:
+		c.logger.Printf("Connection lost: %v", err)
+	default:
+		c.logger.Printf("Connection closed by server")
+	}
+	c.reconnect(ctx)
+}
+
+// reconnect tries to connect again with exponential backoff until it succeeds
+// or ctx is cancelled. The caller sets c.reconnecting.
+func (c *client) reconnect(ctx context.Context) {
+	defer func() {
+		c.mu.Lock()
+		c.reconnecting = false
+		c.mu.Unlock()
+	}()
+	// A /reconnect from before this started has been answered by it
+	select {
+	case <-c.retry:
+	default:
+	}
+	for attempt := 1; ; attempt++ {
+		c.mu.Lock()
+		backoff := c.backoff
+		c.backoff = min(max(2*backoff, time.Second), maxBackoff)
+		c.mu.Unlock()
+
+		if backoff > 0 {
+			c.logger.Printf("Reconnecting in %v...", backoff)
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.retry:
+			case <-time.After(backoff):
+			}
+		}
+
+		c.logger.Printf("Reconnecting (attempt %d)...", attempt)
+		err := c.connect(ctx)
+		if err == nil {
+			if c.sm.isResumed() {
+				c.logger.Printf("Reconnected and resumed the previous session")
+			} else {
+				c.logger.Printf("Reconnected with a new session")
+			}
+			return
+		}
+		if ctx.Err() != nil || errors.Is(err, errDisconnected) {
+			return
+		}
+		if permanentError(err) {
+			c.logger.Printf("Not reconnecting, restart once this is fixed: %v", err)
+			return
+		}
+		c.logger.Printf("Error reconnecting: %v", err)
+	}
+}
+
+// restart drops the connection and connects again, resuming the stream if the
+// server still has it, for when the network changed under us. If we are
+// already reconnecting it tries again right away instead of waiting.
+func (c *client) restart(ctx context.Context) error {
+	if c.dryRun != nil {
+		return errDryRun
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errDisconnected
+	}
+	c.backoff = 0
+	switch {
+	case c.session != nil:
+		// serve takes it from there
+		c.restarting = true
+		c.session.Conn().Close()
+	case c.reconnecting:
+		select {
+		case c.retry <- struct{}{}:
+		default:
+		}
+	default:
+		// We gave up after an error, try again
+		c.reconnecting = true
+		go c.reconnect(ctx)
+	}
+	return nil
+}
+
+// Session returns the current session or nil while disconnected.
+func (c *client) Session() *xmpp.Session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.session
+}
+
+// LocalAddr returns the address bound to the current session, which may differ
+// from the one we logged in with, or the login address while disconnected.
+func (c *client) LocalAddr() jid.JID {
+	if session := c.Session(); session != nil {
+		return session.LocalAddr()
+	}
+	return c.addr
+}
+
+// Encode writes v to the current session. Errors on the connection drop it so
+// that the reconnect logic can take over, others only fail this write.
+func (c *client) Encode(ctx context.Context, v interface{}) error {
+	if c.dryRun != nil {
+		return c.dryRun.Encode(ctx, v)
+	}
+	session := c.Session()
+	if session == nil {
+		return errDisconnected
+	}
+	err := session.Encode(ctx, v)
+	if err != nil && ctx.Err() == nil && connError(err) {
+		session.Conn().Close()
+	}
+	return err
+}
+
+// Send writes the tokens from r to the current session. Errors on the
+// connection drop it so that the reconnect logic can take over, others only
+// fail this write.
+func (c *client) Send(ctx context.Context, r xml.TokenReader) error {
+	if c.dryRun != nil {
+		return c.dryRun.Send(ctx, r)
+	}
+	session := c.Session()
+	if session == nil {
+		return errDisconnected
+	}
+	err := session.Send(ctx, r)
+	if err != nil && ctx.Err() == nil && connError(err) {
+		session.Conn().Close()
+	}
+	return err
+}
+
+// Close goes offline and ends the session. It is safe to call more than once.
+func (c *client) Close() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	session := c.session
+	c.mu.Unlock()
+
+	fmt.Println("Closing session...")
+	if session == nil {
+		return
+	}
+
+	// The root context may already be cancelled, so give going offline its
+	// own deadline
+	offlineCtx, offlineCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	err := session.Send(offlineCtx, stanza.Presence{ID: newID(), Type: stanza.UnavailablePresence}.Wrap(nil))
+	offlineCancel()
+	if err != nil {
+		c.logger.Printf("Error sending unavailable presence: %v", err)
+	}
+
+	if err := session.Close(); err != nil {
+		c.logger.Printf("Error ending session: %v", err)
+	}
+	if err := session.Conn().Close(); err != nil {
+		c.logger.Printf("Error ending connection: %v", err)
+	}
+}
+
+// connError reports whether err came from the connection rather than from
+// encoding what we tried to send, so the stream can't be used anymore.
+func connError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, net.ErrClosed)
+}
+
+// permanentError reports whether connecting failed in a way that trying again
+// won't fix, such as the server rejecting our password or certificate.
+func permanentError(err error) bool {
+	var certErr *tls.CertificateVerificationError
+	var hostErr x509.HostnameError
+	var authorityErr x509.UnknownAuthorityError
+	if errors.As(err, &certErr) || errors.As(err, &hostErr) || errors.As(err, &authorityErr) || errors.Is(err, errPlainUnencrypted) {
+		return true
+	}
+	var se stream.Error
+	if errors.As(err, &se) {
+		return fatalStreamErrors[se.Err]
+	}
+	// The library doesn't export its SASL failure, so look at how it would be
+	// sent instead
+	var failure interface {
+		error
+		TokenReader() xml.TokenReader
+	}
+	if !errors.As(err, &failure) {
+		return false
+	}
+	tok, err := failure.TokenReader().Token()
+	if err != nil {
+		return false
+	}
+	start, ok := tok.(xml.StartElement)
+	return ok && start.Name == xml.Name{Space: nsSASL, Local: "failure"}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// errUsage is returned by command handlers that were called with the wrong
+// arguments.
+var errUsage = errors.New("invalid arguments")
+
+// command is a slash command understood by the read loop.
+type command struct {
+	name        string
+	args        string
+	description string
+	// Gets the arguments split on whitespace and the rest of the line after
+	// the name as it was typed
+	run func(args []string, text string) error
+}
+
+// commandRegistry maps command names to their handlers, keeping the order in
+// which they were registered for /help.
+type commandRegistry struct {
+	list   []*command
+	byName map[string]*command
+}
+
+func (r *commandRegistry) register(name, args, description string, run func(args []string) error) {
+	r.registerText(name, args, description, func(args []string, _ string) error {
+		return run(args)
+	})
+}
+
+// registerText adds a command that also takes text, such as a message, which
+// has to keep the whitespace it was typed with.
+func (r *commandRegistry) registerText(name, args, description string, run func(args []string, text string) error) {
+	if r.byName == nil {
+		r.byName = make(map[string]*command)
+	}
+	cmd := &command{name: name, args: args, description: description, run: run}
+	r.list = append(r.list, cmd)
+	r.byName[name] = cmd
+}
+
+// dispatch runs the command on line. Usage errors are printed, any other error
+// is returned.
+func (r *commandRegistry) dispatch(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	cmd, ok := r.byName[fields[0]]
+	if !ok {
+		fmt.Printf("Unknown command %s, type /help for a list of commands\n", fields[0])
+		return nil
+	}
+
+	err := cmd.run(fields[1:], skipFields(line, 1))
+	if errors.Is(err, errUsage) {
+		fmt.Printf("Usage: %s %s\n", cmd.name, cmd.args)
+		return nil
+	}
+	return err
+}
+
+// skipFields returns what follows the first n fields of s and the whitespace
+// character after them, leaving the rest as it is.
+func skipFields(s string, n int) string {
+	for i := 0; i < n; i++ {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		end := strings.IndexFunc(s, unicode.IsSpace)
+		if end < 0 {
+			return ""
+		}
+		_, size := utf8.DecodeRuneInString(s[end:])
+		s = s[end+size:]
+	}
+	return s
+}
+
+func (r *commandRegistry) printCommands() {
+	w := newBlock()
+	for _, cmd := range r.list {
+		fmt.Fprintf(w, "%s %s\t%s\n", cmd.name, cmd.args, cmd.description)
+	}
+	fmt.Fprintf(w, "exit\tClose the session and quit\n")
+	w.Flush()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Commands whose argument is completed from the JIDs we know
+var jidCommands = map[string]bool{"/to": true, "/msg": true}
+
+// knownJIDs returns the bare JIDs in our roster and of contacts that are
+// online, sorted.
+func (c *client) knownJIDs() []string {
+	c.mu.Lock()
+	seen := make(map[string]bool, len(c.roster)+len(c.contacts))
+	for addr := range c.roster {
+		seen[addr] = true
+	}
+	for addr, p := range c.contacts {
+		if p.Online {
+			seen[addr] = true
+		}
+	}
+	c.mu.Unlock()
+
+	addrs := make([]string, 0, len(seen))
+	for addr := range seen {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// matchJIDs returns the addresses where either the whole JID or the localpart
+// starts with prefix, ignoring case.
+func matchJIDs(addrs []string, prefix string) []string {
+	prefix = strings.ToLower(prefix)
+	var matches []string
+	for _, addr := range addrs {
+		lower := strings.ToLower(addr)
+		local, _, _ := strings.Cut(lower, "@")
+		if strings.HasPrefix(lower, prefix) || strings.HasPrefix(local, prefix) {
+			matches = append(matches, addr)
+		}
+	}
+	return matches
+}
+
+// complete completes the JID after /to and /msg. When more than one matches,
+// the line is completed as far as they agree and the matches are listed.
+func (ch *chat) complete(line string, pos int) (string, int, bool) {
+	cmd, arg, ok := strings.Cut(line[:pos], " ")
+	if !ok || !jidCommands[cmd] || strings.Contains(arg, " ") {
+		return "", 0, false
+	}
+
+	matches := matchJIDs(ch.c.knownJIDs(), arg)
+	switch len(matches) {
+	case 0:
+		return line, pos, true
+	case 1:
+		completed := cmd + " " + matches[0]
+		if pos == len(line) {
+			completed += " "
+		}
+		return completed + line[pos:], len(completed), true
+	}
+
+	prefix := matches[0]
+	for _, addr := range matches[1:] {
+		for !strings.HasPrefix(addr, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	for !utf8.ValidString(prefix) {
+		prefix = prefix[:len(prefix)-1]
+	}
+	// Matches on the localpart may not share a prefix with what was typed
+	if len(prefix) > len(arg) && strings.HasPrefix(strings.ToLower(prefix), strings.ToLower(arg)) {
+		completed := cmd + " " + prefix
+		return completed + line[pos:], len(completed), true
+	}
+	printf("%s\n", strings.Join(matches, "  "))
+	return line, pos, true
+}
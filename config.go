@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+type config struct {
+	JID      string `toml:"jid"`
+	Password string `toml:"password"`
+	Server   string `toml:"server"`
+	Port     int    `toml:"port"`
+	Resource string `toml:"resource"`
+	Verbose  bool   `toml:"verbose"`
+	Nick     string `toml:"nick"`
+	// More accounts to log into at the same time, as [[account]] tables
+	Accounts []accountConfig `toml:"account"`
+}
+
+// accountConfig is an account other than the main one. Its messages are shown
+// with its name, or its JID if it has none.
+type accountConfig struct {
+	Name     string `toml:"name"`
+	JID      string `toml:"jid"`
+	Password string `toml:"password"`
+	Server   string `toml:"server"`
+	Port     int    `toml:"port"`
+	Resource string `toml:"resource"`
+	Nick     string `toml:"nick"`
+}
+
+func loadConfig(path string) (config, error) {
+	var cfg config
+	_, err := toml.DecodeFile(path, &cfg)
+	return cfg, err
+}
+
+// setConfigValue sets a top level key in the config file at path, keeping the
+// rest of the file, comments included, as it is.
+func setConfigValue(path, key string, value interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	err = toml.NewEncoder(&buf).Encode(map[string]interface{}{key: value})
+	if err != nil {
+		return err
+	}
+	line := strings.TrimSpace(buf.String())
+
+	lines := strings.Split(string(data), "\n")
+	insert := len(lines)
+	for i, l := range lines {
+		l = strings.TrimSpace(l)
+		// Keys after the first table header would end up in the table
+		if strings.HasPrefix(l, "[") {
+			insert = i
+			break
+		}
+		k, _, ok := strings.Cut(l, "=")
+		if ok && strings.Trim(strings.TrimSpace(k), `"`) == key {
+			lines[i] = line
+			return os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o600)
+		}
+	}
+	// Add the key after the last one instead of after blank lines
+	for insert > 0 && strings.TrimSpace(lines[insert-1]) == "" {
+		insert--
+	}
+	lines = slices.Insert(lines, insert, line)
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o600)
+}
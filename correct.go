@@ -0,0 +1,6 @@
+package main
+
+// XEP-0308 reference to the message being corrected
+type correction struct {
+	ID string `xml:"id,attr"`
+}
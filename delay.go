@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// XEP-0203 delayed delivery, when a message was originally sent
+type delay struct {
+	Stamp time.Time `xml:"stamp,attr"`
+}
+
+// sentAt returns when msg was originally sent, which is now unless the server
+// held on to it.
+func sentAt(msg messageBody) time.Time {
+	if msg.Delay != nil && !msg.Delay.Stamp.IsZero() {
+		return msg.Delay.Stamp
+	}
+	return time.Now()
+}
+
+// timestamp formats t to go in front of a message, see -timeformat.
+func (c *client) timestamp(t time.Time) string {
+	if c.timeFormat == "" {
+		return ""
+	}
+	return t.Local().Format(c.timeFormat) + " "
+}
+
+// chatPrefix goes in front of a chat message, marking messages that were
+// stored while we were offline with the date and time they were sent.
+func (c *client) chatPrefix(msg messageBody) string {
+	if msg.Delay == nil || msg.Delay.Stamp.IsZero() {
+		return c.timestamp(time.Now())
+	}
+	return fmt.Sprintf("(offline, %s) ", msg.Delay.Stamp.Local().Format("2006-01-02 15:04"))
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/jid"
+)
+
+// srvTargets looks up the SRV records of service for domain and returns them
+// as host:port pairs in order of preference. The resolver sorts them by
+// priority and shuffles records of the same priority by weight as RFC 2782
+// asks, so that servers with the same priority share the load.
+func srvTargets(ctx context.Context, service, domain string) []string {
+	_, srvs, err := net.DefaultResolver.LookupSRV(ctx, service, "tcp", domain)
+	if err != nil {
+		return nil
+	}
+	var targets []string
+	for _, srv := range srvs {
+		// A target of "." means the service is decidedly not available
+		if srv.Target == "." {
+			return nil
+		}
+		targets = append(targets, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+	}
+	return targets
+}
+
+// directTLSTargets looks up the _xmpps-client._tcp SRV records of domain
+// (XEP-0368).
+func directTLSTargets(ctx context.Context, domain string) []string {
+	return srvTargets(ctx, "xmpps-client", domain)
+}
+
+// startTLSTargets looks up the _xmpp-client._tcp SRV records of domain and
+// adds the default port of domain for when none of them can be reached. The
+// dialer of the library does much the same, but it can't go through a proxy or
+// race addresses.
+func startTLSTargets(ctx context.Context, domain string) []string {
+	return withFallback(srvTargets(ctx, "xmpp-client", domain), net.JoinHostPort(domain, "5222"))
+}
+
+// withFallback adds fallback to the end of targets unless it is one of them
+// already.
+func withFallback(targets []string, fallback string) []string {
+	for _, target := range targets {
+		if target == fallback {
+			return targets
+		}
+	}
+	return append(targets, fallback)
+}
+
+// dialTargets tries each of targets in turn for a connection to upgrade with
+// StartTLS.
+func dialTargets(ctx context.Context, d contextDialer, targets []string, debug *log.Logger) (net.Conn, error) {
+	err := errors.New("no targets to dial")
+	for _, target := range targets {
+		var conn net.Conn
+		conn, err = d.DialContext(ctx, "tcp", target)
+		if err == nil {
+			debug.Printf("Connected to %s (%s) using StartTLS", target, conn.RemoteAddr())
+			return conn, nil
+		}
+		debug.Printf("Error connecting to %s: %v", target, err)
+	}
+	return nil, err
+}
+
+// dialTLS tries each of targets in turn using implicit TLS.
+func dialTLS(ctx context.Context, d contextDialer, targets []string, tlsConfig *tls.Config, debug *log.Logger) (net.Conn, error) {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{"xmpp-client"}
+	err := errors.New("no targets to dial")
+	for _, target := range targets {
+		var conn net.Conn
+		conn, err = d.DialContext(ctx, "tcp", target)
+		if err != nil {
+			debug.Printf("Error connecting to %s: %v", target, err)
+			continue
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err = tlsConn.HandshakeContext(ctx); err == nil {
+			debug.Printf("Connected to %s (%s) using direct TLS", target, conn.RemoteAddr())
+			return tlsConn, nil
+		}
+		debug.Printf("Error with the TLS handshake of %s: %v", target, err)
+		conn.Close()
+	}
+	return nil, err
+}
+
+// dialDirectTLS connects using implicit TLS to hostport, or the JID's domain
+// when hostport is empty.
+func dialDirectTLS(ctx context.Context, d contextDialer, hostport string, addr jid.JID, tlsConfig *tls.Config, debug *log.Logger) (net.Conn, error) {
+	if hostport != "" {
+		return dialTLS(ctx, d, []string{hostport}, tlsConfig, debug)
+	}
+	var targets []string
+	if !resolvesRemotely(d) {
+		targets = directTLSTargets(ctx, addr.Domainpart())
+	}
+	return dialTLS(ctx, d, withFallback(targets, net.JoinHostPort(addr.Domainpart(), "5223")), tlsConfig, debug)
+}
+
+// dialDomain connects to the JID's domain, preferring direct TLS if the domain
+// advertises it and otherwise falling back to a plain connection that will be
+// upgraded with StartTLS. Through a proxy that resolves names itself the SRV
+// records can't be looked up, so the default StartTLS port is used.
+func dialDomain(ctx context.Context, d contextDialer, addr jid.JID, tlsConfig *tls.Config, debug *log.Logger) (net.Conn, xmpp.SessionState, error) {
+	if resolvesRemotely(d) {
+		conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(addr.Domainpart(), "5222"))
+		if err != nil {
+			return nil, 0, err
+		}
+		debug.Printf("Connected to %s through the proxy using StartTLS", addr.Domainpart())
+		return conn, 0, nil
+	}
+
+	if targets := directTLSTargets(ctx, addr.Domainpart()); len(targets) > 0 {
+		conn, err := dialTLS(ctx, d, targets, tlsConfig, debug)
+		if err == nil {
+			return conn, xmpp.Secure, nil
+		}
+		debug.Printf("Error connecting with direct TLS, falling back to StartTLS: %v", err)
+	} else {
+		debug.Printf("No direct TLS service found for %s, using StartTLS", addr.Domainpart())
+	}
+
+	conn, err := dialTargets(ctx, d, startTLSTargets(ctx, addr.Domainpart()), debug)
+	if err != nil {
+		return nil, 0, err
+	}
+	return conn, 0, nil
+}
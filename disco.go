@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/disco/items"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/ping"
+	"mellium.im/xmpp/stanza"
+	"mellium.im/xmpp/version"
+	"mellium.im/xmpp/xtime"
+)
+
+// clientFeatures are the features we advertise to other entities.
+var clientFeatures = []string{
+	disco.NSInfo,
+	ping.NS,
+	version.NS,
+	xtime.NS,
+	"http://jabber.org/protocol/chatstates",
+	"urn:xmpp:receipts",
+	"urn:xmpp:chat-markers:0",
+	"urn:xmpp:message-correct:0",
+	"jabber:x:oob",
+	nsIBB,
+	nsNick,
+	nsAttention,
+}
+
+// clientInfo is the answer to disco#info queries about us.
+func clientInfo() disco.Info {
+	ci := disco.Info{
+		Identity: []info.Identity{{
+			Category: "client",
+			Type:     "console",
+			Name:     clientName,
+		}},
+	}
+	for _, feature := range clientFeatures {
+		ci.Features = append(ci.Features, info.Feature{Var: feature})
+	}
+	return ci
+}
+
+// handleDiscoInfoRequest answers disco#info queries. The only node we have is
+// the one for our entity capabilities, which has the same features.
+func handleDiscoInfoRequest(t xmlstream.TokenReadEncoder, iq stanza.IQ, payload xml.StartElement) error {
+	if iq.Type != stanza.GetIQ {
+		return nil
+	}
+	ci := clientInfo()
+	for _, attr := range payload.Attr {
+		if attr.Name.Local != "node" || attr.Value == "" {
+			continue
+		}
+		if caps := ownCaps(); attr.Value != caps.Node+"#"+caps.Ver {
+			_, err := xmlstream.Copy(t, iq.Error(stanza.Error{
+				Type:      stanza.Cancel,
+				Condition: stanza.ItemNotFound,
+			}))
+			return err
+		}
+		ci.Node = attr.Value
+	}
+	_, err := xmlstream.Copy(t, iq.Result(ci.TokenReader()))
+	return err
+}
+
+func (c *client) discoInfo(ctx context.Context, to jid.JID) (disco.Info, error) {
+	session := c.Session()
+	if session == nil {
+		return disco.Info{}, errDisconnected
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	return disco.GetInfo(ctx, "", to, session)
+}
+
+func (c *client) discoItems(ctx context.Context, to jid.JID) ([]items.Item, error) {
+	return c.discoNodeItems(ctx, to, "")
+}
+
+// discoNodeItems lists the items of a node of to.
+func (c *client) discoNodeItems(ctx context.Context, to jid.JID, node string) ([]items.Item, error) {
+	session := c.Session()
+	if session == nil {
+		return nil, errDisconnected
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	iter := disco.FetchItems(ctx, items.Item{JID: to, Node: node}, session)
+	var found []items.Item
+	for iter.Next() {
+		found = append(found, iter.Item())
+	}
+	err := iter.Err()
+	if e := iter.Close(); err == nil {
+		err = e
+	}
+	return found, err
+}
+
+// supports reports whether to advertises feature.
+func (c *client) supports(ctx context.Context, to jid.JID, feature string) (bool, error) {
+	info, err := c.cachedInfo(ctx, to)
+	if err != nil {
+		return false, err
+	}
+	for _, f := range info.Features {
+		if f.Var == feature {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func printDisco(to jid.JID, info disco.Info, found []items.Item) {
+	w := newBlock()
+	defer w.Flush()
+	fmt.Fprintf(w, "Identities of %s:\n", to)
+	for _, ident := range info.Identity {
+		if ident.Name != "" {
+			fmt.Fprintf(w, "  %s/%s (%s)\n", ident.Category, ident.Type, ident.Name)
+		} else {
+			fmt.Fprintf(w, "  %s/%s\n", ident.Category, ident.Type)
+		}
+	}
+	fmt.Fprintln(w, "Features:")
+	for _, feature := range info.Features {
+		fmt.Fprintf(w, "  %s\n", feature.Var)
+	}
+	if len(found) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Items:")
+	for _, item := range found {
+		switch {
+		case item.Name != "" && item.Node != "":
+			fmt.Fprintf(w, "  %s [%s] %s\n", item.JID, item.Node, item.Name)
+		case item.Node != "":
+			fmt.Fprintf(w, "  %s [%s]\n", item.JID, item.Node)
+		case item.Name != "":
+			fmt.Fprintf(w, "  %s %s\n", item.JID, item.Name)
+		default:
+			fmt.Fprintf(w, "  %s\n", item.JID)
+		}
+	}
+}
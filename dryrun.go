@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"mellium.im/xmlstream"
+)
+
+// errDryRun is returned by requests that would need a response from the
+// server.
+var errDryRun = errors.New("no responses in a dry run")
+
+// stanzaWriter is the part of a session used to send stanzas, so that a dry run
+// can stand in for the real thing.
+type stanzaWriter interface {
+	Encode(ctx context.Context, v interface{}) error
+	Send(ctx context.Context, r xml.TokenReader) error
+}
+
+// dryRunWriter prints stanzas to w, one per line, instead of sending them.
+type dryRunWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (d *dryRunWriter) Encode(ctx context.Context, v interface{}) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := xml.NewEncoder(d.w).Encode(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(d.w)
+	return err
+}
+
+func (d *dryRunWriter) Send(ctx context.Context, r xml.TokenReader) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e := xml.NewEncoder(d.w)
+	_, err := xmlstream.Copy(e, r)
+	if err != nil {
+		return err
+	}
+	if err = e.Flush(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(d.w)
+	return err
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// editor returns the command line of the user's editor.
+func editor() []string {
+	for _, env := range []string{"VISUAL", "EDITOR"} {
+		if fields := strings.Fields(os.Getenv(env)); len(fields) > 0 {
+			return fields
+		}
+	}
+	return []string{"vi"}
+}
+
+// compose has the user write a message in their editor and returns it without
+// the blank lines around it.
+func compose(input lineReader) (string, error) {
+	f, err := os.CreateTemp("", "xmpp-client-*.txt")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	tty, resume, err := input.Suspend()
+	if err != nil {
+		return "", fmt.Errorf("giving the terminal to the editor: %w", err)
+	}
+	args := editor()
+	cmd := exec.Command(args[0], append(args[1:], f.Name())...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, tty, tty
+	err = cmd.Run()
+	if e := resume(); err == nil && e != nil {
+		err = fmt.Errorf("taking the terminal back: %w", e)
+	}
+	if err != nil {
+		return "", fmt.Errorf("running %s: %w", args[0], err)
+	}
+
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		return "", err
+	}
+	msg := strings.Trim(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	if strings.TrimSpace(msg) == "" {
+		return "", errors.New("message is empty, not sending it")
+	}
+	return msg, nil
+}
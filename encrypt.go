@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// encryptBody replaces the body of a chat message with an encrypted one,
+// preferring OMEMO over OpenPGP if both -omemo and -pgp are set. Contacts
+// without keys for either get the message in plain text.
+func (c *client) encryptBody(ctx context.Context, msg *messageBody) error {
+	if msg.Body == "" || (c.omemo == nil && c.pgp == nil) {
+		return nil
+	}
+	var missing []string
+	if c.omemo != nil {
+		enc, err := c.encryptOMEMO(ctx, msg.To, msg.Body)
+		switch {
+		case err == nil:
+			msg.Body = omemoFallback
+			msg.OMEMO = enc
+			msg.Encryption = &eme{Namespace: nsOMEMO, Name: "OMEMO"}
+			msg.Store = &struct{}{}
+			return nil
+		case !errors.Is(err, errNoOMEMO):
+			return fmt.Errorf("encrypting: %w", err)
+		}
+		missing = append(missing, "OMEMO")
+	}
+	if c.pgp != nil {
+		enc, err := c.pgp.encrypt(msg.To, msg.Body)
+		switch {
+		case err == nil:
+			msg.Body = pgpFallback
+			msg.OpenPGP = enc
+			msg.Encryption = &eme{Namespace: nsOpenPGP, Name: "OpenPGP for XMPP"}
+			msg.Store = &struct{}{}
+			return nil
+		case !errors.Is(err, errNoPGPKey):
+			return fmt.Errorf("encrypting: %w", err)
+		}
+		missing = append(missing, "OpenPGP")
+	}
+	warning := fmt.Sprintf("%s has no %s keys, sending unencrypted", msg.To.Bare(), strings.Join(missing, " or "))
+	c.report(event{Type: "warning", To: msg.To.String(), Error: warning}, "Warning: %s\n", warning)
+	return nil
+}
+
+// decryptBody replaces the fallback body of an encrypted message with the
+// decrypted one.
+func (c *client) decryptBody(msg *messageBody) {
+	var (
+		body     string
+		verified bool
+		err      error
+	)
+	switch {
+	case msg.OMEMO != nil && c.omemo != nil:
+		body, verified, err = c.decryptOMEMO(msg.From, msg.OMEMO)
+		msg.Encrypted = "omemo"
+	case msg.OpenPGP != nil && c.pgp != nil:
+		// Our own messages may have no from address
+		from := msg.From
+		if from.String() == "" {
+			from = c.LocalAddr()
+		}
+		body, verified, err = c.pgp.decrypt(from, msg.To, c.LocalAddr(), msg.OpenPGP)
+		msg.Encrypted = "pgp"
+	default:
+		return
+	}
+	if err != nil {
+		c.logger.Printf("Error decrypting %s message from %s: %v", msg.Encrypted, msg.From.Bare(), err)
+		msg.Body = ""
+		msg.Encrypted = ""
+		return
+	}
+	msg.Body = body
+	msg.Verified = verified
+}
+
+// encryptionLabel marks decrypted messages in the chat.
+func encryptionLabel(msg messageBody) string {
+	switch {
+	case msg.Encrypted == "":
+		return ""
+	case msg.Verified:
+		return "[" + msg.Encrypted + "] "
+	}
+	return "[" + msg.Encrypted + ", unverified] "
+}
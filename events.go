@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// event is a line of -json output. Type is one of message, groupchat, private, carbon,
+// typing, attention, queued, delivered, seen, subject, presence, subscription, block, unblock, pep,
+// retract, occupant, roster, upload, transfer, download, warning or error, the other fields are only set where they apply.
+type event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Set when logged into more than one account
+	Account string `json:"account,omitempty"`
+	From    string `json:"from,omitempty"`
+	To      string `json:"to,omitempty"`
+	ID      string `json:"id,omitempty"`
+	Body    string `json:"body,omitempty"`
+	// XEP-0201 thread the message belongs to
+	Thread string `json:"thread,omitempty"`
+	// Room topic or chat subject of subject events
+	Subject string `json:"subject,omitempty"`
+	// PEP node of pep and retract events
+	Node string `json:"node,omitempty"`
+	// Set if the message replaces an earlier one
+	Corrected bool `json:"corrected,omitempty"`
+	// Set if the server held on to the message, Time is when it was sent
+	Delayed bool `json:"delayed,omitempty"`
+	// omemo or pgp for encrypted messages, and whether the sender is verified
+	Encrypted string `json:"encrypted,omitempty"`
+	Verified  bool   `json:"verified,omitempty"`
+	// Shared file and, for upload and download events, where it is on disk
+	URL  string `json:"url,omitempty"`
+	Desc string `json:"desc,omitempty"`
+	File string `json:"file,omitempty"`
+	// offline, available, away, chat, dnd or xa
+	Presence string `json:"presence,omitempty"`
+	// Status message, or added, removed or updated for roster events
+	Status       string `json:"status,omitempty"`
+	Subscription string `json:"subscription,omitempty"`
+	// Of occupant events
+	Role        string `json:"role,omitempty"`
+	Affiliation string `json:"affiliation,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// eventWriter writes events to a writer as one JSON object per line.
+type eventWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newEventWriter(w io.Writer) *eventWriter {
+	return &eventWriter{enc: json.NewEncoder(w)}
+}
+
+func (w *eventWriter) emit(e event) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.enc.Encode(e)
+}
+
+// report prints a line for people, or emits e instead with -json.
+func (c *client) report(e event, format string, args ...interface{}) {
+	if c.events == nil {
+		c.printf(format, args...)
+		return
+	}
+	c.emit(e)
+}
+
+// printf is like the printf function but shows which account the line is
+// about.
+func (c *client) printf(format string, args ...interface{}) {
+	if c.account == "" {
+		printf(format, args...)
+		return
+	}
+	printf("[%s] %s", c.account, fmt.Sprintf(format, args...))
+}
+
+func (c *client) emit(e event) {
+	e.Account = c.account
+	if err := c.events.emit(e); err != nil {
+		c.logger.Printf("Error writing event: %v", err)
+	}
+}
+
+func (c *client) reportError(err error) {
+	msg := explainError(err)
+	c.report(event{Type: "error", Error: msg}, "Error %s\n", msg)
+}
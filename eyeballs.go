@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// How long to wait for an address to connect before also trying the next one,
+// as recommended by RFC 8305
+const eyeballsDelay = 250 * time.Millisecond
+
+// eyeballsDialer connects to hosts with both IPv4 and IPv6 addresses by trying
+// them concurrently, staggered and alternating between the families, and
+// keeping whichever connects first (happy eyeballs, RFC 8305).
+type eyeballsDialer struct {
+	// ipv4, ipv6 or empty to go with the order the resolver returns
+	prefer string
+}
+
+func (d eyeballsDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	var nd net.Dialer
+	if net.ParseIP(host) != nil {
+		return nd.DialContext(ctx, network, address)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs = interleaveFamilies(addrs, d.prefer)
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no addresses found", Name: host, IsNotFound: true}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	// Buffered so attempts that finish after we're done don't block
+	results := make(chan result, len(addrs))
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	var firstErr error
+	next, pending := 0, 0
+	for next < len(addrs) || pending > 0 {
+		select {
+		case <-timer.C:
+			if next == len(addrs) {
+				continue
+			}
+			target := net.JoinHostPort(addrs[next].String(), port)
+			next++
+			pending++
+			go func() {
+				conn, err := nd.DialContext(ctx, network, target)
+				results <- result{conn, err}
+			}()
+			timer.Reset(eyeballsDelay)
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Close the connections of attempts still underway
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			// Don't wait out the delay when an attempt fails
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(0)
+		}
+	}
+	return nil, firstErr
+}
+
+// interleaveFamilies orders addrs so that IPv4 and IPv6 addresses take turns,
+// starting with the preferred family or else the family of the first address.
+func interleaveFamilies(addrs []net.IPAddr, prefer string) []net.IPAddr {
+	var v4, v6 []net.IPAddr
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			v4 = append(v4, a)
+		} else {
+			v6 = append(v6, a)
+		}
+	}
+	first, second := v6, v4
+	switch {
+	case prefer == "ipv4":
+		first, second = v4, v6
+	case prefer == "" && len(addrs) > 0 && addrs[0].IP.To4() != nil:
+		first, second = v4, v6
+	}
+	ordered := make([]net.IPAddr, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
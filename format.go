@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// defaultFormat shows messages the way they always have been
+const defaultFormat = "{{.Prefix}}{{if .Action}}* {{.From}} {{.Body}}{{else}}{{.From}}: {{.Body}}{{end}}"
+
+// messageView is what the -format template is executed with for each message
+// that is shown.
+type messageView struct {
+	// chat, groupchat or private
+	Type string
+	// The sender as usually shown: the bare JID of a contact, the nickname in a
+	// room or "nick in room" for private messages
+	From string
+	// Full JID of the sender, and the room of groupchat and private messages
+	JID  string
+	Room string
+	Body string
+	// Set for /me messages, whose Body is then what the sender is doing
+	Action bool
+	// When the message was sent, which is earlier than now if it was Delayed by
+	// the server while we were offline
+	Time    time.Time
+	Delayed bool
+	// #tag of the thread the message belongs to
+	Thread    string
+	Corrected bool
+	// omemo or pgp, and whether the sender is verified
+	Encrypted string
+	Verified  bool
+	// Everything shown in front of the sender by default: the time, room,
+	// thread, encryption and correction
+	Prefix string
+}
+
+// parseFormat parses a -format template and tries it on an example message,
+// so that mistakes like misspelt fields are found at startup rather than when
+// the first message arrives.
+func parseFormat(s string) (*template.Template, error) {
+	tmpl, err := template.New("format").Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(io.Discard, messageView{Type: "chat", Time: time.Now()}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// newMessageView fills in what is known about msg without knowing whether it
+// came from a room.
+func (c *client) newMessageView(typ string, msg messageBody) messageView {
+	v := messageView{
+		Type:      typ,
+		JID:       msg.From.String(),
+		Time:      sentAt(msg),
+		Delayed:   msg.Delay != nil,
+		Corrected: msg.Replace != nil,
+		Encrypted: msg.Encrypted,
+		Verified:  msg.Verified,
+	}
+	v.Body, v.Action = action(msg.Body)
+	if msg.Thread != nil && msg.Thread.ID != "" {
+		v.Thread = threadTag(msg.Thread.ID)
+	}
+	return v
+}
+
+// printMessage shows a message through the -format template.
+func (c *client) printMessage(v messageView) {
+	var b strings.Builder
+	if err := c.format.Execute(&b, v); err != nil {
+		c.logger.Printf("Error formatting message: %v", err)
+		b.Reset()
+		if v.Action {
+			fmt.Fprintf(&b, "%s* %s %s", v.Prefix, v.From, v.Body)
+		} else {
+			fmt.Fprintf(&b, "%s%s: %s", v.Prefix, v.From, v.Body)
+		}
+	}
+	if !strings.HasSuffix(b.String(), "\n") {
+		b.WriteString("\n")
+	}
+	c.printf("%s", b.String())
+}
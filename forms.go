@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/jid"
+)
+
+// prompter asks the user for a value, hiding what they type if private is
+// set.
+type prompter func(prompt string, private bool) (string, error)
+
+// stdinPrompter asks on stdin, for before the chat has started.
+func stdinPrompter(prompt string, private bool) (string, error) {
+	if private {
+		return promptPassword(prompt)
+	}
+	fmt.Print(prompt)
+	return readLine(os.Stdin)
+}
+
+// fillForm shows the XEP-0004 data form f and asks for the value of each of
+// its fields except those in known, which are filled in for the user. An empty
+// answer keeps the default value of a field.
+func fillForm(f *form.Data, ask prompter, known map[string]string) error {
+	if title := f.Title(); title != "" {
+		fmt.Println(title)
+	}
+	if instructions := f.Instructions(); instructions != "" {
+		fmt.Println(instructions)
+	}
+	var fields []form.FieldData
+	f.ForFields(func(field form.FieldData) {
+		fields = append(fields, field)
+	})
+	for _, field := range fields {
+		if v, ok := known[field.Var]; ok {
+			if _, err := f.Set(field.Var, v); err != nil {
+				return fmt.Errorf("setting %s: %w", field.Var, err)
+			}
+			continue
+		}
+		switch field.Type {
+		case form.TypeHidden:
+			// Sent back as it is
+			continue
+		case form.TypeFixed:
+			fmt.Println(strings.Join(field.Raw, "\n"))
+			continue
+		}
+
+		opts, _ := f.GetOptions(field.Var)
+		for i, opt := range opts {
+			label := opt.Label
+			if label == "" {
+				label = opt.Value
+			}
+			fmt.Printf("  %d. %s\n", i+1, label)
+		}
+		for {
+			answer, err := ask(fieldPrompt(field), field.Type == form.TypeTextPrivate)
+			if err != nil {
+				return err
+			}
+			answer = strings.TrimSpace(answer)
+			if answer == "" {
+				if _, set := f.Get(field.Var); field.Required && !set {
+					fmt.Println("This field is required")
+					continue
+				}
+				break
+			}
+			v, err := parseFieldValue(field.Type, answer, opts)
+			if err == nil {
+				_, err = f.Set(field.Var, v)
+			}
+			if err != nil {
+				fmt.Printf("Invalid value: %v\n", err)
+				continue
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// fieldPrompt describes field with its type and default value, if any.
+func fieldPrompt(field form.FieldData) string {
+	label := field.Label
+	if label == "" {
+		label = field.Var
+	}
+	var hints []string
+	switch field.Type {
+	case form.TypeBoolean:
+		hints = append(hints, "yes/no")
+	case form.TypeList:
+		hints = append(hints, "number")
+	case form.TypeListMulti:
+		hints = append(hints, "numbers separated by commas")
+	case form.TypeJIDMulti:
+		hints = append(hints, "separated by commas")
+	case form.TypeTextMulti:
+		hints = append(hints, "lines separated by |")
+	case form.TypeJID:
+		hints = append(hints, "JID")
+	}
+	if field.Required {
+		hints = append(hints, "required")
+	}
+	if len(field.Raw) > 0 && field.Type != form.TypeTextPrivate {
+		hints = append(hints, "default "+strings.Join(field.Raw, ", "))
+	}
+	prompt := label
+	if field.Desc != "" {
+		prompt += " - " + field.Desc
+	}
+	if len(hints) > 0 {
+		prompt += " [" + strings.Join(hints, ", ") + "]"
+	}
+	return prompt + ": "
+}
+
+// parseFieldValue turns an answer into the value form.Data.Set expects for a
+// field of type typ. List fields are answered with the numbers of options.
+func parseFieldValue(typ form.FieldType, answer string, opts []form.FieldOpt) (interface{}, error) {
+	option := func(s string) (string, error) {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n < 1 || n > len(opts) {
+			return "", fmt.Errorf("%q is not one of the options", s)
+		}
+		return opts[n-1].Value, nil
+	}
+	switch typ {
+	case form.TypeBoolean:
+		switch strings.ToLower(answer) {
+		case "y", "yes", "true", "1":
+			return true, nil
+		case "n", "no", "false", "0":
+			return false, nil
+		}
+		return nil, errors.New("answer yes or no")
+	case form.TypeList:
+		return option(answer)
+	case form.TypeListMulti:
+		var values []string
+		for _, s := range strings.Split(answer, ",") {
+			v, err := option(s)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	case form.TypeJID:
+		return jid.Parse(answer)
+	case form.TypeJIDMulti:
+		var jids []jid.JID
+		for _, s := range strings.Split(answer, ",") {
+			j, err := jid.Parse(strings.TrimSpace(s))
+			if err != nil {
+				return nil, err
+			}
+			jids = append(jids, j)
+		}
+		return jids, nil
+	case form.TypeTextMulti:
+		lines := strings.Split(answer, "|")
+		for i := range lines {
+			lines[i] = strings.TrimSpace(lines[i])
+		}
+		return strings.Join(lines, "\n"), nil
+	}
+	return answer, nil
+}
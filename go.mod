@@ -3,17 +3,25 @@ module github.com/TA-23-24/xmpp-client
 go 1.21.1
 
 require (
+	github.com/BurntSushi/toml v1.4.0
+	github.com/quic-go/quic-go v0.42.0
+	golang.org/x/crypto v0.5.0
+	golang.org/x/net v0.10.0
+	golang.org/x/term v0.8.0
 	mellium.im/sasl v0.3.1
 	mellium.im/xmlstream v0.15.4
 	mellium.im/xmpp v0.21.4
 )
 
 require (
-	golang.org/x/crypto v0.5.0 // indirect
-	golang.org/x/mod v0.7.0 // indirect
-	golang.org/x/net v0.5.0 // indirect
-	golang.org/x/sys v0.4.0 // indirect
-	golang.org/x/text v0.6.0 // indirect
-	golang.org/x/tools v0.5.0 // indirect
+	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
+	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
+	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
+	go.uber.org/mock v0.4.0 // indirect
+	golang.org/x/exp v0.0.0-20221205204356-47842c84f3db // indirect
+	golang.org/x/mod v0.11.0 // indirect
+	golang.org/x/sys v0.8.0 // indirect
+	golang.org/x/text v0.9.0 // indirect
+	golang.org/x/tools v0.9.1 // indirect
 	mellium.im/reader v0.1.0 // indirect
 )
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/stanza"
+)
+
+// HandleXMPP handles incoming stanzas for the current session.
+func (c *client) HandleXMPP(t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+	c.mu.Lock()
+	c.lastReceived = time.Now()
+	c.mu.Unlock()
+
+	// The decoder needs to see the start token as well, otherwise the closing
+	// tag of the stanza is reported as unexpected
+	d := xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(*start), t))
+
+	switch start.Name.Local {
+	case "message":
+		return c.handleMessage(t, d)
+	case "presence":
+		return c.handlePresence(t, d)
+	case "iq":
+		return c.handleIQ(t, start)
+	}
+	return nil
+}
+
+func (c *client) handleMessage(t xmlstream.TokenReadEncoder, d *xml.Decoder) error {
+	msg := messageBody{}
+	err := d.Decode(&msg)
+	if err != nil && err != io.EOF {
+		c.logger.Printf("Error decoding message: %v", err)
+		return nil
+	}
+
+	if msg.MAMResult != nil && c.collectArchived(msg.MAMResult) {
+		return nil
+	}
+
+	if msg.Event != nil {
+		c.handlePubSubEvent(msg)
+		return nil
+	}
+
+	if msg.CarbonSent != nil || msg.CarbonReceived != nil {
+		c.handleCarbon(msg)
+		return nil
+	}
+
+	c.decryptBody(&msg)
+
+	if msg.Attention != nil && msg.Type != stanza.GroupChatMessage && msg.Delay == nil {
+		c.handleAttention(msg)
+	}
+
+	if msg.Received != nil {
+		if body, ok := c.receipts.done(msg.Received.ID); ok {
+			c.report(event{Type: "delivered", From: msg.From.String(), ID: msg.Received.ID, Body: body},
+				"✓ delivered to %s: %s\n", msg.From.Bare().String(), body)
+		}
+	}
+
+	if msg.Displayed != nil {
+		if body, ok := c.markers.done(msg.Displayed.ID); ok {
+			c.report(event{Type: "seen", From: msg.From.String(), ID: msg.Displayed.ID, Body: body},
+				"✓ seen by %s: %s\n", msg.From.Bare().String(), body)
+		}
+	}
+
+	// Corrected messages are shown again in full
+	corrected := ""
+	if msg.Replace != nil {
+		corrected = "(corrected) "
+	}
+
+	hasOOB := msg.OOB != nil && msg.OOB.URL != ""
+
+	// Messages with a body in rooms only have a subject to say what they are
+	// about, they don't change the topic
+	if msg.Subject != nil && (msg.Body == "" || msg.Type != stanza.GroupChatMessage) {
+		c.handleSubject(msg)
+	}
+
+	if msg.Type == stanza.GroupChatMessage {
+		if c.events != nil && (msg.Body != "" || hasOOB) {
+			c.emit(messageEvent("groupchat", msg))
+		}
+		if msg.Body != "" {
+			if c.events == nil {
+				v := c.newMessageView("groupchat", msg)
+				v.From, v.Room = msg.From.Resourcepart(), msg.From.Bare().String()
+				v.Prefix = fmt.Sprintf("%s[%s] %s%s", c.timestamp(v.Time), v.Room, c.threadPrefix(msg), corrected)
+				c.printMessage(v)
+			}
+			// Rooms send our own messages back to us and recent history when we
+			// join
+			c.mu.Lock()
+			own := c.rooms[msg.From.Bare().String()]
+			c.mu.Unlock()
+			if !own.Equal(msg.From) && msg.Delay == nil {
+				c.notify(msg.From, true, msg.Body)
+				c.rememberThread(msg.From.Bare().String(), msg)
+			}
+			// The history is replayed on every join and already recorded
+			if msg.Delay == nil {
+				c.recordHistory("in", msg.From, msg.Body)
+			}
+		}
+		if hasOOB {
+			c.printOOB(msg)
+		}
+		return nil
+	}
+
+	if msg.Type != stanza.ChatMessage {
+		return nil
+	}
+
+	// Acknowledge the message if the sender asked for a receipt
+	if msg.Request != nil && msg.ID != "" {
+		err = t.Encode(messageBody{
+			Message: stanza.Message{
+				ID:   newID(),
+				To:   msg.From,
+				From: c.LocalAddr(),
+				Type: msg.Type,
+			},
+			Received: &receipt{ID: msg.ID},
+		})
+		if err != nil {
+			c.logger.Printf("Error sending delivery receipt: %v", err)
+		}
+	}
+
+	// Occupants of rooms message us privately through the room, which only
+	// knows them by their nickname
+	sender, private := msg.From.Bare().String(), msg.MUCUser != nil || c.isOccupant(msg.From)
+	if private {
+		sender = fmt.Sprintf("%s in %s", msg.From.Resourcepart(), msg.From.Bare())
+	}
+
+	if msg.Composing != nil {
+		c.report(event{Type: "typing", From: msg.From.String()}, "%s is typing...\n", sender)
+	}
+
+	if msg.Body == "" && !hasOOB {
+		return nil
+	}
+
+	// Events carry the body and the file together
+	if c.events != nil {
+		typ := "message"
+		if private {
+			typ = "private"
+		}
+		c.emit(messageEvent(typ, msg))
+	}
+	// Private messages stay with the occupant, not the room
+	from, label := msg.From.Bare(), ""
+	if private {
+		from, label = msg.From, "(private) "
+	}
+
+	// The body of a shared file is usually just the URL again
+	if msg.Body != "" && (!hasOOB || msg.Body != msg.OOB.URL) {
+		if c.events == nil {
+			v := c.newMessageView("chat", msg)
+			if private {
+				v.Type, v.Room = "private", msg.From.Bare().String()
+			}
+			v.From = sender
+			v.Prefix = c.chatPrefix(msg) + label + c.threadPrefix(msg) + encryptionLabel(msg) + corrected
+			c.printMessage(v)
+		}
+		c.notify(msg.From, false, msg.Body)
+		c.recordHistory("in", from, msg.Body)
+	}
+	if hasOOB {
+		if c.events == nil {
+			c.printf("%s%s%s sent a file\n", c.chatPrefix(msg), label, sender)
+		}
+		c.printOOB(msg)
+		c.recordHistory("in", from, msg.OOB.URL)
+	}
+	if c.readMarkers && msg.Markable != nil && msg.ID != "" {
+		c.sendDisplayed(t, msg)
+	}
+
+	c.rememberThread(msg.From.Bare().String(), msg)
+	c.mu.Lock()
+	c.lastFrom = msg.From
+	c.mu.Unlock()
+
+	return nil
+}
+
+// messageEvent is the -json event for an incoming message of type typ.
+func messageEvent(typ string, msg messageBody) event {
+	e := event{
+		Type:      typ,
+		Time:      sentAt(msg),
+		Delayed:   msg.Delay != nil,
+		From:      msg.From.String(),
+		ID:        msg.ID,
+		Body:      msg.Body,
+		Corrected: msg.Replace != nil,
+		Encrypted: msg.Encrypted,
+		Verified:  msg.Verified,
+	}
+	if msg.Thread != nil {
+		e.Thread = msg.Thread.ID
+	}
+	if msg.OOB != nil {
+		e.URL, e.Desc = msg.OOB.URL, msg.OOB.Desc
+	}
+	return e
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"mellium.im/xmpp/jid"
+)
+
+const historyContext = 10
+
+// Messages of the same conversation shown before and after each search match
+const searchContext = 2
+
+type historyEntry struct {
+	Time time.Time `json:"time"`
+	Dir  string    `json:"dir"`
+	JID  string    `json:"jid"`
+	Body string    `json:"body"`
+}
+
+// historyLog appends chat messages to a file as JSON lines. A nil *historyLog
+// discards everything so that callers don't need to check if history is on.
+type historyLog struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+func openHistory(path string) (*historyLog, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &historyLog{path: path, f: f}, nil
+}
+
+// append records a message, dir is "in" or "out".
+func (h *historyLog) append(dir string, j jid.JID, body string) error {
+	if h == nil {
+		return nil
+	}
+	line, err := json.Marshal(historyEntry{
+		Time: time.Now(),
+		Dir:  dir,
+		JID:  j.String(),
+		Body: body,
+	})
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err = h.f.Write(append(line, '\n'))
+	return err
+}
+
+// last returns the last n entries exchanged with j.
+func (h *historyLog) last(j jid.JID, n int) ([]historyEntry, error) {
+	if h == nil {
+		return nil, nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, err := os.Open(h.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []historyEntry
+	err = readHistory(f, func(entry historyEntry, entryJID jid.JID) {
+		if !entryJID.Bare().Equal(j.Bare()) {
+			return
+		}
+		entries = append(entries, entry)
+		if len(entries) > n {
+			entries = entries[1:]
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// readHistory calls fn with each entry of the history in r. Lines that aren't
+// entries are skipped, however long they are.
+func readHistory(r io.Reader, fn func(entry historyEntry, entryJID jid.JID)) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			var entry historyEntry
+			if json.Unmarshal(line, &entry) == nil {
+				if entryJID, err := jid.Parse(entry.JID); err == nil {
+					fn(entry, entryJID)
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// historyQuery selects entries when searching the history, the zero JID and
+// times match every conversation and date.
+type historyQuery struct {
+	term       string
+	ignoreCase bool
+	with       jid.JID
+	since      time.Time
+	until      time.Time
+}
+
+func (q historyQuery) matches(entry historyEntry) bool {
+	if !q.since.IsZero() && entry.Time.Before(q.since) {
+		return false
+	}
+	if !q.until.IsZero() && !entry.Time.Before(q.until) {
+		return false
+	}
+	if q.ignoreCase {
+		return strings.Contains(strings.ToLower(entry.Body), strings.ToLower(q.term))
+	}
+	return strings.Contains(entry.Body, q.term)
+}
+
+// searchResult is a match and the messages around it in its conversation.
+type searchResult struct {
+	with    string
+	entries []historyEntry
+	// Whether each of entries matched
+	matched []bool
+}
+
+// search returns the entries matching q with searchContext entries of the
+// same conversation on either side, merging matches that are close together.
+func (h *historyLog) search(q historyQuery) ([]*searchResult, error) {
+	if h == nil {
+		return nil, nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, err := os.Open(h.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Entries of each conversation in order
+	conversations := make(map[string][]historyEntry)
+	type hit struct {
+		with string
+		i    int
+	}
+	var hits []hit
+	err = readHistory(f, func(entry historyEntry, entryJID jid.JID) {
+		with := entryJID.Bare().String()
+		if !q.with.Equal(jid.JID{}) && with != q.with.Bare().String() {
+			return
+		}
+		if q.matches(entry) {
+			hits = append(hits, hit{with, len(conversations[with])})
+		}
+		conversations[with] = append(conversations[with], entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*searchResult
+	// The last result of each conversation and the index after its last entry
+	last := make(map[string]*searchResult)
+	end := make(map[string]int)
+	for _, m := range hits {
+		entries := conversations[m.with]
+		from, to := max(m.i-searchContext, 0), min(m.i+searchContext+1, len(entries))
+		r := last[m.with]
+		if r == nil || from > end[m.with] {
+			r = &searchResult{with: m.with}
+			results = append(results, r)
+			last[m.with] = r
+		} else {
+			from = end[m.with]
+		}
+		for i := from; i < to; i++ {
+			r.entries = append(r.entries, entries[i])
+			r.matched = append(r.matched, false)
+		}
+		end[m.with] = to
+		r.matched[len(r.matched)-(to-m.i)] = true
+	}
+	return results, nil
+}
+
+func (h *historyLog) Close() error {
+	if h == nil {
+		return nil
+	}
+	return h.f.Close()
+}
+
+func (c *client) recordHistory(dir string, j jid.JID, body string) {
+	if err := c.history.append(dir, j, body); err != nil {
+		c.logger.Printf("Error writing history: %v", err)
+	}
+}
+
+func printHistory(entries []historyEntry) {
+	w := newBlock()
+	defer w.Flush()
+	for _, entry := range entries {
+		from := entry.JID
+		if entry.Dir == "out" {
+			from = "me"
+		}
+		fmt.Fprintf(w, "%s %s: %s\n", entry.Time.Local().Format(time.DateTime), from, entry.Body)
+	}
+}
+
+// printSearch prints search results, with the matching messages marked.
+func printSearch(results []*searchResult) {
+	w := newBlock()
+	defer w.Flush()
+	for i, r := range results {
+		if i > 0 {
+			fmt.Fprintln(w, "--")
+		}
+		fmt.Fprintf(w, "With %s:\n", r.with)
+		for j, entry := range r.entries {
+			mark := " "
+			if r.matched[j] {
+				mark = "*"
+			}
+			from := entry.JID
+			if entry.Dir == "out" {
+				from = "me"
+			}
+			fmt.Fprintf(w, "%s %s %s: %s\n", mark, entry.Time.Local().Format(time.DateTime), from, entry.Body)
+		}
+	}
+}
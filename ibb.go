@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+const nsIBB = "http://jabber.org/protocol/ibb"
+
+const (
+	// Block size we ask for, smaller ones are tried if the receiver refuses it
+	ibbBlockSize = 4096
+	// Smallest block size we try, and largest we accept
+	minIBBBlockSize = 512
+	maxIBBBlockSize = 65535
+	// Incoming transfers larger than this are cancelled
+	maxIBBSize = 100 << 20
+)
+
+// XEP-0047 open, data or close element
+type ibbPacket struct {
+	XMLName   xml.Name
+	SID       string `xml:"sid,attr"`
+	BlockSize int    `xml:"block-size,attr"`
+	Stanza    string `xml:"stanza,attr"`
+	Seq       uint16 `xml:"seq,attr"`
+	Data      string `xml:",chardata"`
+}
+
+// ibbTransfer is a file someone is sending us.
+type ibbTransfer struct {
+	f         *os.File
+	blockSize int
+	// Sequence number of the next data packet
+	seq  uint16
+	size int64
+}
+
+// ibbPayload returns an IBB element called name for the session sid.
+func ibbPayload(name, sid string, attr []xml.Attr, inner xml.TokenReader) xml.TokenReader {
+	return xmlstream.Wrap(inner, xml.StartElement{
+		Name: xml.Name{Space: nsIBB, Local: name},
+		Attr: append([]xml.Attr{{Name: xml.Name{Local: "sid"}, Value: sid}}, attr...),
+	})
+}
+
+// sendFileIBB sends the file at name to the full JID to in IQs, waiting for
+// each block to be acknowledged before sending the next.
+func (c *client) sendFileIBB(ctx context.Context, to jid.JID, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", name)
+	}
+
+	sid := newID()
+	blockSize := ibbBlockSize
+	for {
+		open := ibbPayload("open", sid, []xml.Attr{
+			{Name: xml.Name{Local: "block-size"}, Value: strconv.Itoa(blockSize)},
+			{Name: xml.Name{Local: "stanza"}, Value: "iq"},
+		}, nil)
+		err = c.sendIQ(ctx, to, stanza.SetIQ, open, nil)
+		// The receiver wants smaller blocks
+		var se stanza.Error
+		if errors.As(err, &se) && se.Condition == stanza.ResourceConstraint && blockSize > minIBBBlockSize {
+			blockSize /= 2
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("opening bytestream: %w", err)
+		}
+		break
+	}
+
+	var r io.Reader = f
+	if fi.Size() >= progressThreshold && c.events == nil {
+		r = &progressReader{r: f, name: fi.Name(), size: fi.Size()}
+	}
+	buf := make([]byte, blockSize)
+	for seq := uint16(0); ; seq++ {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			data := ibbPayload("data", sid, []xml.Attr{
+				{Name: xml.Name{Local: "seq"}, Value: strconv.Itoa(int(seq))},
+			}, xmlstream.Token(xml.CharData(base64.StdEncoding.EncodeToString(buf[:n]))))
+			if e := c.sendIQ(ctx, to, stanza.SetIQ, data, nil); e != nil {
+				return fmt.Errorf("sending block %d: %w", seq, e)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			c.sendIQ(ctx, to, stanza.SetIQ, ibbPayload("close", sid, nil, nil), nil)
+			return err
+		}
+	}
+	return c.sendIQ(ctx, to, stanza.SetIQ, ibbPayload("close", sid, nil, nil), nil)
+}
+
+// handleIBB receives files from contacts in our roster. They are saved in the
+// download directory, or the current one, named after the sender.
+func (c *client) handleIBB(t xmlstream.TokenReadEncoder, iq stanza.IQ, payload xml.StartElement) error {
+	if iq.Type != stanza.SetIQ {
+		return nil
+	}
+	var p ibbPacket
+	d := xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(payload), t))
+	if err := d.Decode(&p); err != nil {
+		c.logger.Printf("Error decoding bytestream packet: %v", err)
+		return nil
+	}
+
+	reply := func(cond stanza.Condition, typ stanza.ErrorType) error {
+		if cond == "" {
+			_, err := xmlstream.Copy(t, iq.Result(nil))
+			return err
+		}
+		_, err := xmlstream.Copy(t, iq.Error(stanza.Error{Type: typ, Condition: cond}))
+		return err
+	}
+
+	key := iq.From.String() + " " + p.SID
+	c.mu.Lock()
+	transfer := c.transfers[key]
+	c.mu.Unlock()
+
+	switch p.XMLName.Local {
+	case "open":
+		c.mu.Lock()
+		_, known := c.roster[iq.From.Bare().String()]
+		c.mu.Unlock()
+		switch {
+		case !known:
+			c.logger.Printf("Refused a file from %s, who is not in your roster", iq.From)
+			return reply(stanza.NotAcceptable, stanza.Cancel)
+		case transfer != nil || p.SID == "":
+			return reply(stanza.NotAcceptable, stanza.Cancel)
+		case p.Stanza != "" && p.Stanza != "iq":
+			return reply(stanza.FeatureNotImplemented, stanza.Cancel)
+		case p.BlockSize <= 0:
+			return reply(stanza.BadRequest, stanza.Modify)
+		case p.BlockSize > maxIBBBlockSize:
+			return reply(stanza.ResourceConstraint, stanza.Modify)
+		}
+		f, err := createUnique(c.downloadDir, iq.From.Bare().String()+".bin")
+		if err != nil {
+			c.logger.Printf("Error saving file from %s: %v", iq.From, err)
+			return reply(stanza.InternalServerError, stanza.Cancel)
+		}
+		c.mu.Lock()
+		if c.transfers == nil {
+			c.transfers = make(map[string]*ibbTransfer)
+		}
+		c.transfers[key] = &ibbTransfer{f: f, blockSize: p.BlockSize}
+		c.mu.Unlock()
+		c.report(event{Type: "transfer", From: iq.From.String(), File: f.Name()},
+			"%s is sending you a file, saving it to %s\n", iq.From, f.Name())
+		return reply("", "")
+	case "data":
+		if transfer == nil {
+			return reply(stanza.ItemNotFound, stanza.Cancel)
+		}
+		data, err := base64.StdEncoding.DecodeString(p.Data)
+		switch {
+		case p.Seq != transfer.seq:
+			// A missed or repeated block can't be recovered from
+			c.cancelTransfer(key, fmt.Errorf("expected block %d, got %d", transfer.seq, p.Seq))
+			return reply(stanza.UnexpectedRequest, stanza.Cancel)
+		case err != nil || len(data) > transfer.blockSize:
+			c.cancelTransfer(key, errors.New("invalid block"))
+			return reply(stanza.BadRequest, stanza.Cancel)
+		case transfer.size+int64(len(data)) > maxIBBSize:
+			c.cancelTransfer(key, fmt.Errorf("file is larger than %d bytes", maxIBBSize))
+			return reply(stanza.NotAcceptable, stanza.Cancel)
+		}
+		if _, err := transfer.f.Write(data); err != nil {
+			c.cancelTransfer(key, err)
+			return reply(stanza.InternalServerError, stanza.Cancel)
+		}
+		transfer.seq++
+		transfer.size += int64(len(data))
+		return reply("", "")
+	case "close":
+		if transfer == nil {
+			return reply(stanza.ItemNotFound, stanza.Cancel)
+		}
+		c.mu.Lock()
+		delete(c.transfers, key)
+		c.mu.Unlock()
+		if err := transfer.f.Close(); err != nil {
+			c.logger.Printf("Error saving file from %s: %v", iq.From, err)
+			os.Remove(transfer.f.Name())
+			return reply(stanza.InternalServerError, stanza.Cancel)
+		}
+		c.report(event{Type: "download", From: iq.From.String(), File: transfer.f.Name()},
+			"Received %s (%d bytes) from %s\n", transfer.f.Name(), transfer.size, iq.From)
+		return reply("", "")
+	}
+	return reply(stanza.BadRequest, stanza.Modify)
+}
+
+// cancelTransfer drops an incoming transfer and what was received of it.
+func (c *client) cancelTransfer(key string, err error) {
+	c.mu.Lock()
+	transfer := c.transfers[key]
+	delete(c.transfers, key)
+	c.mu.Unlock()
+	if transfer == nil {
+		return
+	}
+	transfer.f.Close()
+	os.Remove(transfer.f.Name())
+	c.logger.Printf("Error receiving %s: %v", transfer.f.Name(), err)
+}
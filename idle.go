@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// idleTracker sets our presence to away once nothing has been entered for a
+// while, see -idle, and back to available on the next line.
+type idleTracker struct {
+	timeout time.Duration
+	clients []*client
+
+	mu        sync.Mutex
+	lastInput time.Time
+}
+
+func newIdleTracker(timeout time.Duration, clients []*client) *idleTracker {
+	return &idleTracker{timeout: timeout, clients: clients, lastInput: time.Now()}
+}
+
+// run goes away once the timeout has passed since the last input.
+func (t *idleTracker) run(ctx context.Context) {
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		t.mu.Lock()
+		idle := time.Since(t.lastInput)
+		t.mu.Unlock()
+		if idle < t.timeout {
+			timer.Reset(t.timeout - idle)
+			continue
+		}
+		for _, c := range t.clients {
+			if err := c.goIdle(ctx); err != nil {
+				c.logger.Printf("Error setting presence: %v", err)
+			}
+		}
+		// Checked again after the next input
+		timer.Reset(t.timeout)
+	}
+}
+
+// active records input and brings back whoever went away because of us.
+func (t *idleTracker) active(ctx context.Context) {
+	t.mu.Lock()
+	t.lastInput = time.Now()
+	t.mu.Unlock()
+	for _, c := range t.clients {
+		if err := c.returnFromIdle(ctx); err != nil {
+			c.logger.Printf("Error setting presence: %v", err)
+		}
+	}
+}
+
+// goIdle sets us away if we are available. Presence set by hand, like dnd, is
+// left alone.
+func (c *client) goIdle(ctx context.Context) error {
+	c.mu.Lock()
+	if c.show != "" {
+		c.mu.Unlock()
+		return nil
+	}
+	c.idleAway = true
+	status := c.status
+	c.mu.Unlock()
+	c.printf("Nothing typed for a while, you are now away\n")
+	return ignoreDisconnected(c.setPresence(ctx, "away", status))
+}
+
+// returnFromIdle sets us available again if goIdle made us away.
+func (c *client) returnFromIdle(ctx context.Context) error {
+	c.mu.Lock()
+	back := c.idleAway && c.show == "away"
+	c.idleAway = false
+	status := c.status
+	c.mu.Unlock()
+	if !back {
+		return nil
+	}
+	c.printf("You are available again\n")
+	return ignoreDisconnected(c.setPresence(ctx, "", status))
+}
+
+// ignoreDisconnected drops errDisconnected, for presence that is sent once we
+// are connected again anyway.
+func ignoreDisconnected(err error) error {
+	if errors.Is(err, errDisconnected) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unicode"
+
+	"golang.org/x/term"
+)
+
+// Escape codes to have the terminal report focus changes, and the reports
+const (
+	focusReportOn  = "\x1b[?1004h"
+	focusReportOff = "\x1b[?1004l"
+	focusIn        = "\x1b[I"
+	focusOut       = "\x1b[O"
+)
+
+// focused is whether the terminal last reported that it has the focus, false
+// if it never did.
+var focused atomic.Bool
+
+// lineReader reads what the user types, a line at a time.
+type lineReader interface {
+	ReadLine() (string, error)
+	SetPrompt(prompt string)
+	// SetCompleter has complete called when tab is pressed, with the line and
+	// the cursor position, to return the completed line and new position
+	SetCompleter(complete func(line string, pos int) (string, int, bool))
+	// SetKeyHandler has typed called for each character typed, with the line
+	// it is typed into and the cursor position before it is added
+	SetKeyHandler(typed func(line string, pos int, key rune))
+	// Suspend hands the terminal to another program, like an editor, and
+	// holds back anything printed until resume is called
+	Suspend() (tty *os.File, resume func() error, err error)
+	Close() error
+}
+
+// newLineReader edits lines with history when edit is set and stdin and stdout
+// are a terminal, and reads plain lines otherwise, e.g. when input is piped in.
+func newLineReader(prompt string, edit bool) (lineReader, error) {
+	if !edit || !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		return plainInput{bufio.NewScanner(os.Stdin)}, nil
+	}
+	return newTerminalInput(prompt)
+}
+
+type plainInput struct {
+	scanner *bufio.Scanner
+}
+
+func (in plainInput) ReadLine() (string, error) {
+	if in.scanner.Scan() {
+		return in.scanner.Text(), nil
+	}
+	if err := in.scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", io.EOF
+}
+
+func (plainInput) SetPrompt(string)                                   {}
+func (plainInput) SetCompleter(func(string, int) (string, int, bool)) {}
+func (plainInput) SetKeyHandler(func(string, int, rune))              {}
+func (plainInput) Close() error                                       { return nil }
+
+func (plainInput) Suspend() (*os.File, func() error, error) {
+	return os.Stdout, func() error { return nil }, nil
+}
+
+// terminalInput puts the terminal in raw mode to edit lines. Everything
+// printed to stdout and stderr meanwhile goes above the line being edited, so
+// messages arriving while typing don't end up in the middle of it.
+type terminalInput struct {
+	*term.Terminal
+	fd     int
+	state  *term.State
+	stdout *os.File
+	stderr *os.File
+	pipe   *os.File
+	done   chan struct{}
+	// Held while suspended so that nothing is printed over another program
+	paused sync.Mutex
+
+	complete func(line string, pos int) (string, int, bool)
+	typed    func(line string, pos int, key rune)
+}
+
+func newTerminalInput(prompt string) (*terminalInput, error) {
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		term.Restore(fd, state)
+		return nil, err
+	}
+
+	in := &terminalInput{
+		Terminal: term.NewTerminal(struct {
+			io.Reader
+			io.Writer
+		}{focusReader{os.Stdin}, os.Stdout}, prompt),
+		fd:     fd,
+		state:  state,
+		stdout: os.Stdout,
+		stderr: os.Stderr,
+		pipe:   w,
+		done:   make(chan struct{}),
+	}
+	in.AutoCompleteCallback = in.keyPressed
+	if width, height, err := term.GetSize(fd); err == nil && width > 0 {
+		in.SetSize(width, height)
+	}
+	os.Stdout.WriteString(focusReportOn)
+	os.Stdout, os.Stderr = w, w
+	go in.copyOutput(r)
+	return in, nil
+}
+
+// copyOutput prints whole lines, the terminal clears the line the cursor is
+// on to make room for output so a partial one would be lost.
+func (in *terminalInput) copyOutput(r io.Reader) {
+	defer close(in.done)
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			in.paused.Lock()
+			in.Write([]byte(line))
+			in.paused.Unlock()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (in *terminalInput) SetCompleter(complete func(line string, pos int) (string, int, bool)) {
+	in.complete = complete
+}
+
+func (in *terminalInput) SetKeyHandler(typed func(line string, pos int, key rune)) {
+	in.typed = typed
+}
+
+// keyPressed is called by the terminal for every key it doesn't handle
+// itself, which includes the characters that are typed.
+func (in *terminalInput) keyPressed(line string, pos int, key rune) (string, int, bool) {
+	if key == '\t' {
+		if in.complete == nil {
+			return "", 0, false
+		}
+		return in.complete(line, pos)
+	}
+	if in.typed != nil && unicode.IsPrint(key) {
+		in.typed(line, pos, key)
+	}
+	return "", 0, false
+}
+
+// Suspend holds back output, which the serve goroutine blocks on once the pipe
+// is full, so only suspend for as long as the user needs.
+func (in *terminalInput) Suspend() (*os.File, func() error, error) {
+	in.paused.Lock()
+	in.stdout.WriteString(focusReportOff)
+	if err := term.Restore(in.fd, in.state); err != nil {
+		in.paused.Unlock()
+		return nil, nil, err
+	}
+	resume := func() error {
+		defer in.paused.Unlock()
+		if _, err := term.MakeRaw(in.fd); err != nil {
+			return err
+		}
+		in.stdout.WriteString(focusReportOn)
+		return nil
+	}
+	return in.stdout, resume, nil
+}
+
+// Close prints anything left and gives the terminal back.
+func (in *terminalInput) Close() error {
+	os.Stdout, os.Stderr = in.stdout, in.stderr
+	in.pipe.Close()
+	<-in.done
+	os.Stdout.WriteString(focusReportOff)
+	return term.Restore(in.fd, in.state)
+}
+
+// focusReader takes the focus reports out of what is typed and keeps track of
+// them in focused.
+type focusReader struct {
+	r io.Reader
+}
+
+func (f focusReader) Read(p []byte) (int, error) {
+	for {
+		n, err := f.r.Read(p)
+		out := p[:0]
+		for rest := p[:n]; len(rest) > 0; {
+			i := bytes.IndexByte(rest, '\x1b')
+			if i < 0 || i+len(focusIn) > len(rest) {
+				out = append(out, rest...)
+				break
+			}
+			out = append(out, rest[:i]...)
+			switch string(rest[i : i+len(focusIn)]) {
+			case focusIn:
+				focused.Store(true)
+			case focusOut:
+				focused.Store(false)
+			default:
+				out = append(out, rest[i])
+				rest = rest[i+1:]
+				continue
+			}
+			rest = rest[i+len(focusIn):]
+		}
+		if len(out) > 0 || err != nil {
+			return len(out), err
+		}
+	}
+}
+
+// stdoutWriter and stderrWriter write to whatever os.Stdout and os.Stderr are
+// at the time, so that loggers created early on follow them to the terminal.
+type (
+	stdoutWriter struct{}
+	stderrWriter struct{}
+)
+
+func (stdoutWriter) Write(p []byte) (int, error) { return os.Stdout.Write(p) }
+func (stderrWriter) Write(p []byte) (int, error) { return os.Stderr.Write(p) }
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/ping"
+	"mellium.im/xmpp/roster"
+	"mellium.im/xmpp/stanza"
+	"mellium.im/xmpp/stream"
+	"mellium.im/xmpp/version"
+	"mellium.im/xmpp/xtime"
+)
+
+// sendIQ sends payload in an IQ of type typ to to and waits for the response
+// with the same ID, unmarshaling its payload into v if v isn't nil. Error
+// responses are returned as a stanza.Error and requests time out after
+// requestTimeout.
+func (c *client) sendIQ(ctx context.Context, to jid.JID, typ stanza.IQType, payload xml.TokenReader, v interface{}) error {
+	iq := stanza.IQ{
+		ID:   newID(),
+		To:   to,
+		Type: typ,
+	}
+	if c.dryRun != nil {
+		err := c.dryRun.Send(ctx, iq.Wrap(payload))
+		if err != nil {
+			return err
+		}
+		return errDryRun
+	}
+
+	session := c.Session()
+	if session == nil {
+		return errDisconnected
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	return session.UnmarshalIQElement(ctx, payload, iq, v)
+}
+
+// handleIQ answers the requests we understand and reports error responses
+// that aren't a reply to a request we're still waiting on. The session answers
+// any other requests with an error.
+func (c *client) handleIQ(t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+	iq, err := stanza.UnmarshalIQError(t, *start)
+	switch iq.Type {
+	case stanza.GetIQ, stanza.SetIQ:
+		return c.handleIQRequest(t, iq)
+	case stanza.ErrorIQ:
+	default:
+		return nil
+	}
+	var se stanza.Error
+	if errors.As(err, &se) {
+		c.report(event{Type: "error", From: iq.From.String(), ID: iq.ID, Error: explainError(se)},
+			"Error from %s: %s\n", iq.From, explainError(se))
+	} else if err != nil {
+		c.logger.Printf("Error decoding IQ error from %s: %v", iq.From, err)
+	}
+	return nil
+}
+
+func (c *client) handleIQRequest(t xmlstream.TokenReadEncoder, iq stanza.IQ) error {
+	var payload xml.StartElement
+	for {
+		tok, err := t.Token()
+		if err != nil {
+			return nil
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			payload = start
+			break
+		}
+	}
+
+	switch {
+	case payload.Name == xml.Name{Space: ping.NS, Local: "ping"}:
+		return ping.Handler{}.HandleIQ(iq, t, &payload)
+	case payload.Name == xml.Name{Space: disco.NSInfo, Local: "query"}:
+		return handleDiscoInfoRequest(t, iq, payload)
+	case payload.Name == xml.Name{Space: version.NS, Local: "query"}:
+		return handleVersionRequest(t, iq)
+	case payload.Name == xml.Name{Space: xtime.NS, Local: "time"}:
+		return xtime.Handler{}.HandleIQ(iq, t, &payload)
+	case payload.Name == xml.Name{Space: roster.NS, Local: "query"}:
+		return c.handleRosterPush(t, iq, payload)
+	case payload.Name.Space == nsBlocking:
+		return c.handleBlockPush(t, iq, payload)
+	case payload.Name.Space == nsIBB:
+		return c.handleIBB(t, iq, payload)
+	}
+	return nil
+}
+
+// explainError is like err.Error() but adds the condition and type of any
+// stanza error, e.g. "Room is full (service-unavailable, wait)", or the text of
+// a stream error, e.g. "conflict: Replaced by new connection".
+func explainError(err error) string {
+	msg := err.Error()
+	var streamErr stream.Error
+	if errors.As(err, &streamErr) {
+		if len(streamErr.Text) > 0 && streamErr.Text[0].Value != "" {
+			return fmt.Sprintf("%s: %s", msg, streamErr.Text[0].Value)
+		}
+		return msg
+	}
+	var se stanza.Error
+	if !errors.As(err, &se) {
+		return msg
+	}
+
+	// Without a text the message already is the condition
+	var details []string
+	if len(se.Text) != 0 && se.Condition != "" {
+		details = append(details, string(se.Condition))
+	}
+	if se.Type != "" {
+		details = append(details, string(se.Type))
+	}
+	if len(details) == 0 {
+		return msg
+	}
+	return fmt.Sprintf("%s (%s)", msg, strings.Join(details, ", "))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+	"mellium.im/xmpp/stream"
+	"mellium.im/xmpp/version"
+)
+
+// newTestClient returns a client with a session to a fake server, which
+// answers each IQ with what respond returns for it, nothing if that's empty.
+func newTestClient(t *testing.T, respond func(iq stanza.IQ) string) *client {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+
+	go func() {
+		d := xml.NewDecoder(serverConn)
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				return
+			}
+			start, ok := tok.(xml.StartElement)
+			if !ok || start.Name.Local != "iq" {
+				continue
+			}
+			var iq stanza.IQ
+			if err := d.DecodeElement(&iq, &start); err != nil {
+				return
+			}
+			if reply := respond(iq); reply != "" {
+				if _, err := io.WriteString(serverConn, reply); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	// The stream is taken as already negotiated
+	ready := func(context.Context, *stream.Info, *stream.Info, *xmpp.Session, interface{}) (xmpp.SessionState, io.ReadWriter, interface{}, error) {
+		return xmpp.Ready, nil, nil, nil
+	}
+	session, err := xmpp.NewSession(context.Background(), jid.MustParse("example.net"), jid.MustParse("juliet@example.net/balcony"), clientConn, xmpp.Secure, ready)
+	if err != nil {
+		t.Fatalf("creating session: %v", err)
+	}
+	go session.Serve(xmpp.HandlerFunc(func(xmlstream.TokenReadEncoder, *xml.StartElement) error {
+		return nil
+	}))
+	return &client{
+		logger:  log.New(io.Discard, "", 0),
+		addr:    session.LocalAddr(),
+		session: session,
+	}
+}
+
+func TestSendIQResult(t *testing.T) {
+	c := newTestClient(t, func(iq stanza.IQ) string {
+		if iq.Type != stanza.GetIQ {
+			t.Errorf("sent IQ of type %s, want get", iq.Type)
+		}
+		return fmt.Sprintf(`<iq xmlns="jabber:client" type="result" id=%q><query xmlns="jabber:iq:version"><name>Test</name><version>1.0</version></query></iq>`, iq.ID)
+	})
+
+	var q version.Query
+	err := c.sendIQ(context.Background(), jid.MustParse("example.net"), stanza.GetIQ, version.Query{}.TokenReader(), &q)
+	if err != nil {
+		t.Fatalf("sending IQ: %v", err)
+	}
+	if q.Name != "Test" || q.Version != "1.0" {
+		t.Errorf("decoded %+v, want name Test and version 1.0", q)
+	}
+}
+
+func TestSendIQError(t *testing.T) {
+	c := newTestClient(t, func(iq stanza.IQ) string {
+		return fmt.Sprintf(`<iq xmlns="jabber:client" type="error" id=%q><error type="cancel"><service-unavailable xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></error></iq>`, iq.ID)
+	})
+
+	var q version.Query
+	err := c.sendIQ(context.Background(), jid.MustParse("example.net"), stanza.GetIQ, version.Query{}.TokenReader(), &q)
+	var se stanza.Error
+	if !errors.As(err, &se) {
+		t.Fatalf("got error %v, want a stanza error", err)
+	}
+	if se.Condition != stanza.ServiceUnavailable || se.Type != stanza.Cancel {
+		t.Errorf("got %s of type %s, want service-unavailable of type cancel", se.Condition, se.Type)
+	}
+}
+
+func TestSendIQTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { requestTimeout = timeout }(requestTimeout)
+	requestTimeout = 100 * time.Millisecond
+
+	// The server never answers
+	c := newTestClient(t, func(stanza.IQ) string { return "" })
+
+	start := time.Now()
+	err := c.sendIQ(context.Background(), jid.MustParse("example.net"), stanza.GetIQ, version.Query{}.TokenReader(), nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want the deadline to be exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*requestTimeout {
+		t.Errorf("gave up after %v, want about %v", elapsed, requestTimeout)
+	}
+}
+
+func TestSendIQDisconnected(t *testing.T) {
+	c := &client{}
+	err := c.sendIQ(context.Background(), jid.MustParse("example.net"), stanza.GetIQ, version.Query{}.TokenReader(), nil)
+	if !errors.Is(err, errDisconnected) {
+		t.Errorf("got error %v, want %v", err, errDisconnected)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const pingTimeout = 15 * time.Second
+
+// keepalive pings the server every interval and drops the connection if a ping
+// fails so that the reconnect logic kicks in.
+func (c *client) keepalive(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		session := c.Session()
+		if session == nil {
+			continue
+		}
+
+		_, err := c.ping(ctx, session)
+		if err != nil && ctx.Err() == nil {
+			c.logger.Printf("Keepalive ping failed: %v", err)
+			session.Conn().Close()
+		}
+	}
+}
@@ -3,20 +3,24 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"encoding/xml"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"golang.org/x/term"
 	"mellium.im/sasl"
-	"mellium.im/xmlstream"
 	"mellium.im/xmpp"
-	"mellium.im/xmpp/dial"
 	"mellium.im/xmpp/jid"
 	"mellium.im/xmpp/stanza"
+	"mellium.im/xmpp/websocket"
 )
 
 type logWriter struct {
@@ -25,7 +29,63 @@ type logWriter struct {
 
 type messageBody struct {
 	stanza.Message
-	Body string `xml:"body"`
+	Body string `xml:"body,omitempty"`
+	// Room topic or chat subject, set to an empty string to clear it
+	Subject *string `xml:"subject,omitempty"`
+	Thread  *thread `xml:"thread,omitempty"`
+
+	// XEP-0085 chat states
+	Active    *struct{} `xml:"http://jabber.org/protocol/chatstates active,omitempty"`
+	Composing *struct{} `xml:"http://jabber.org/protocol/chatstates composing,omitempty"`
+	Paused    *struct{} `xml:"http://jabber.org/protocol/chatstates paused,omitempty"`
+
+	// XEP-0184 delivery receipts
+	Request  *struct{} `xml:"urn:xmpp:receipts request,omitempty"`
+	Received *receipt  `xml:"urn:xmpp:receipts received,omitempty"`
+
+	// XEP-0333 chat markers
+	Markable  *struct{}   `xml:"urn:xmpp:chat-markers:0 markable,omitempty"`
+	Displayed *chatMarker `xml:"urn:xmpp:chat-markers:0 displayed,omitempty"`
+
+	// XEP-0308 last message correction
+	Replace *correction `xml:"urn:xmpp:message-correct:0 replace,omitempty"`
+
+	// XEP-0066 out of band data
+	OOB *oobData `xml:"jabber:x:oob x,omitempty"`
+
+	// XEP-0172 user nickname
+	Nick string `xml:"http://jabber.org/protocol/nick nick,omitempty"`
+
+	// XEP-0224 request for the user's attention
+	Attention *struct{} `xml:"urn:xmpp:attention:0 attention,omitempty"`
+
+	// XEP-0045 marker of a private message to or from an occupant of a room
+	MUCUser *struct{} `xml:"http://jabber.org/protocol/muc#user x,omitempty"`
+
+	// XEP-0203 timestamp of a message the server held on to
+	Delay *delay `xml:"urn:xmpp:delay delay,omitempty"`
+
+	// XEP-0163 personal eventing notification
+	Event *pubsubEvent `xml:"http://jabber.org/protocol/pubsub#event event,omitempty"`
+
+	// XEP-0313 archive query result
+	MAMResult *mamResult `xml:"urn:xmpp:mam:2 result,omitempty"`
+
+	// XEP-0280 message carbons
+	CarbonSent     *carbon `xml:"urn:xmpp:carbons:2 sent,omitempty"`
+	CarbonReceived *carbon `xml:"urn:xmpp:carbons:2 received,omitempty"`
+
+	// XEP-0384 OMEMO or XEP-0373 OpenPGP encryption, announced with XEP-0380
+	// and kept in the archive with a XEP-0334 hint
+	OMEMO      *omemoEncrypted `xml:"urn:xmpp:omemo:2 encrypted,omitempty"`
+	OpenPGP    *openpgpElement `xml:"urn:xmpp:openpgp:0 openpgp,omitempty"`
+	Encryption *eme            `xml:"urn:xmpp:eme:0 encryption,omitempty"`
+	Store      *struct{}       `xml:"urn:xmpp:hints store,omitempty"`
+
+	// How the body was encrypted and whether the sender is verified,
+	// set once it's decrypted
+	Encrypted string `xml:"-"`
+	Verified  bool   `xml:"-"`
 }
 
 func (w logWriter) Write(p []byte) (int, error) {
@@ -33,22 +93,117 @@ func (w logWriter) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
-func main(){
+// stringList is a flag that can be given more than once.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+func main() {
 	// Logger and XML logger during stream negotiations
-	logger := log.New(os.Stderr, "", log.LstdFlags)
+	logger := log.New(stderrWriter{}, "", log.LstdFlags)
+	debug := log.New(io.Discard, "", log.LstdFlags)
 	sentXML := log.New(io.Discard, "SENT ", log.LstdFlags)
 	recvXML := log.New(io.Discard, "RECV ", log.LstdFlags)
 
 	// Handling flags
 	var (
-		help bool
-		verbose bool
-		quic bool
+		help        bool
+		verbose     bool
+		trace       string
+		quic        bool
+		configPath  string
+		server      string
+		port        int
+		keepalive   time.Duration
+		idle        time.Duration
+		timeout     time.Duration
+		mucRoom     string
+		historyPath string
+		rosterPath  string
+		carbons     bool
+		tofu        bool
+		caCert      string
+		clientCert  string
+		clientKey   string
+		mechanism   string
+		noPlain     bool
+		anonymous   bool
+		register    bool
+		pretty      bool
+		logPath     string
+		readMarkers bool
+		bell        bool
+		downloadDir string
+		tls13       bool
+		directTLS   bool
+		wsURL       string
+		proxyURL    string
+		accounts    stringList
+		prefer      string
+		boshURL     string
+		dryRun      bool
+		jsonEvents  bool
+		message     string
+		toAddr      string
+		resource    string
+		omemo       bool
+		pgpKey      string
+		pgpKeyring  string
+		notify      string
+		timeFormat  string
+		format      string
 	)
 	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
 	flags.BoolVar(&help, "h", help, "Show this help message.")
 	flags.BoolVar(&verbose, "v", verbose, "Show verbose logging.")
+	flags.StringVar(&trace, "trace", trace, "Only log the stanzas matching these comma separated filters, e.g. message,iq@set, rather than all XML like -v.")
+	flags.BoolVar(&dryRun, "dry-run", dryRun, "Print the stanzas that would be sent instead of connecting to a server.")
 	flags.BoolVar(&quic, "quic", quic, "Use quic to connect to server.")
+	flags.BoolVar(&directTLS, "direct-tls", directTLS, "Use TLS from the start of the connection instead of StartTLS.")
+	flags.BoolVar(&tls13, "tls13", tls13, "Require TLS 1.3.")
+	flags.StringVar(&wsURL, "ws", wsURL, "Connect to this XMPP over WebSocket endpoint, e.g. wss://example.com/ws.")
+	flags.StringVar(&boshURL, "bosh", boshURL, "Connect to this BOSH endpoint, e.g. https://example.com/http-bind.")
+	flags.StringVar(&proxyURL, "proxy", proxyURL, "Connect through this proxy, e.g. socks5://127.0.0.1:9050, socks5h:// to also have the proxy look up names, or http://proxy:3128.")
+	flags.StringVar(&prefer, "prefer", prefer, "Try addresses of this family first, ipv4 or ipv6, when the server has both.")
+	flags.Var(&accounts, "account", "Also log into this account at the same time, can be repeated. Its password is asked for like the first one's.")
+	flags.StringVar(&configPath, "config", configPath, "Load JID, password and options from a TOML file.")
+	flags.StringVar(&server, "server", server, "Connect to this host instead of looking it up from the JID.")
+	flags.IntVar(&port, "port", port, "Connect to this port instead of looking it up from the JID.")
+	flags.StringVar(&resource, "resource", resource, "Ask the server to bind this resource, e.g. desktop, instead of picking one.")
+	flags.DurationVar(&timeout, "timeout", 30*time.Second, "Give up connecting and logging in after this long, e.g. 10s or 1m.")
+	flags.DurationVar(&keepalive, "keepalive", 60*time.Second, "Interval between keepalive pings, 0 to disable.")
+	flags.DurationVar(&idle, "idle", 0, "Set your presence to away after nothing was typed for this long, e.g. 10m, and back once you type again.")
+	flags.StringVar(&message, "message", message, "Send this message, wait for it to be delivered and exit.")
+	flags.StringVar(&toAddr, "to", toAddr, "Send messages to this JID, instead of giving it after the flags.")
+	flags.StringVar(&mucRoom, "muc", mucRoom, "Join this multi-user chat room (room@service[/nick]) after logging in.")
+	flags.StringVar(&historyPath, "history", historyPath, "Append sent and received messages to this file.")
+	flags.StringVar(&rosterPath, "rostercache", rosterPath, "Keep the roster in this file, so it can be shown while offline and the server only sends changes to it.")
+	flags.BoolVar(&carbons, "carbons", carbons, "Show messages sent and received by your other clients.")
+	flags.BoolVar(&omemo, "omemo", omemo, "Encrypt messages to contacts that use OMEMO, keys are kept in the config directory.")
+	flags.StringVar(&pgpKey, "pgp", pgpKey, "Sign messages with this OpenPGP key from gpg and encrypt them to contacts with an xmpp:JID key.")
+	flags.StringVar(&pgpKeyring, "pgpkeyring", pgpKeyring, "Also look up the keys of contacts in this gpg keyring file.")
+	flags.StringVar(&format, "format", defaultFormat, "Show messages with this Go text/template, using the fields .Type, .From, .JID, .Room, .Body, .Action, .Time, .Delayed, .Thread, .Corrected, .Encrypted, .Verified and .Prefix, e.g. '{{.Time.Format \"15:04\"}} <{{.From}}> {{.Body}}'.")
+	flags.StringVar(&timeFormat, "timeformat", "15:04", "Show the time of messages in this Go time layout, e.g. 15:04:05 or 2006-01-02 15:04, empty to not show it.")
+	flags.StringVar(&notify, "notify", notify, "Show a desktop notification for messages from these comma separated JIDs, all for every contact, while the terminal is in the background. Rooms have to be listed.")
+	flags.BoolVar(&readMarkers, "readreceipts", readMarkers, "Let contacts know when you have seen their messages.")
+	flags.BoolVar(&bell, "bell", true, "Ring the terminal bell when a contact asks for your attention with /buzz.")
+	flags.StringVar(&downloadDir, "download", downloadDir, "Save files shared with you to this directory.")
+	flags.BoolVar(&tofu, "tofu", tofu, "Trust the server certificate on first use and pin it for later connections.")
+	flags.StringVar(&caCert, "cacert", caCert, "Also trust the CA certificates in this PEM file.")
+	flags.StringVar(&clientCert, "clientcert", clientCert, "Present the client certificate in this PEM file.")
+	flags.StringVar(&clientKey, "clientkey", clientKey, "Private key for -clientcert, defaults to the -clientcert file.")
+	flags.StringVar(&mechanism, "mechanism", mechanism, "Only authenticate with this SASL mechanism, e.g. PLAIN or SCRAM-SHA-256.")
+	flags.BoolVar(&noPlain, "no-plain", noPlain, "Never authenticate with PLAIN, which sends the password itself to the server.")
+	flags.BoolVar(&anonymous, "anonymous", anonymous, "Log in anonymously to the domain of -server or the target JID.")
+	flags.BoolVar(&register, "register", register, "Create the account on its server (XEP-0077) instead of logging in, asking for anything else the server wants to know.")
+	flags.BoolVar(&jsonEvents, "json", jsonEvents, "Write incoming messages and other events to stdout as JSON, one object per line, and anything else to stderr.")
+	flags.BoolVar(&pretty, "pretty", pretty, "Indent and colorize the XML log, implies -v.")
+	flags.StringVar(&logPath, "logfile", logPath, "Write the XML log and errors to this file, implies -v.")
 
 	err := flags.Parse(os.Args[1:])
 	switch err {
@@ -64,170 +219,602 @@ func main(){
 		os.Exit(0)
 	}
 
-	if verbose {
-		sentXML.SetOutput(os.Stderr)
-		recvXML.SetOutput(os.Stderr)
+	// Keep stdout for events, so everything else that's printed goes to stderr
+	var events *eventWriter
+	if jsonEvents {
+		events = newEventWriter(os.Stdout)
+		os.Stdout = os.Stderr
 	}
 
+	// Flags given on the command line take precedence over the config file
+	var cfg config
+	if configPath != "" {
+		cfg, err = loadConfig(configPath)
+		if err != nil {
+			logger.Fatalf("Error loading config file %q: %v", configPath, err)
+		}
+	}
+	setFlags := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+	if !setFlags["v"] {
+		verbose = verbose || cfg.Verbose
+	}
+	if !setFlags["server"] {
+		server = cfg.Server
+	}
+	if !setFlags["port"] {
+		port = cfg.Port
+	}
+	if !setFlags["resource"] {
+		resource = cfg.Resource
+	}
+
+	// The XML log goes to the log file if there is one so that it doesn't get
+	// mixed up with the chat, errors go to both
+	var xmlLog io.Writer = stderrWriter{}
+	if logPath != "" {
+		f, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			logger.Fatalf("Error opening log file: %v", err)
+		}
+		defer f.Close()
+		xmlLog = f
+		logger.SetOutput(io.MultiWriter(stderrWriter{}, f))
+	}
+	if verbose || pretty || logPath != "" || trace != "" {
+		debug.SetOutput(xmlLog)
+		sentXML.SetOutput(xmlLog)
+		recvXML.SetOutput(xmlLog)
+	}
+
+	var teeIn, teeOut io.Writer = logWriter{logger: recvXML}, logWriter{logger: sentXML}
+	if pretty {
+		in := &prettyWriter{logger: recvXML}
+		out := &prettyWriter{logger: sentXML}
+		// Keep piped output free of escape codes
+		if logPath == "" && term.IsTerminal(int(os.Stderr.Fd())) {
+			in.color, out.color = colorRecv, colorSent
+		}
+		teeIn, teeOut = in, out
+	}
+	if trace != "" {
+		filters, err := parseTraceFilters(trace)
+		if err != nil {
+			logger.Fatalf("Error parsing -trace: %v", err)
+		}
+		teeIn = &traceWriter{w: teeIn, filters: filters}
+		teeOut = &traceWriter{w: teeOut, filters: filters}
+	}
+	teeOut = &redactWriter{w: teeOut}
+
 	args := flags.Args()
-	if len(args) < 1 {
-		printHelp(flags)
-		os.Exit(1)
+	// Registering doesn't message anyone
+	if toAddr == "" && !register {
+		if len(args) < 1 {
+			printHelp(flags)
+			os.Exit(1)
+		}
+		toAddr = args[0]
 	}
 
-	var (
-		addr string
-		pass string
-	)
+	transports := 0
+	for _, set := range []bool{quic, directTLS, wsURL != "", boshURL != ""} {
+		if set {
+			transports++
+		}
+	}
+	if transports > 1 {
+		logger.Fatalf("Only one of -quic, -direct-tls, -ws and -bosh can be used, they all replace StartTLS")
+	}
 
-	fmt.Printf("Input your JID: ")
-	_, err = fmt.Scan(&addr)
-	if err != nil {
-		logger.Fatalf("Error reading from stdin: %v", err)
+	if prefer != "" && prefer != "ipv4" && prefer != "ipv6" {
+		logger.Fatalf("-prefer must be ipv4 or ipv6, got %q", prefer)
+	}
+	var d contextDialer = eyeballsDialer{prefer: prefer}
+	if proxyURL != "" {
+		if quic || wsURL != "" {
+			logger.Fatalf("-proxy can't be used with -quic or -ws")
+		}
+		proxy, err := newProxyDialer(proxyURL)
+		if err != nil {
+			logger.Fatalf("Error parsing -proxy: %v", err)
+		}
+		d = proxy
 	}
 
-	fmt.Printf("Password: ")
-	_, err = fmt.Scan(&pass)
-	if err != nil {
-		logger.Fatalf("Error reading from stdin: %v", err)
+	if timeout <= 0 {
+		logger.Fatalf("-timeout must be positive, got %v", timeout)
 	}
 
-	parsedAuthAddr, err := jid.Parse(addr)
+	formatTmpl, err := parseFormat(format)
 	if err != nil {
-		logger.Fatalf("Error parsing %q as a JID: %v", addr, err)
+		logger.Fatalf("Error parsing -format: %v", err)
 	}
 
-	parsedToAddr, err := jid.Parse(args[0])
+	mechanisms, err := saslMechanisms(mechanism, clientCert != "", noPlain)
 	if err != nil {
-		logger.Fatalf("Error parsing %q as a JID: %v", args[0], err)
-	}
-
-	fmt.Println("Logging in...")
-
-	// Different negotiation process for quic and tcp
-	var negotiator xmpp.Negotiator
-	if quic {
-		negotiator = xmpp.NewNegotiator(func(*xmpp.Session, *xmpp.StreamConfig) xmpp.StreamConfig {
-			return xmpp.StreamConfig{
-				Features: []xmpp.StreamFeature{
-					xmpp.SASL(parsedAuthAddr.String(), pass, sasl.ScramSha256Plus, sasl.ScramSha1Plus, sasl.ScramSha256, sasl.ScramSha1, sasl.Plain),
-					xmpp.BindResource(),
-				},
-				TeeIn: logWriter{logger: recvXML},
-				TeeOut: logWriter{logger: sentXML},
-			}
-		})
-	} else {
-		negotiator = xmpp.NewNegotiator(func(*xmpp.Session, *xmpp.StreamConfig) xmpp.StreamConfig {
-			return xmpp.StreamConfig{
-				Features: []xmpp.StreamFeature{
-					xmpp.StartTLS(&tls.Config{
-						ServerName: parsedAuthAddr.Domain().String(),
-						MinVersion: tls.VersionTLS12,
-					}),
-					xmpp.SASL(parsedAuthAddr.String(), pass, sasl.ScramSha256Plus, sasl.ScramSha1Plus, sasl.ScramSha256, sasl.ScramSha1, sasl.Plain),
-					xmpp.BindResource(),
-				},
-				TeeIn: logWriter{logger: recvXML},
-				TeeOut: logWriter{logger: sentXML},
-			}
-		})
+		logger.Fatalf("Error selecting SASL mechanism: %v", err)
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// Only prompt for values missing from the config file
+	addr := cfg.JID
+	pass := cfg.Password
+
+	// Anonymous logins only need a domain, the server assigns us a JID
+	if anonymous {
+		mechanisms = []sasl.Mechanism{saslAnonymous}
+		switch {
+		case addr != "":
+		case server != "":
+			addr = server
+		default:
+			target, err := jid.Parse(toAddr)
+			if err != nil {
+				logger.Fatalf("Error parsing %q as a JID: %v", toAddr, err)
+			}
+			addr = target.Domainpart()
+		}
+		if j, err := jid.Parse(addr); err == nil {
+			addr = j.Domainpart()
+		}
+	}
 
-	var session *xmpp.Session
-	if quic {
-		logger.Fatalf("Haven't implemented yet")
-	} else {
-		d := dial.Dialer{
-			NoTLS: true,
+	// Other accounts come from the config file and -account
+	extra := cfg.Accounts
+	for _, a := range accounts {
+		extra = append(extra, accountConfig{JID: a})
+	}
+	if register && (anonymous || dryRun || len(extra) > 0) {
+		logger.Fatalf("-register can't be used with -anonymous, -dry-run or more than one account")
+	}
+	if len(extra) > 0 {
+		switch {
+		case anonymous:
+			logger.Fatalf("-anonymous can't be used with more than one account")
+		case wsURL != "" || boshURL != "":
+			logger.Fatalf("-ws and -bosh can't be used with more than one account")
 		}
-		dialCtx, dialCtxCancel := context.WithTimeout(ctx, 30*time.Second)
-		conn, err := d.Dial(dialCtx, "tcp", parsedAuthAddr)
+	}
+
+	if addr == "" {
+		fmt.Printf("Input your JID: ")
+		_, err = fmt.Scan(&addr)
 		if err != nil {
-			logger.Fatalf("Error dialing connection: %v", err)
+			logger.Fatalf("Error reading from stdin: %v", err)
 		}
+	}
 
-		session, err = xmpp.NewSession(dialCtx, parsedAuthAddr.Domain(), parsedAuthAddr, conn, 0, negotiator)
-		dialCtxCancel()
+	if pass == "" && !anonymous && !dryRun {
+		pass, err = readPassword()
 		if err != nil {
-			logger.Fatalf("Error logging in: %v", err)
+			logger.Fatalf("Error reading password: %v", err)
+		}
+	}
+	for i, a := range extra {
+		if a.Password == "" && !dryRun {
+			extra[i].Password, err = promptPassword(fmt.Sprintf("Password for %s: ", a.JID))
+			if err != nil {
+				logger.Fatalf("Error reading password: %v", err)
+			}
 		}
 	}
 
-	defer func() {
-		fmt.Println("Closing session...")
-		if err := session.Close(); err != nil {
-			logger.Fatalf("Error ending session: %v", err)
+	var parsedToAddr jid.JID
+	if toAddr != "" {
+		parsedToAddr, err = jid.Parse(toAddr)
+		if err != nil {
+			logger.Fatalf("Error parsing %q as a JID: %v", toAddr, err)
 		}
-		if err := session.Conn().Close(); err != nil {
-			logger.Fatalf("Error ending connection: %v", err)
+	}
+
+	baseTLSConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if tls13 {
+		baseTLSConfig.MinVersion = tls.VersionTLS13
+	}
+	if caCert != "" {
+		baseTLSConfig.RootCAs, err = loadCertPool(caCert)
+		if err != nil {
+			logger.Fatalf("Error loading CA certificates from %q: %v", caCert, err)
 		}
-	}()
-	
-	// Send initial presence to let us receive message from server
-	err = session.Send(ctx, stanza.Presence{Type: stanza.AvailablePresence}.Wrap(nil))
-	if err != nil {
-		logger.Fatalf("Error sending initial presence: %v", err)
+	}
+	if clientCert != "" {
+		if clientKey == "" {
+			clientKey = clientCert
+		}
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			logger.Fatalf("Error loading client certificate: %v", err)
+		}
+		baseTLSConfig.Certificates = []tls.Certificate{cert}
+	}
+	if tofu {
+		path, err := defaultKnownHostsPath()
+		if err != nil {
+			logger.Fatalf("Error locating known hosts file: %v", err)
+		}
+		// Pinning replaces the usual chain verification
+		baseTLSConfig.InsecureSkipVerify = true
+		baseTLSConfig.VerifyConnection = (&knownHosts{path: path}).verify(logger)
 	}
 
-	// Message receiving handler
-	go func() {
-		session.Serve(xmpp.HandlerFunc(func(t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
-			d := xml.NewTokenDecoder(t)
+	var history *historyLog
+	if historyPath != "" {
+		history, err = openHistory(historyPath)
+		if err != nil {
+			logger.Fatalf("Error opening history file: %v", err)
+		}
+		defer history.Close()
+	}
 
-			// Ignore anything that's not a message. In a real system we'd want to at
-			if start.Name.Local != "message" {
-				return nil
+	var rosters *rosterCache
+	if rosterPath != "" {
+		rosters, err = openRosterCache(rosterPath)
+		if err != nil {
+			logger.Fatalf("Error opening roster cache: %v", err)
+		}
+	}
+
+	if omemo {
+		// Have the server tell us when contacts add or remove devices
+		clientFeatures = append(clientFeatures, nodeOMEMODevices+"+notify")
+	}
+
+	// newClient sets up everything that is particular to an account, the rest
+	// of the flags apply to all of them
+	newClient := func(a accountConfig) *client {
+		parsedAuthAddr, err := jid.Parse(a.JID)
+		if err != nil {
+			logger.Fatalf("Error parsing %q as a JID: %v", a.JID, err)
+		}
+
+		// The session binds the resource of the address it starts with, but we
+		// authenticate as the bare JID
+		origin := parsedAuthAddr
+		if a.Resource != "" {
+			origin, err = parsedAuthAddr.WithResource(a.Resource)
+			if err != nil {
+				logger.Fatalf("Error using %q as resource: %v", a.Resource, err)
 			}
+		}
 
-			msg := messageBody{}
-			err = d.DecodeElement(&msg, start)
-			if err != nil && err != io.EOF {
-				logger.Printf("Error decoding message: %v", err)
-				return nil
+		// PLAIN sends the password as it is, so only ever do that encrypted
+		saslUsed := &saslTracker{}
+		encrypted := encryptedURL(wsURL) || encryptedURL(boshURL)
+		accountMechanisms := make([]sasl.Mechanism, 0, len(mechanisms))
+		for _, m := range mechanisms {
+			if m.Name == sasl.Plain.Name {
+				m = requireEncryption(m, encrypted)
 			}
+			accountMechanisms = append(accountMechanisms, saslUsed.wrap(m))
+		}
 
-			if msg.Body == "" || msg.Type != stanza.ChatMessage {
+		tlsConfig := baseTLSConfig.Clone()
+		tlsConfig.ServerName = parsedAuthAddr.Domain().String()
+
+		// Stream management watches the XML going both ways to count stanzas
+		sm := &streamManagement{logger: logger}
+
+		// The negotiator asks for the password on every login so that it uses
+		// the one set with /passwd, the first time before the client exists
+		var c *client
+		password := func() string {
+			if c == nil {
+				return a.Password
+			}
+			return c.Password()
+		}
+		// Registering only needs the stream, encrypted where that's up to us
+		login := func() []xmpp.StreamFeature {
+			if register {
 				return nil
 			}
+			return []xmpp.StreamFeature{
+				xmpp.SASL(parsedAuthAddr.String(), password(), accountMechanisms...),
+				bindResource(sm),
+			}
+		}
 
-			fmt.Printf("%s: %s\n", parsedToAddr.String(), msg.Body) 
+		// Catches where see-other-host stream errors send us
+		redirects := &redirectWatcher{}
+
+		// Different negotiation process for quic and tcp, direct TLS, WebSocket
+		// and BOSH are like quic in that the stream is already encrypted
+		var negotiator xmpp.Negotiator
+		switch {
+		case wsURL != "":
+			negotiator = websocket.Negotiator(func(*xmpp.Session, *xmpp.StreamConfig) xmpp.StreamConfig {
+				return xmpp.StreamConfig{
+					Features: login(),
+					TeeIn:    io.MultiWriter(teeIn, sm.In(), redirects),
+					TeeOut:   io.MultiWriter(teeOut, sm.Out()),
+				}
+			})
+		case quic || directTLS || boshURL != "":
+			negotiator = xmpp.NewNegotiator(func(*xmpp.Session, *xmpp.StreamConfig) xmpp.StreamConfig {
+				return xmpp.StreamConfig{
+					Features: login(),
+					TeeIn:    io.MultiWriter(teeIn, sm.In(), redirects),
+					TeeOut:   io.MultiWriter(teeOut, sm.Out()),
+				}
+			})
+		default:
+			negotiator = xmpp.NewNegotiator(func(*xmpp.Session, *xmpp.StreamConfig) xmpp.StreamConfig {
+				return xmpp.StreamConfig{
+					Features: append([]xmpp.StreamFeature{xmpp.StartTLS(tlsConfig)}, login()...),
+					TeeIn:    io.MultiWriter(teeIn, sm.In(), redirects),
+					TeeOut:   io.MultiWriter(teeOut, sm.Out()),
+				}
+			})
+		}
+
+		// An explicit server or port skips SRV lookup, but the JID domain is
+		// still used for the stream and TLS server name
+		var hostport string
+		if a.Server != "" || a.Port != 0 {
+			host, port := a.Server, a.Port
+			if host == "" {
+				host = parsedAuthAddr.Domainpart()
+			}
+			if port == 0 {
+				port = 5222
+			}
+			hostport = net.JoinHostPort(host, strconv.Itoa(port))
+		}
 
-			return nil
-		}))	
+		c = &client{
+			logger:      logger,
+			addr:        origin,
+			negotiator:  negotiator,
+			carbons:     carbons,
+			readMarkers: readMarkers,
+			bell:        bell,
+			downloadDir: downloadDir,
+			events:      events,
+			nick:        a.Nick,
+			password:    a.Password,
+			history:     history,
+			rosterCache: rosters,
+			retry:       make(chan struct{}, 1),
+			redirects:   redirects,
+			sm:          sm,
+			saslUsed:    saslUsed,
+			timeFormat:  timeFormat,
+			format:      formatTmpl,
+			timeout:     timeout,
+			dial: func(ctx context.Context) (net.Conn, xmpp.SessionState, error) {
+				if quic {
+					// QUIC is always encrypted so the stream starts out secure
+					conn, err := dialQUIC(ctx, hostport, parsedAuthAddr, tlsConfig)
+					return conn, xmpp.Secure, err
+				}
+				if wsURL != "" {
+					return dialWebSocket(ctx, wsURL, tlsConfig)
+				}
+				if boshURL != "" {
+					return dialBOSH(ctx, boshURL, proxyURL, parsedAuthAddr.Domain(), tlsConfig)
+				}
+				if directTLS {
+					conn, err := dialDirectTLS(ctx, d, hostport, parsedAuthAddr, tlsConfig, debug)
+					return conn, xmpp.Secure, err
+				}
+				if hostport != "" {
+					conn, err := d.DialContext(ctx, "tcp", hostport)
+					return conn, 0, err
+				}
+				return dialDomain(ctx, d, parsedAuthAddr, tlsConfig, debug)
+			},
+		}
+		sm.send = c.Send
+		// RFC 7395 WebSocket and BOSH have their own ways of redirecting, and the
+		// QUIC address is part of the connection
+		if !quic && wsURL == "" && boshURL == "" {
+			c.dialHost = func(ctx context.Context, host string) (net.Conn, xmpp.SessionState, error) {
+				if directTLS {
+					conn, err := dialDirectTLS(ctx, d, withDefaultPort(host, "5223"), parsedAuthAddr, tlsConfig, debug)
+					return conn, xmpp.Secure, err
+				}
+				conn, err := d.DialContext(ctx, "tcp", withDefaultPort(host, "5222"))
+				return conn, 0, err
+			}
+		}
+		c.loadRoster()
+
+		if omemo {
+			path, err := defaultOMEMOPath(parsedAuthAddr)
+			if err != nil {
+				logger.Fatalf("Error locating OMEMO keys: %v", err)
+			}
+			c.omemo, err = openOMEMOStore(path)
+			if err != nil {
+				logger.Fatalf("Error loading OMEMO keys: %v", err)
+			}
+			fmt.Printf("OMEMO device %d of %s, fingerprint %s\n", c.omemo.DeviceID, parsedAuthAddr.Bare(), c.omemo.Fingerprint())
+		}
+		return c
+	}
+
+	if !dryRun && !register {
+		fmt.Println("Logging in...")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Cancel the root context on Ctrl-C or SIGTERM so that we shut down cleanly
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
 	}()
 
-	// We can start sending our message from here
-	fmt.Println("Start messaging (type 'exit' to exit)")
-	for {
-		var msg string
-		_, err := fmt.Scan(&msg)
+	// Only the first account's settings are saved to the config file
+	c := newClient(accountConfig{JID: addr, Password: pass, Server: server, Port: port, Resource: resource, Nick: cfg.Nick})
+	c.configPath = configPath
+	clients := []*client{c}
+	for _, a := range extra {
+		clients = append(clients, newClient(a))
+	}
+	// With more accounts the others carry on
+	if len(clients) == 1 {
+		c.quit = cancel
+	}
+	// Show which account something happened on once there is more than one
+	if len(clients) > 1 {
+		names := append([]accountConfig{{}}, extra...)
+		for i, c := range clients {
+			c.account = names[i].Name
+			if c.account == "" {
+				c.account = c.addr.Bare().String()
+			}
+		}
+	}
+
+	var pgp *openPGP
+	if pgpKey != "" {
+		pgp, err = newOpenPGP(pgpKey, pgpKeyring)
 		if err != nil {
-			logger.Fatalf("Error reading input: %v", err)
+			logger.Fatalf("Error loading OpenPGP key: %v", err)
 		}
+		fmt.Printf("OpenPGP key %s\n", pgp.keyID)
+	}
 
-		if msg == "exit" {
-			break
+	var n *notifier
+	if notify != "" {
+		n, err = newNotifier(notify, os.Stdout)
+		if err != nil {
+			logger.Fatalf("Error parsing -notify: %v", err)
 		}
+	}
 
-		if msg == "" {
-			continue
+	if register {
+		if err := c.register(ctx, pass, stdinPrompter); err != nil {
+			logger.Fatalf("Error registering %s: %s", c.addr.Bare(), explainError(err))
 		}
+		fmt.Printf("Registered %s, you can log in with it now\n", c.addr.Bare())
+		return
+	}
 
-		err = session.Encode(ctx, messageBody{
-			Message: stanza.Message{
-				To: parsedToAddr,
-				From: parsedAuthAddr,
-				Type: stanza.ChatMessage,
-			},
-			Body: msg,
-		})
+	for _, c := range clients {
+		c.pgp, c.notifier = pgp, n
+		if dryRun {
+			c.dryRun = &dryRunWriter{w: stdoutWriter{}}
+			err = c.Send(ctx, c.ownPresence())
+		} else {
+			err = c.connect(ctx)
+		}
+		if err != nil {
+			logger.Fatalf("Error connecting %s: %s", c.addr.Bare(), explainError(err))
+		}
+		defer c.Close()
+	}
+
+	// Scripts only want to know if the message arrived
+	if message != "" {
+		err = c.sendOnce(ctx, parsedToAddr, message, requestTimeout)
+		c.Close()
 		if err != nil {
 			logger.Fatalf("Error sending message: %v", err)
 		}
+		return
+	}
+
+	for _, c := range clients {
+		if keepalive > 0 && !dryRun {
+			go c.keepalive(ctx, keepalive)
+		}
+		if !dryRun {
+			go c.requestAcks(ctx)
+		}
+	}
+
+	ch := newChat(ctx, c, parsedToAddr)
+	ch.accounts = clients
+	if mucRoom != "" {
+		if err := ch.join(mucRoom); err != nil {
+			c.reportError(err)
+		}
+	}
+
+	entries, err := c.history.last(ch.to, historyContext)
+	if err != nil {
+		logger.Printf("Error reading history: %v", err)
+	}
+	printHistory(entries)
+
+	// JSON events are written straight to stdout, which would break the line
+	// being edited
+	in, err := newLineReader(ch.prompt(), !jsonEvents)
+	if err != nil {
+		logger.Fatalf("Error setting up the terminal: %v", err)
+	}
+	defer in.Close()
+	in.SetCompleter(ch.complete)
+	in.SetKeyHandler(ch.typed)
+	ch.input = in
+
+	// Read input in the background so that a signal can interrupt the loop.
+	// Each line is handled before reading the next one so that the prompt
+	// shows where it goes.
+	lines := make(chan string)
+	next := make(chan struct{})
+	go func() {
+		defer close(lines)
+		for {
+			line, err := in.ReadLine()
+			if err != nil {
+				if err != io.EOF {
+					logger.Printf("Error reading input: %v", err)
+				}
+				return
+			}
+			lines <- line
+			if _, ok := <-next; !ok {
+				return
+			}
+		}
+	}()
+	defer close(next)
+
+	var idleTracker *idleTracker
+	if idle > 0 && !dryRun {
+		idleTracker = newIdleTracker(idle, clients)
+		go idleTracker.run(ctx)
+	}
+
+	// We can start sending our message from here
+	fmt.Println("Start messaging (type 'exit' to exit, '/help' for commands)")
+	for {
+		var msg string
+		select {
+		case <-ctx.Done():
+			return
+		case line, ok := <-lines:
+			if !ok {
+				return
+			}
+			msg = line
+		}
+		if idleTracker != nil {
+			idleTracker.active(ctx)
+		}
+
+		if msg == "exit" {
+			break
+		}
+
+		if strings.TrimSpace(msg) != "" {
+			ch.handle(msg)
+		}
+		in.SetPrompt(ch.prompt())
+		next <- struct{}{}
 	}
 }
 
@@ -235,4 +822,6 @@ func printHelp(flags *flag.FlagSet) {
 	fmt.Fprintf(flags.Output(), "Usage of %s:\n", os.Args[0])
 	flags.PrintDefaults()
 	fmt.Printf("Running: %s <flags> <JID Target>\n", os.Args[0])
+	fmt.Printf("     or: %s <flags> -to <JID Target> -message <text>\n", os.Args[0])
+	fmt.Println("Type /help once connected to list the chat commands.")
 }
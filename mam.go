@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"mellium.im/xmpp/history"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+const mamPageSize = 50
+
+// XEP-0313 archived message
+type mamResult struct {
+	QueryID   string    `xml:"queryid,attr"`
+	ID        string    `xml:"id,attr"`
+	Forwarded forwarded `xml:"urn:xmpp:forward:0 forwarded"`
+}
+
+// collectArchived stores a result for one of our running queries and reports
+// whether it was expected.
+func (c *client) collectArchived(r *mamResult) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	results, ok := c.mamQueries[r.QueryID]
+	if !ok {
+		return false
+	}
+	c.mamQueries[r.QueryID] = append(results, *r)
+	return true
+}
+
+// fetchArchive pages through the server side archive, optionally only
+// returning messages exchanged with the given JID.
+func (c *client) fetchArchive(ctx context.Context, with jid.JID) ([]mamResult, error) {
+	query := history.Query{
+		ID:    newID(),
+		With:  with,
+		Limit: mamPageSize,
+	}
+	c.mu.Lock()
+	if c.mamQueries == nil {
+		c.mamQueries = make(map[string][]mamResult)
+	}
+	c.mamQueries[query.ID] = nil
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.mamQueries, query.ID)
+		c.mu.Unlock()
+	}()
+
+	for {
+		var res history.Result
+		err := c.sendIQ(ctx, jid.JID{}, stanza.SetIQ, query.TokenReader(), &res)
+		if err != nil {
+			return nil, err
+		}
+		if res.Complete || res.Set.Last == "" || res.Set.Last == query.PageID {
+			break
+		}
+		query.PageID = res.Set.Last
+	}
+
+	c.mu.Lock()
+	results := c.mamQueries[query.ID]
+	c.mu.Unlock()
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Forwarded.Delay.Stamp.Before(results[j].Forwarded.Delay.Stamp)
+	})
+	return results, nil
+}
+
+func (c *client) printArchive(results []mamResult) {
+	if len(results) == 0 {
+		printf("No archived messages found\n")
+		return
+	}
+	w := newBlock()
+	defer w.Flush()
+	for _, r := range results {
+		msg := r.Forwarded.Message
+		decrypted := msg
+		c.decryptBody(&decrypted)
+		// Messages we can't decrypt keep their fallback body
+		if decrypted.Body != "" {
+			msg = decrypted
+		}
+		if msg.Body == "" {
+			continue
+		}
+		from := msg.From.Bare().String()
+		if from == "" || msg.From.Bare().Equal(c.LocalAddr().Bare()) {
+			from = "me"
+		}
+		fmt.Fprintf(w, "%s %s%s: %s\n", r.Forwarded.Delay.Stamp.Local().Format(time.DateTime), encryptionLabel(msg), from, msg.Body)
+	}
+}
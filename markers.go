@@ -0,0 +1,27 @@
+package main
+
+import (
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/stanza"
+)
+
+// XEP-0333 chat marker
+type chatMarker struct {
+	ID string `xml:"id,attr"`
+}
+
+// sendDisplayed tells the sender of msg that we've shown it to the user.
+func (c *client) sendDisplayed(t xmlstream.Encoder, msg messageBody) {
+	err := t.Encode(messageBody{
+		Message: stanza.Message{
+			ID:   newID(),
+			To:   msg.From,
+			From: c.LocalAddr(),
+			Type: msg.Type,
+		},
+		Displayed: &chatMarker{ID: msg.ID},
+	})
+	if err != nil {
+		c.logger.Printf("Error sending displayed marker: %v", err)
+	}
+}
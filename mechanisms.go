@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+
+	"mellium.im/sasl"
+)
+
+const nsSASL = "urn:ietf:params:xml:ns:xmpp-sasl"
+
+// errPlainUnencrypted is returned instead of sending our password in the clear.
+var errPlainUnencrypted = errors.New("refusing to authenticate with PLAIN over an unencrypted connection")
+
+// saslExternal is the SASL EXTERNAL mechanism from RFC 4422 appendix A. The
+// server derives our identity from the client certificate, so we send an
+// empty response and let it pick the authorization identity.
+var saslExternal = sasl.Mechanism{
+	Name: "EXTERNAL",
+	Start: func(*sasl.Negotiator) (bool, []byte, interface{}, error) {
+		return false, nil, nil, nil
+	},
+	Next: func(*sasl.Negotiator, []byte, interface{}) (bool, []byte, interface{}, error) {
+		return false, nil, nil, sasl.ErrTooManySteps
+	},
+}
+
+// saslAnonymous is the SASL ANONYMOUS mechanism from RFC 4505. We don't send
+// any trace information.
+var saslAnonymous = sasl.Mechanism{
+	Name: "ANONYMOUS",
+	Start: func(*sasl.Negotiator) (bool, []byte, interface{}, error) {
+		return false, nil, nil, nil
+	},
+	Next: func(*sasl.Negotiator, []byte, interface{}) (bool, []byte, interface{}, error) {
+		return false, nil, nil, sasl.ErrTooManySteps
+	},
+}
+
+// defaultMechanisms is in order of preference, strongest first.
+var defaultMechanisms = []sasl.Mechanism{
+	sasl.ScramSha256Plus,
+	sasl.ScramSha1Plus,
+	sasl.ScramSha256,
+	sasl.ScramSha1,
+	sasl.Plain,
+}
+
+// saslMechanisms returns the mechanisms we offer to use. An empty name means
+// all of them, EXTERNAL only being tried when we have a client certificate
+// and PLAIN only if noPlain isn't set.
+func saslMechanisms(name string, clientCert, noPlain bool) ([]sasl.Mechanism, error) {
+	if noPlain && strings.EqualFold(name, sasl.Plain.Name) {
+		return nil, errors.New("PLAIN is disabled with -no-plain")
+	}
+	var all []sasl.Mechanism
+	if clientCert {
+		all = append(all, saslExternal)
+	}
+	for _, m := range defaultMechanisms {
+		if !noPlain || m.Name != sasl.Plain.Name {
+			all = append(all, m)
+		}
+	}
+	if name == "" {
+		return all, nil
+	}
+
+	known := append([]sasl.Mechanism{saslExternal}, defaultMechanisms...)
+	var names []string
+	for _, m := range known {
+		if strings.EqualFold(m.Name, name) {
+			return []sasl.Mechanism{m}, nil
+		}
+		names = append(names, m.Name)
+	}
+	return nil, fmt.Errorf("unknown SASL mechanism %q, expected one of %s", name, strings.Join(names, ", "))
+}
+
+// requireEncryption makes m fail instead of starting unless the connection is
+// encrypted. The negotiator only knows about TLS that the session set up
+// itself, so encrypted is set for transports that encrypt on their own, like
+// BOSH over HTTPS.
+func requireEncryption(m sasl.Mechanism, encrypted bool) sasl.Mechanism {
+	start := m.Start
+	m.Start = func(n *sasl.Negotiator) (bool, []byte, interface{}, error) {
+		if n.TLSState() == nil && !encrypted {
+			return false, nil, nil, errPlainUnencrypted
+		}
+		return start(n)
+	}
+	return m
+}
+
+// encryptedURL reports whether a -ws or -bosh endpoint is reached over TLS.
+func encryptedURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && (u.Scheme == "wss" || u.Scheme == "https")
+}
+
+// saslTracker remembers which mechanism we last authenticated with and what
+// the server offered, which the library doesn't tell us.
+type saslTracker struct {
+	mu      sync.Mutex
+	used    string
+	offered []string
+}
+
+// wrap has m record itself as the one in use when it starts.
+func (t *saslTracker) wrap(m sasl.Mechanism) sasl.Mechanism {
+	start, name := m.Start, m.Name
+	m.Start = func(n *sasl.Negotiator) (bool, []byte, interface{}, error) {
+		t.mu.Lock()
+		t.used, t.offered = name, n.RemoteMechanisms()
+		t.mu.Unlock()
+		return start(n)
+	}
+	return m
+}
+
+// mechanism is the name of the mechanism we last authenticated with.
+func (t *saslTracker) mechanism() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.used
+}
+
+// check logs which mechanism we authenticated with and whether it bound the
+// authentication to the TLS channel. Not using channel binding although the
+// server offers it means that we were told to, or that someone in the middle
+// could have relayed our login.
+func (t *saslTracker) check(logger *log.Logger) {
+	t.mu.Lock()
+	used, offered := t.used, t.offered
+	t.mu.Unlock()
+
+	switch {
+	case used == "":
+	case strings.HasSuffix(used, "-PLUS"):
+		logger.Printf("Authenticated with %s, bound to the TLS channel", used)
+	default:
+		var plus []string
+		for _, name := range offered {
+			if strings.HasSuffix(name, "-PLUS") {
+				plus = append(plus, name)
+			}
+		}
+		if len(plus) == 0 {
+			logger.Printf("Authenticated with %s", used)
+			return
+		}
+		logger.Printf("Warning: authenticated with %s without channel binding although the server offers %s, the login could have been relayed by someone in the middle", used, strings.Join(plus, ", "))
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"sort"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// XEP-0045 join presence
+type mucPresence struct {
+	stanza.Presence
+	X    *struct{}    `xml:"http://jabber.org/protocol/muc x,omitempty"`
+	Caps *capsElement `xml:"http://jabber.org/protocol/caps c,omitempty"`
+}
+
+// isOccupant reports whether addr is someone in a room we are in rather than a
+// contact, as for private messages sent through the room.
+func (c *client) isOccupant(addr jid.JID) bool {
+	if addr.Resourcepart() == "" {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.rooms[addr.Bare().String()]
+	return ok
+}
+
+// occupantJID adds our default nickname to room if it has no resource.
+func (c *client) occupantJID(room jid.JID) (jid.JID, error) {
+	if room.Resourcepart() != "" {
+		return room, nil
+	}
+	return room.WithResource(c.LocalAddr().Localpart())
+}
+
+// joinRoom sends presence to the occupant JID (room@service/nick) and
+// remembers the room so that it can be joined again after a reconnect.
+func (c *client) joinRoom(ctx context.Context, occupant jid.JID) error {
+	err := c.Encode(ctx, mucPresence{
+		Presence: stanza.Presence{
+			ID:   newID(),
+			To:   occupant,
+			From: c.LocalAddr(),
+		},
+		X:    &struct{}{},
+		Caps: ownCaps(),
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rooms == nil {
+		c.rooms = make(map[string]jid.JID)
+	}
+	c.rooms[occupant.Bare().String()] = occupant
+	return nil
+}
+
+func (c *client) leaveRoom(ctx context.Context, room jid.JID) error {
+	c.mu.Lock()
+	occupant, ok := c.rooms[room.Bare().String()]
+	delete(c.rooms, room.Bare().String())
+	delete(c.occupants, room.Bare().String())
+	c.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("not in room %s", room.Bare())
+	}
+
+	return c.Encode(ctx, stanza.Presence{
+		ID:   newID(),
+		To:   occupant,
+		From: c.LocalAddr(),
+		Type: stanza.UnavailablePresence,
+	})
+}
+
+const nsMUCAdmin = "http://jabber.org/protocol/muc#admin"
+
+// XEP-0045 status codes of occupant presence
+const (
+	mucStatusSelf        = 110
+	mucStatusBanned      = 301
+	mucStatusNickChanged = 303
+	mucStatusKicked      = 307
+	mucStatusRemoved     = 321
+)
+
+// mucUser is the extension of presence from room occupants.
+type mucUser struct {
+	Item struct {
+		Affiliation string `xml:"affiliation,attr"`
+		Role        string `xml:"role,attr"`
+		JID         string `xml:"jid,attr"`
+		Nick        string `xml:"nick,attr"`
+		Actor       struct {
+			Nick string `xml:"nick,attr"`
+		} `xml:"actor"`
+		Reason string `xml:"reason"`
+	} `xml:"item"`
+	Status []struct {
+		Code int `xml:"code,attr"`
+	} `xml:"status"`
+}
+
+func (u *mucUser) hasStatus(code int) bool {
+	for _, s := range u.Status {
+		if s.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// occupant is the role and affiliation of someone in a room, and their JID if
+// the room tells us.
+type occupant struct {
+	Role        string
+	Affiliation string
+	JID         string
+}
+
+// handleOccupantPresence keeps track of the occupants of rooms we are in and
+// reports who joins and leaves and changes to their role and affiliation.
+func (c *client) handleOccupantPresence(p presenceBody) {
+	room, nick := p.From.Bare(), p.From.Resourcepart()
+	u := p.MUC
+	now := occupant{Role: u.Item.Role, Affiliation: u.Item.Affiliation, JID: u.Item.JID}
+	self := u.hasStatus(mucStatusSelf)
+	gone := p.Type == stanza.UnavailablePresence
+	renamed := gone && u.hasStatus(mucStatusNickChanged) && u.Item.Nick != ""
+
+	c.mu.Lock()
+	us, in := c.rooms[room.String()]
+	if !in {
+		c.mu.Unlock()
+		return
+	}
+	if c.occupants == nil {
+		c.occupants = make(map[string]map[string]occupant)
+	}
+	occupants := c.occupants[room.String()]
+	if occupants == nil {
+		occupants = make(map[string]occupant)
+		c.occupants[room.String()] = occupants
+	}
+	// Until our own presence arrives the room is telling us who is in it
+	// already
+	_, joined := occupants[us.Resourcepart()]
+	old, seen := occupants[nick]
+	switch {
+	case renamed:
+		delete(occupants, nick)
+		// So that the presence with the new nickname isn't a join
+		occupants[u.Item.Nick] = now
+		if self {
+			c.rooms[room.String()], _ = room.WithResource(u.Item.Nick)
+		}
+	case gone:
+		delete(occupants, nick)
+		// The room has dropped us
+		if self {
+			delete(c.rooms, room.String())
+			delete(c.occupants, room.String())
+		}
+	default:
+		occupants[nick] = now
+		// The room may have given us another nickname than we asked for
+		if self {
+			c.rooms[room.String()] = p.From
+		}
+	}
+	c.mu.Unlock()
+
+	e := event{Type: "occupant", From: p.From.String(), Presence: "available", Status: p.Status, Role: now.Role, Affiliation: now.Affiliation}
+	if gone {
+		e.Presence = "offline"
+	}
+	who, is, was := nick, "is", "was"
+	if self {
+		who, is, was = "You", "are", "were"
+	}
+	by, changedBy := "", ""
+	if u.Item.Actor.Nick != "" {
+		by, changedBy = " by "+u.Item.Actor.Nick, " (changed by "+u.Item.Actor.Nick+")"
+	}
+	reason := ""
+	if u.Item.Reason != "" {
+		reason = ": " + u.Item.Reason
+	}
+	status := ""
+	if p.Status != "" {
+		status = " (" + p.Status + ")"
+	}
+	switch {
+	case gone && u.hasStatus(mucStatusKicked):
+		c.report(e, "[%s] %s %s kicked%s%s\n", room, who, was, by, reason)
+	case gone && u.hasStatus(mucStatusBanned):
+		c.report(e, "[%s] %s %s banned%s%s\n", room, who, was, by, reason)
+	case gone && u.hasStatus(mucStatusRemoved):
+		c.report(e, "[%s] %s %s removed for not being a member\n", room, who, was)
+	case renamed:
+		c.report(e, "[%s] %s %s now known as %s\n", room, who, is, u.Item.Nick)
+	case gone && joined:
+		c.report(e, "[%s] %s left the room%s\n", room, nick, status)
+	case !seen && joined && !self:
+		c.report(e, "[%s] %s joined the room as %s\n", room, nick, article(now.Role))
+	case gone || !seen:
+	case old.Role != now.Role:
+		c.report(e, "[%s] %s %s now %s%s\n", room, who, is, article(now.Role), changedBy)
+	case old.Affiliation != now.Affiliation:
+		c.report(e, "[%s] %s %s now %s%s\n", room, who, is, article(now.Affiliation), changedBy)
+	}
+}
+
+// printOccupants lists who is in room with their role and affiliation.
+func (c *client) printOccupants(room jid.JID) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	occupants, ok := c.occupants[room.String()]
+	if !ok {
+		return fmt.Errorf("not in room %s", room)
+	}
+	nicks := make([]string, 0, len(occupants))
+	for nick := range occupants {
+		nicks = append(nicks, nick)
+	}
+	sort.Strings(nicks)
+
+	w := newBlock()
+	defer w.Flush()
+	fmt.Fprintf(w, "%d occupants of %s:\n", len(nicks), room)
+	for _, nick := range nicks {
+		o := occupants[nick]
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", nick, o.Role, o.Affiliation, o.JID)
+	}
+	return nil
+}
+
+// article describes a role or affiliation, e.g. "a moderator" or "an owner".
+func article(s string) string {
+	switch s {
+	case "", "none":
+		return "without a role or affiliation"
+	case "outcast":
+		return "banned"
+	case "admin", "owner":
+		return "an " + s
+	}
+	return "a " + s
+}
+
+// setOccupant changes the role of the occupant nick or the affiliation of the
+// user addr in room, one of the two is empty.
+func (c *client) setOccupant(ctx context.Context, room jid.JID, nick string, addr jid.JID, attr, value, reason string) error {
+	attrs := []xml.Attr{{Name: xml.Name{Local: attr}, Value: value}}
+	if nick != "" {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "nick"}, Value: nick})
+	} else {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "jid"}, Value: addr.Bare().String()})
+	}
+	var inner xml.TokenReader
+	if reason != "" {
+		inner = xmlstream.Wrap(
+			xmlstream.Token(xml.CharData(reason)),
+			xml.StartElement{Name: xml.Name{Local: "reason"}},
+		)
+	}
+	payload := xmlstream.Wrap(
+		xmlstream.Wrap(inner, xml.StartElement{Name: xml.Name{Local: "item"}, Attr: attrs}),
+		xml.StartElement{Name: xml.Name{Space: nsMUCAdmin, Local: "query"}},
+	)
+	err := c.sendIQ(ctx, room.Bare(), stanza.SetIQ, payload, nil)
+	var se stanza.Error
+	if errors.As(err, &se) {
+		switch se.Condition {
+		case stanza.Forbidden:
+			return fmt.Errorf("you don't have the privileges to do that in %s", room.Bare())
+		case stanza.NotAllowed:
+			return fmt.Errorf("%s doesn't allow that, e.g. owners and admins can't be kicked: %s", room.Bare(), explainError(err))
+		case stanza.ItemNotFound, stanza.NotAcceptable:
+			return fmt.Errorf("%s has no occupant like that: %s", room.Bare(), explainError(err))
+		}
+	}
+	return err
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+
+	"mellium.im/xmlstream"
+)
+
+const nsNick = "http://jabber.org/protocol/nick"
+
+// setNick publishes nick as our XEP-0172 user nickname and includes it in
+// messages and subscription requests from now on.
+func (c *client) setNick(ctx context.Context, nick string) error {
+	err := c.publish(ctx, nsNick, xmlstream.Wrap(
+		xmlstream.Token(xml.CharData(nick)),
+		xml.StartElement{Name: xml.Name{Space: nsNick, Local: "nick"}},
+	))
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.nick = nick
+	c.mu.Unlock()
+	return nil
+}
+
+// Nick returns our nickname or an empty string if we haven't set one.
+func (c *client) Nick() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nick
+}
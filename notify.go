@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"unicode"
+
+	"mellium.im/xmpp/jid"
+)
+
+// Longest body shown in a notification
+const maxNotifyBody = 200
+
+// notifier decides which messages we alert the user about, see -notify.
+type notifier struct {
+	// Every chat message, rooms still have to be listed
+	all  bool
+	jids map[string]bool
+	// Used to ring the bell when notify-send isn't installed
+	tty *os.File
+}
+
+// newNotifier parses a comma separated list of JIDs, where all stands for
+// every contact.
+func newNotifier(list string, tty *os.File) (*notifier, error) {
+	n := &notifier{jids: make(map[string]bool), tty: tty}
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		switch s {
+		case "":
+		case "all":
+			n.all = true
+		default:
+			addr, err := parseJID(s)
+			if err != nil {
+				return nil, err
+			}
+			n.jids[addr.Bare().String()] = true
+		}
+	}
+	return n, nil
+}
+
+// notify alerts the user to a message from from, unless they are looking at
+// the terminal already.
+func (c *client) notify(from jid.JID, groupchat bool, body string) {
+	n := c.notifier
+	if n == nil || focused.Load() {
+		return
+	}
+	if !n.jids[from.Bare().String()] && (groupchat || !n.all) {
+		return
+	}
+
+	title := "Message from " + from.Bare().String()
+	if groupchat {
+		title = fmt.Sprintf("%s in %s", from.Resourcepart(), from.Bare())
+	}
+	if len(body) > maxNotifyBody {
+		body = strings.ToValidUTF8(body[:maxNotifyBody], "") + "…"
+	}
+
+	if _, err := exec.LookPath("notify-send"); err != nil {
+		// Ring the bell and put the sender in the window title instead. Room
+		// nicknames are chosen by others, a BEL or ESC in one would end the
+		// sequence and start another.
+		fmt.Fprintf(n.tty, "\a\x1b]2;%s\a", stripControl(title))
+		return
+	}
+	go func() {
+		if err := exec.Command("notify-send", "--app-name=xmpp-client", "--", title, body).Run(); err != nil {
+			c.logger.Printf("Error showing notification: %v", err)
+		}
+	}()
+}
+
+// stripControl removes control characters from s.
+func stripControl(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,809 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+const (
+	nsOMEMO          = "urn:xmpp:omemo:2"
+	nodeOMEMODevices = nsOMEMO + ":devices"
+	nodeOMEMOBundles = nsOMEMO + ":bundles"
+
+	// One-time prekeys in our bundle
+	omemoPreKeys = 100
+	// Body for clients that can't decrypt the message
+	omemoFallback = "This message is encrypted with OMEMO, which your client does not seem to support."
+)
+
+// errNoOMEMO means that a contact hasn't published any OMEMO devices.
+var errNoOMEMO = errors.New("no OMEMO devices")
+
+// XEP-0384 encrypted element, the payload is encrypted once and its key for
+// each device
+type omemoEncrypted struct {
+	Header struct {
+		SID  uint32      `xml:"sid,attr"`
+		Keys []omemoKeys `xml:"keys"`
+	} `xml:"header"`
+	Payload string `xml:"payload,omitempty"`
+}
+
+type omemoKeys struct {
+	JID  string     `xml:"jid,attr"`
+	Keys []omemoKey `xml:"key"`
+}
+
+type omemoKey struct {
+	RID uint32 `xml:"rid,attr"`
+	// Set if the key starts a new session
+	KEX  bool   `xml:"kex,attr,omitempty"`
+	Data string `xml:",chardata"`
+}
+
+// XEP-0380 explicit message encryption
+type eme struct {
+	Namespace string `xml:"namespace,attr"`
+	Name      string `xml:"name,attr,omitempty"`
+}
+
+// Devices of an account
+type omemoDeviceList struct {
+	Devices []struct {
+		ID uint32 `xml:"id,attr"`
+	} `xml:"device"`
+}
+
+// Public keys of a device
+type omemoBundle struct {
+	SignedPreKey struct {
+		ID  uint32 `xml:"id,attr"`
+		Key string `xml:",chardata"`
+	} `xml:"spk"`
+	Signature string `xml:"spks"`
+	Identity  string `xml:"ik"`
+	PreKeys   []struct {
+		ID  uint32 `xml:"id,attr"`
+		Key string `xml:",chardata"`
+	} `xml:"prekeys>pk"`
+}
+
+// XEP-0420 envelope, what actually gets encrypted
+type sceEnvelope struct {
+	XMLName xml.Name `xml:"urn:xmpp:sce:1 envelope"`
+	Content struct {
+		Body string `xml:"jabber:client body"`
+	} `xml:"content"`
+	// Random padding to hide the length of the body
+	RPad string `xml:"rpad"`
+	From struct {
+		JID string `xml:"jid,attr"`
+	} `xml:"from"`
+	To struct {
+		JID string `xml:"jid,attr"`
+	} `xml:"to"`
+}
+
+// omemoStore is our OMEMO device: its keys, the sessions with other devices
+// and the identity keys of the devices we've seen. It's saved as JSON after
+// every change.
+type omemoStore struct {
+	mu   sync.Mutex
+	path string
+	// Device lists we've fetched, kept up to date by notifications
+	deviceLists map[string][]uint32
+
+	DeviceID     uint32
+	Identity     []byte
+	SignedPreKey struct {
+		ID        uint32
+		Key       []byte
+		Signature []byte
+	}
+	PreKeys      map[uint32][]byte
+	NextPreKeyID uint32
+	// Keyed by bare JID and device ID
+	Sessions map[string]*ratchet
+	Devices  map[string]*omemoDevice
+}
+
+type omemoDevice struct {
+	Identity []byte
+	Verified bool
+}
+
+func defaultOMEMOPath(addr jid.JID) (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "xmpp-client", "omemo", addr.Bare().String()+".json"), nil
+}
+
+// openOMEMOStore loads our device from path or creates a new one.
+func openOMEMOStore(path string) (*omemoStore, error) {
+	s := &omemoStore{path: path}
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		err = json.Unmarshal(data, s)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		return s, nil
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+
+	// Device IDs are between 1 and 2^31 - 1
+	n, err := rand.Int(rand.Reader, big.NewInt(1<<31-1))
+	if err != nil {
+		return nil, err
+	}
+	s.DeviceID = uint32(n.Int64()) + 1
+	_, identity, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	s.Identity = identity.Seed()
+	spk, err := newX25519()
+	if err != nil {
+		return nil, err
+	}
+	s.SignedPreKey.ID = 1
+	s.SignedPreKey.Key = spk.Bytes()
+	s.SignedPreKey.Signature = ed25519.Sign(identity, spk.PublicKey().Bytes())
+	s.NextPreKeyID = 1
+	if err := s.generatePreKeys(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	return s, s.save()
+}
+
+// save writes the store to its file, s.mu must be held.
+func (s *omemoStore) save() error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	// Losing the sessions to a partial write would break them for good
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// generatePreKeys tops up the one-time prekeys, s.mu must be held.
+func (s *omemoStore) generatePreKeys() error {
+	if s.PreKeys == nil {
+		s.PreKeys = make(map[uint32][]byte)
+	}
+	for len(s.PreKeys) < omemoPreKeys {
+		k, err := newX25519()
+		if err != nil {
+			return err
+		}
+		s.PreKeys[s.NextPreKeyID] = k.Bytes()
+		s.NextPreKeyID++
+	}
+	return nil
+}
+
+func (s *omemoStore) identity() ed25519.PrivateKey {
+	return ed25519.NewKeyFromSeed(s.Identity)
+}
+
+// Fingerprint returns the fingerprint of our identity key.
+func (s *omemoStore) Fingerprint() string {
+	return omemoFingerprint(s.identity().Public().(ed25519.PublicKey))
+}
+
+// omemoFingerprint formats an identity key in groups of eight hex digits.
+func omemoFingerprint(identity []byte) string {
+	h := hex.EncodeToString(identity)
+	var groups []string
+	for len(h) > 8 {
+		groups = append(groups, h[:8])
+		h = h[8:]
+	}
+	return strings.Join(append(groups, h), " ")
+}
+
+func deviceKey(owner jid.JID, id uint32) string {
+	return owner.Bare().String() + "/" + strconv.FormatUint(uint64(id), 10)
+}
+
+// learnIdentity records the identity key of a device the first time we see
+// it and refuses keys that changed after that, s.mu must be held.
+func (s *omemoStore) learnIdentity(owner jid.JID, id uint32, identity []byte) (isNew bool, err error) {
+	if s.Devices == nil {
+		s.Devices = make(map[string]*omemoDevice)
+	}
+	d, ok := s.Devices[deviceKey(owner, id)]
+	if ok {
+		if !bytes.Equal(d.Identity, identity) {
+			return false, fmt.Errorf("the identity key of device %d of %s changed, someone may be impersonating it", id, owner.Bare())
+		}
+		return false, nil
+	}
+	s.Devices[deviceKey(owner, id)] = &omemoDevice{Identity: identity}
+	return true, s.save()
+}
+
+// trusted filters the devices of owner we encrypt for. Until one of them is
+// verified with /trust all of them are trusted blindly, after that only the
+// verified ones.
+func (s *omemoStore) trusted(owner jid.JID, devices []uint32) []uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var verified []uint32
+	for _, id := range devices {
+		if d, ok := s.Devices[deviceKey(owner, id)]; ok && d.Verified {
+			verified = append(verified, id)
+		}
+	}
+	if len(verified) > 0 {
+		return verified
+	}
+	return devices
+}
+
+// bundle returns our public keys for publishing.
+func (s *omemoStore) bundle() xml.TokenReader {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	text := func(name, value string, attr ...xml.Attr) xml.TokenReader {
+		return xmlstream.Wrap(
+			xmlstream.Token(xml.CharData(value)),
+			xml.StartElement{Name: xml.Name{Local: name}, Attr: attr},
+		)
+	}
+	idAttr := func(id uint32) xml.Attr {
+		return xml.Attr{Name: xml.Name{Local: "id"}, Value: strconv.FormatUint(uint64(id), 10)}
+	}
+	b64 := base64.StdEncoding.EncodeToString
+
+	ids := make([]uint32, 0, len(s.PreKeys))
+	for id := range s.PreKeys {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	var prekeys []xml.TokenReader
+	for _, id := range ids {
+		k, err := x25519Public(s.PreKeys[id])
+		if err != nil {
+			continue
+		}
+		prekeys = append(prekeys, text("pk", b64(k), idAttr(id)))
+	}
+
+	spk, _ := x25519Public(s.SignedPreKey.Key)
+	return xmlstream.Wrap(
+		xmlstream.MultiReader(
+			text("spk", b64(spk), idAttr(s.SignedPreKey.ID)),
+			text("spks", b64(s.SignedPreKey.Signature)),
+			text("ik", b64(s.identity().Public().(ed25519.PublicKey))),
+			xmlstream.Wrap(xmlstream.MultiReader(prekeys...), xml.StartElement{Name: xml.Name{Local: "prekeys"}}),
+		),
+		xml.StartElement{Name: xml.Name{Space: nsOMEMO, Local: "bundle"}},
+	)
+}
+
+// setupOMEMO publishes our keys and adds our device to the device list of
+// our account.
+func (c *client) setupOMEMO(ctx context.Context) error {
+	err := c.publishBundle(ctx)
+	if err != nil {
+		return fmt.Errorf("publishing keys: %w", err)
+	}
+	return c.announceDevice(ctx)
+}
+
+func (c *client) publishBundle(ctx context.Context) error {
+	return c.publishItem(ctx, nodeOMEMOBundles, strconv.FormatUint(uint64(c.omemo.DeviceID), 10), c.omemo.bundle(), map[string]string{
+		"pubsub#access_model": "open",
+		"pubsub#max_items":    "max",
+	})
+}
+
+// announceDevice adds our device to the device list of our account if it
+// isn't there yet.
+func (c *client) announceDevice(ctx context.Context) error {
+	devices, err := c.fetchDeviceList(ctx, c.LocalAddr().Bare())
+	if err != nil {
+		return fmt.Errorf("fetching device list: %w", err)
+	}
+	for _, id := range devices {
+		if id == c.omemo.DeviceID {
+			return nil
+		}
+	}
+	devices = append(devices, c.omemo.DeviceID)
+
+	var list []xml.TokenReader
+	for _, id := range devices {
+		list = append(list, xmlstream.Wrap(nil, xml.StartElement{
+			Name: xml.Name{Local: "device"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "id"}, Value: strconv.FormatUint(uint64(id), 10)}},
+		}))
+	}
+	err = c.publishItem(ctx, nodeOMEMODevices, "current", xmlstream.Wrap(
+		xmlstream.MultiReader(list...),
+		xml.StartElement{Name: xml.Name{Space: nsOMEMO, Local: "devices"}},
+	), map[string]string{"pubsub#access_model": "open"})
+	if err != nil {
+		return fmt.Errorf("publishing device list: %w", err)
+	}
+	c.omemo.mu.Lock()
+	c.omemo.setDeviceList(c.LocalAddr(), devices)
+	c.omemo.mu.Unlock()
+	return nil
+}
+
+// setDeviceList caches the devices of owner, s.mu must be held.
+func (s *omemoStore) setDeviceList(owner jid.JID, devices []uint32) {
+	if s.deviceLists == nil {
+		s.deviceLists = make(map[string][]uint32)
+	}
+	s.deviceLists[owner.Bare().String()] = devices
+}
+
+// fetchDeviceList gets the devices of owner from the server. Accounts that
+// never published any have none, as do those whose server refuses to tell,
+// e.g. without PEP.
+func (c *client) fetchDeviceList(ctx context.Context, owner jid.JID) ([]uint32, error) {
+	items, err := c.fetchItems(ctx, owner.Bare(), nodeOMEMODevices, "")
+	var se stanza.Error
+	if errors.As(err, &se) {
+		return nil, nil
+	}
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	var list omemoDeviceList
+	if err := items[0].decode(&list); err != nil {
+		return nil, err
+	}
+	devices := make([]uint32, 0, len(list.Devices))
+	for _, d := range list.Devices {
+		devices = append(devices, d.ID)
+	}
+	return devices, nil
+}
+
+// deviceList is fetchDeviceList with a cache.
+func (c *client) deviceList(ctx context.Context, owner jid.JID) ([]uint32, error) {
+	c.omemo.mu.Lock()
+	devices, ok := c.omemo.deviceLists[owner.Bare().String()]
+	c.omemo.mu.Unlock()
+	if ok {
+		return devices, nil
+	}
+	devices, err := c.fetchDeviceList(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	c.omemo.mu.Lock()
+	c.omemo.setDeviceList(owner, devices)
+	c.omemo.mu.Unlock()
+	return devices, nil
+}
+
+// handleDeviceList updates the cached devices of an account from a
+// notification and puts our device back if another client removed it.
+func (c *client) handleDeviceList(from jid.JID, items []pubsubItem) {
+	// Notifications from our own account have no from address
+	if from.String() == "" {
+		from = c.LocalAddr().Bare()
+	}
+	for _, item := range items {
+		var list omemoDeviceList
+		if err := item.decode(&list); err != nil {
+			c.logger.Printf("Error decoding OMEMO devices of %s: %v", from, err)
+			continue
+		}
+		devices := make([]uint32, 0, len(list.Devices))
+		for _, d := range list.Devices {
+			devices = append(devices, d.ID)
+		}
+		c.omemo.mu.Lock()
+		c.omemo.setDeviceList(from, devices)
+		c.omemo.mu.Unlock()
+	}
+	if !from.Equal(c.LocalAddr().Bare()) {
+		return
+	}
+	// Requests can't be made from the handler, it has to read the response
+	go func() {
+		if err := c.announceDevice(context.Background()); err != nil {
+			c.logger.Printf("Error announcing OMEMO device: %v", err)
+		}
+	}()
+}
+
+// fetchBundle gets the public keys of a device and checks the signature of
+// its signed prekey.
+func (c *client) fetchBundle(ctx context.Context, owner jid.JID, id uint32) (omemoBundle, []byte, error) {
+	var b omemoBundle
+	items, err := c.fetchItems(ctx, owner.Bare(), nodeOMEMOBundles, strconv.FormatUint(uint64(id), 10))
+	if err != nil {
+		return b, nil, err
+	}
+	if len(items) == 0 {
+		return b, nil, errors.New("no keys published")
+	}
+	if err := items[0].decode(&b); err != nil {
+		return b, nil, err
+	}
+	identity, err := base64.StdEncoding.DecodeString(b.Identity)
+	if err != nil || len(identity) != ed25519.PublicKeySize {
+		return b, nil, errors.New("invalid identity key")
+	}
+	spk, err := base64.StdEncoding.DecodeString(b.SignedPreKey.Key)
+	if err != nil {
+		return b, nil, err
+	}
+	sig, err := base64.StdEncoding.DecodeString(b.Signature)
+	if err != nil {
+		return b, nil, err
+	}
+	if !ed25519.Verify(identity, spk, sig) {
+		return b, nil, errors.New("invalid signature on signed prekey")
+	}
+	return b, identity, nil
+}
+
+// startSession starts a session with a device from its published keys.
+func (c *client) startSession(ctx context.Context, owner jid.JID, id uint32) (*ratchet, error) {
+	b, identity, err := c.fetchBundle(ctx, owner, id)
+	if err != nil {
+		return nil, fmt.Errorf("fetching keys: %w", err)
+	}
+	if len(b.PreKeys) == 0 {
+		return nil, errors.New("no prekeys left")
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(len(b.PreKeys))))
+	if err != nil {
+		return nil, err
+	}
+	pk := b.PreKeys[n.Int64()]
+	pkKey, err := base64.StdEncoding.DecodeString(pk.Key)
+	if err != nil {
+		return nil, err
+	}
+	spk, err := base64.StdEncoding.DecodeString(b.SignedPreKey.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	c.omemo.mu.Lock()
+	isNew, err := c.omemo.learnIdentity(owner, id, identity)
+	c.omemo.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if isNew {
+		fmt.Printf("New OMEMO device %d of %s, fingerprint %s\n", id, owner.Bare(), omemoFingerprint(identity))
+	}
+	return startRatchet(c.omemo.identity(), identity, spk, b.SignedPreKey.ID, pkKey, pk.ID)
+}
+
+// encryptKey encrypts the key of a message for one device, starting a session
+// with it first if there isn't one yet.
+func (c *client) encryptKey(ctx context.Context, owner jid.JID, id uint32, keyMaterial []byte) (omemoKey, error) {
+	s := c.omemo
+	s.mu.Lock()
+	r := s.Sessions[deviceKey(owner, id)]
+	s.mu.Unlock()
+	if r == nil {
+		var err error
+		r, err = c.startSession(ctx, owner, id)
+		if err != nil {
+			return omemoKey{}, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Another send may have started a session while we fetched the keys, the
+	// device would get competing key exchanges if we replaced it
+	if existing := s.Sessions[deviceKey(owner, id)]; existing != nil {
+		r = existing
+	}
+	data, err := r.encrypt(keyMaterial)
+	if err != nil {
+		return omemoKey{}, err
+	}
+	key := omemoKey{RID: id, KEX: r.Pending != nil}
+	if key.KEX {
+		data = r.Pending.marshal(data)
+	}
+	key.Data = base64.StdEncoding.EncodeToString(data)
+	if s.Sessions == nil {
+		s.Sessions = make(map[string]*ratchet)
+	}
+	s.Sessions[deviceKey(owner, id)] = r
+	return key, s.save()
+}
+
+// encryptOMEMO encrypts body for the devices of to and our own other devices.
+func (c *client) encryptOMEMO(ctx context.Context, to jid.JID, body string) (*omemoEncrypted, error) {
+	// The bare JID of an occupant is the room, which has no devices
+	if c.isOccupant(to) {
+		return nil, errNoOMEMO
+	}
+	to = to.Bare()
+	own := c.LocalAddr().Bare()
+	theirs, err := c.deviceList(ctx, to)
+	if err != nil {
+		return nil, fmt.Errorf("fetching devices of %s: %w", to, err)
+	}
+	if len(theirs) == 0 {
+		return nil, errNoOMEMO
+	}
+	ours, err := c.deviceList(ctx, own)
+	if err != nil {
+		return nil, fmt.Errorf("fetching devices of %s: %w", own, err)
+	}
+
+	var envelope sceEnvelope
+	envelope.Content.Body = body
+	envelope.RPad = base64.StdEncoding.EncodeToString(randomBytes(int(binary.BigEndian.Uint16(randomBytes(2)) % 150)))
+	envelope.From.JID = own.String()
+	envelope.To.JID = to.String()
+	plaintext, err := xml.Marshal(envelope)
+	if err != nil {
+		return nil, err
+	}
+	keyMaterial, payload, err := sealPayload(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	enc := &omemoEncrypted{Payload: base64.StdEncoding.EncodeToString(payload)}
+	enc.Header.SID = c.omemo.DeviceID
+	for _, recipient := range []struct {
+		owner   jid.JID
+		devices []uint32
+	}{{to, theirs}, {own, ours}} {
+		keys := omemoKeys{JID: recipient.owner.String()}
+		for _, id := range c.omemo.trusted(recipient.owner, recipient.devices) {
+			if recipient.owner.Equal(own) && id == c.omemo.DeviceID {
+				continue
+			}
+			key, err := c.encryptKey(ctx, recipient.owner, id, keyMaterial)
+			if err != nil {
+				c.logger.Printf("Not encrypting for device %d of %s: %v", id, recipient.owner, err)
+				continue
+			}
+			keys.Keys = append(keys.Keys, key)
+		}
+		if len(keys.Keys) == 0 {
+			if recipient.owner.Equal(to) {
+				return nil, fmt.Errorf("none of the OMEMO devices of %s can be used", to)
+			}
+			continue
+		}
+		enc.Header.Keys = append(enc.Header.Keys, keys)
+	}
+	return enc, nil
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// decryptOMEMO decrypts a message from one of the devices of from and reports
+// whether that device is verified. Messages without a payload only set up the
+// session and have an empty body.
+func (c *client) decryptOMEMO(from jid.JID, enc *omemoEncrypted) (body string, verified bool, err error) {
+	s := c.omemo
+	from = from.Bare()
+	own := c.LocalAddr().Bare()
+
+	var key *omemoKey
+	for _, keys := range enc.Header.Keys {
+		if j, err := jid.Parse(keys.JID); err != nil || !j.Equal(own) {
+			continue
+		}
+		for i, k := range keys.Keys {
+			if k.RID == s.DeviceID {
+				key = &keys.Keys[i]
+			}
+		}
+	}
+	if key == nil {
+		return "", false, errors.New("the message isn't encrypted for this device")
+	}
+	data, err := base64.StdEncoding.DecodeString(key.Data)
+	if err != nil {
+		return "", false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sid := enc.Header.SID
+	r := s.Sessions[deviceKey(from, sid)]
+	var keyMaterial []byte
+	if key.KEX {
+		kex, msg, err := parseKeyExchange(data)
+		if err != nil {
+			return "", false, err
+		}
+		pk, ok := s.PreKeys[kex.PreKeyID]
+		switch {
+		case !ok && r != nil:
+			// The key exchange is repeated until we answer, the session we
+			// started with it is still good
+			keyMaterial, err = r.decrypt(msg)
+			if err != nil {
+				return "", false, err
+			}
+		case !ok:
+			return "", false, fmt.Errorf("unknown prekey %d", kex.PreKeyID)
+		case kex.SignedPreKeyID != s.SignedPreKey.ID:
+			return "", false, fmt.Errorf("unknown signed prekey %d", kex.SignedPreKeyID)
+		default:
+			r, err = acceptRatchet(s.identity(), s.SignedPreKey.Key, pk, kex)
+			if err != nil {
+				return "", false, err
+			}
+			keyMaterial, err = r.decrypt(msg)
+			if err != nil {
+				return "", false, err
+			}
+			// Only pin the identity once the message proved the sender has it
+			isNew, err := s.learnIdentity(from, sid, kex.Identity)
+			if err != nil {
+				return "", false, err
+			}
+			if isNew {
+				fmt.Printf("New OMEMO device %d of %s, fingerprint %s\n", sid, from, omemoFingerprint(kex.Identity))
+			}
+			// Each prekey is only used once, replace it and publish the new one
+			delete(s.PreKeys, kex.PreKeyID)
+			if err := s.generatePreKeys(); err != nil {
+				return "", false, err
+			}
+			go func() {
+				if err := c.publishBundle(context.Background()); err != nil {
+					c.logger.Printf("Error publishing OMEMO keys: %v", err)
+				}
+			}()
+		}
+	} else {
+		if r == nil {
+			return "", false, fmt.Errorf("no session with device %d of %s", sid, from)
+		}
+		keyMaterial, err = r.decrypt(data)
+		if err != nil {
+			return "", false, err
+		}
+	}
+	if s.Sessions == nil {
+		s.Sessions = make(map[string]*ratchet)
+	}
+	s.Sessions[deviceKey(from, sid)] = r
+	if err := s.save(); err != nil {
+		return "", false, err
+	}
+	if d, ok := s.Devices[deviceKey(from, sid)]; ok {
+		verified = d.Verified
+	}
+
+	if enc.Payload == "" {
+		return "", verified, nil
+	}
+	payload, err := base64.StdEncoding.DecodeString(enc.Payload)
+	if err != nil {
+		return "", false, err
+	}
+	plaintext, err := openPayload(keyMaterial, payload)
+	if err != nil {
+		return "", false, err
+	}
+	var envelope sceEnvelope
+	if err := xml.Unmarshal(plaintext, &envelope); err != nil {
+		return "", false, fmt.Errorf("decoding envelope: %w", err)
+	}
+	if sender, err := jid.Parse(envelope.From.JID); err != nil || !sender.Equal(from) {
+		return "", false, fmt.Errorf("message from %s claims to be from %q", from, envelope.From.JID)
+	}
+	return envelope.Content.Body, verified, nil
+}
+
+// printOMEMODevices shows the devices of owner, fetching the keys of any we
+// haven't seen yet so that they can be verified.
+func (c *client) printOMEMODevices(ctx context.Context, owner jid.JID) error {
+	devices, err := c.fetchDeviceList(ctx, owner)
+	if err != nil {
+		return err
+	}
+	c.omemo.mu.Lock()
+	c.omemo.setDeviceList(owner, devices)
+	c.omemo.mu.Unlock()
+	if len(devices) == 0 {
+		fmt.Printf("%s has no OMEMO devices\n", owner.Bare())
+		return nil
+	}
+
+	w := newBlock()
+	fmt.Fprintf(w, "OMEMO devices of %s:\n", owner.Bare())
+	fmt.Fprintln(w, "  DEVICE\tFINGERPRINT\tTRUST")
+	for _, id := range devices {
+		c.omemo.mu.Lock()
+		d, ok := c.omemo.Devices[deviceKey(owner, id)]
+		c.omemo.mu.Unlock()
+		if !ok {
+			_, identity, err := c.fetchBundle(ctx, owner, id)
+			if err != nil {
+				fmt.Fprintf(w, "  %d\t\t%s\n", id, explainError(err))
+				continue
+			}
+			c.omemo.mu.Lock()
+			_, err = c.omemo.learnIdentity(owner, id, identity)
+			d = c.omemo.Devices[deviceKey(owner, id)]
+			c.omemo.mu.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+		trust := "unverified"
+		switch {
+		case id == c.omemo.DeviceID && owner.Bare().Equal(c.LocalAddr().Bare()):
+			trust = "this device"
+		case d.Verified:
+			trust = "verified"
+		}
+		fmt.Fprintf(w, "  %d\t%s\t%s\n", id, omemoFingerprint(d.Identity), trust)
+	}
+	return w.Flush()
+}
+
+// trustDevice marks the device of owner with the given fingerprint as
+// verified.
+func (c *client) trustDevice(owner jid.JID, fp string) (uint32, error) {
+	want := strings.ToLower(strings.Join(strings.Fields(fp), ""))
+	s := c.omemo
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, d := range s.Devices {
+		j, id, _ := strings.Cut(key, "/")
+		if j != owner.Bare().String() || hex.EncodeToString(d.Identity) != want {
+			continue
+		}
+		d.Verified = true
+		n, _ := strconv.ParseUint(id, 10, 32)
+		return uint32(n), s.save()
+	}
+	return 0, fmt.Errorf("no device of %s with that fingerprint, use /trust %[1]s to list them", owner.Bare())
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"testing"
+
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// omemoSender is a device of Alice with a session with our device.
+type omemoSender struct {
+	id      uint32
+	from    jid.JID
+	session *ratchet
+}
+
+func newOMEMOSender(t *testing.T, bob *omemoStore) *omemoSender {
+	t.Helper()
+	_, identity, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spk, err := x25519Public(bob.SignedPreKey.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := x25519Public(bob.PreKeys[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := startRatchet(identity, bob.identity().Public().(ed25519.PublicKey), spk, bob.SignedPreKey.ID, pk, 1)
+	if err != nil {
+		t.Fatalf("starting session: %v", err)
+	}
+	return &omemoSender{id: 1234, from: jid.MustParse("alice@example.net"), session: r}
+}
+
+// encrypt returns an encrypted element for the device of to, with the SCE
+// envelope claiming to be from sender.
+func (s *omemoSender) encrypt(t *testing.T, to *omemoStore, sender, body string) *omemoEncrypted {
+	t.Helper()
+	var envelope sceEnvelope
+	envelope.Content.Body = body
+	envelope.From.JID = sender
+	envelope.To.JID = "bob@example.net"
+	plaintext, err := xml.Marshal(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyMaterial, payload, err := sealPayload(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := s.session.encrypt(keyMaterial)
+	if err != nil {
+		t.Fatalf("encrypting key: %v", err)
+	}
+	key := omemoKey{RID: to.DeviceID}
+	if s.session.Pending != nil {
+		key.KEX = true
+		data = s.session.Pending.marshal(data)
+	}
+	key.Data = base64.StdEncoding.EncodeToString(data)
+
+	enc := &omemoEncrypted{Payload: base64.StdEncoding.EncodeToString(payload)}
+	enc.Header.SID = s.id
+	enc.Header.Keys = []omemoKeys{{JID: "bob@example.net", Keys: []omemoKey{key}}}
+	return enc
+}
+
+func newOMEMOClient(t *testing.T) *client {
+	t.Helper()
+	s, err := openOMEMOStore(filepath.Join(t.TempDir(), "omemo", "bob@example.net.json"))
+	if err != nil {
+		t.Fatalf("creating store: %v", err)
+	}
+	return &client{
+		logger: log.New(io.Discard, "", 0),
+		addr:   jid.MustParse("bob@example.net/pda"),
+		omemo:  s,
+	}
+}
+
+func TestDecryptOMEMO(t *testing.T) {
+	c := newOMEMOClient(t)
+	alice := newOMEMOSender(t, c.omemo)
+
+	// Both messages carry the key exchange as Bob hasn't answered yet
+	for _, body := range []string{"hello", "still there?"} {
+		got, verified, err := c.decryptOMEMO(alice.from, alice.encrypt(t, c.omemo, "alice@example.net", body))
+		if err != nil {
+			t.Fatalf("decrypting %q: %v", body, err)
+		}
+		if got != body || verified {
+			t.Errorf("decrypted %q, verified %t, want %q from an unverified device", got, verified, body)
+		}
+	}
+
+	c.omemo.mu.Lock()
+	_, used := c.omemo.PreKeys[1]
+	n := len(c.omemo.PreKeys)
+	c.omemo.mu.Unlock()
+	if used || n != omemoPreKeys {
+		t.Errorf("prekey 1 kept is %t with %d prekeys, want it replaced by one of %d", used, n, omemoPreKeys)
+	}
+
+	// The session and the identity of the device are saved
+	s, err := openOMEMOStore(c.omemo.path)
+	if err != nil {
+		t.Fatalf("reopening store: %v", err)
+	}
+	if s.Sessions[deviceKey(alice.from, alice.id)] == nil {
+		t.Error("session wasn't saved")
+	}
+	if d := s.Devices[deviceKey(alice.from, alice.id)]; d == nil || !bytes.Equal(d.Identity, alice.session.Pending.Identity) {
+		t.Error("identity of the device wasn't saved")
+	}
+}
+
+func TestDecryptOMEMOForgedSender(t *testing.T) {
+	c := newOMEMOClient(t)
+	alice := newOMEMOSender(t, c.omemo)
+	enc := alice.encrypt(t, c.omemo, "mallory@example.net", "hello")
+	if _, _, err := c.decryptOMEMO(alice.from, enc); err == nil {
+		t.Error("decrypted a message whose envelope names another sender")
+	}
+}
+
+func TestDecryptOMEMOUnknownPreKey(t *testing.T) {
+	c := newOMEMOClient(t)
+	alice := newOMEMOSender(t, c.omemo)
+	alice.session.Pending.PreKeyID = omemoPreKeys + 1
+	if _, _, err := c.decryptOMEMO(alice.from, alice.encrypt(t, c.omemo, "alice@example.net", "hello")); err == nil {
+		t.Error("decrypted a key exchange with an unknown prekey")
+	}
+}
+
+func TestLearnIdentity(t *testing.T) {
+	c := newOMEMOClient(t)
+	s := c.omemo
+	owner := jid.MustParse("alice@example.net/phone")
+	identity := make([]byte, ed25519.PublicKeySize)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if isNew, err := s.learnIdentity(owner, 1, identity); err != nil || !isNew {
+		t.Fatalf("first sight of the device is new %t with error %v, want new", isNew, err)
+	}
+	if isNew, err := s.learnIdentity(owner.Bare(), 1, identity); err != nil || isNew {
+		t.Errorf("second sight of the device is new %t with error %v, want known", isNew, err)
+	}
+	changed := make([]byte, ed25519.PublicKeySize)
+	changed[0] = 1
+	if _, err := s.learnIdentity(owner, 1, changed); err == nil {
+		t.Error("accepted a changed identity key")
+	}
+}
+
+func TestOMEMOFingerprint(t *testing.T) {
+	identity := make([]byte, ed25519.PublicKeySize)
+	for i := range identity {
+		identity[i] = byte(i)
+	}
+	const want = "00010203 04050607 08090a0b 0c0d0e0f 10111213 14151617 18191a1b 1c1d1e1f"
+	if got := omemoFingerprint(identity); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestEncryptOMEMOWithoutDevices(t *testing.T) {
+	var fetched []string
+	c := newTestClient(t, func(iq stanza.IQ) string {
+		fetched = append(fetched, iq.To.String())
+		return fmt.Sprintf(`<iq xmlns="jabber:client" type="error" id=%q from=%q><error type="cancel"><service-unavailable xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></error></iq>`, iq.ID, iq.To)
+	})
+	c.omemo = newOMEMOClient(t).omemo
+
+	// A server without PEP refuses to give out the device list
+	if _, err := c.encryptOMEMO(context.Background(), jid.MustParse("romeo@example.net"), "hi"); !errors.Is(err, errNoOMEMO) {
+		t.Errorf("got error %v for a contact without PEP, want %v", err, errNoOMEMO)
+	}
+
+	// Occupants are only known by the room
+	fetched = nil
+	c.rooms = map[string]jid.JID{"room@conference.example.net": jid.MustParse("room@conference.example.net/juliet")}
+	if _, err := c.encryptOMEMO(context.Background(), jid.MustParse("room@conference.example.net/romeo"), "hi"); !errors.Is(err, errNoOMEMO) {
+		t.Errorf("got error %v for an occupant, want %v", err, errNoOMEMO)
+	}
+	if len(fetched) != 0 {
+		t.Errorf("fetched the devices of %v for an occupant", fetched)
+	}
+}
+
+func TestDecryptOMEMOForgedKeyExchange(t *testing.T) {
+	c := newOMEMOClient(t)
+	alice := newOMEMOSender(t, c.omemo)
+	enc := alice.encrypt(t, c.omemo, "alice@example.net", "hello")
+
+	// A key exchange naming a real prekey but with another identity and a
+	// message that doesn't authenticate
+	data, _ := base64.StdEncoding.DecodeString(enc.Header.Keys[0].Keys[0].Data)
+	kex, msg, err := parseKeyExchange(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := *enc
+	forged.Header.Keys = []omemoKeys{{JID: "bob@example.net", Keys: []omemoKey{{
+		RID: c.omemo.DeviceID,
+		KEX: true,
+		Data: base64.StdEncoding.EncodeToString(keyExchange{
+			PreKeyID:       kex.PreKeyID,
+			SignedPreKeyID: kex.SignedPreKeyID,
+			Identity:       c.omemo.identity().Public().(ed25519.PublicKey),
+			Ephemeral:      kex.Ephemeral,
+		}.marshal(msg)),
+	}}}}
+	if _, _, err := c.decryptOMEMO(alice.from, &forged); err == nil {
+		t.Fatal("decrypted a forged key exchange")
+	}
+	if d := c.omemo.Devices[deviceKey(alice.from, alice.id)]; d != nil {
+		t.Fatal("pinned the identity of a forged key exchange")
+	}
+
+	// The real device is still welcome
+	if _, _, err := c.decryptOMEMO(alice.from, enc); err != nil {
+		t.Errorf("decrypting after a forged key exchange: %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"mellium.im/xmpp/jid"
+)
+
+const (
+	downloadTimeout = 5 * time.Minute
+	// Downloads larger than this are abandoned
+	maxDownloadSize = 100 << 20
+)
+
+// XEP-0066 out of band data, usually a link to a shared file
+type oobData struct {
+	URL  string `xml:"url"`
+	Desc string `xml:"desc,omitempty"`
+}
+
+// printOOB shows the link shared in msg and starts downloading it if -download
+// is set and it comes from a contact. Delayed links aren't downloaded, rooms
+// replay their history on every join.
+func (c *client) printOOB(msg messageBody) {
+	oob := msg.OOB
+	// The message event already has the link
+	switch {
+	case c.events != nil:
+	case oob.Desc != "":
+		c.printf("[file] %s (%s)\n", oob.URL, oob.Desc)
+	default:
+		c.printf("[file] %s\n", oob.URL)
+	}
+	if c.downloadDir == "" || msg.Delay != nil {
+		return
+	}
+	if !c.isContact(msg.From) {
+		c.logger.Printf("Not downloading %s from %s, who is not in your roster", oob.URL, msg.From)
+		return
+	}
+	go func() {
+		name, err := c.download(oob.URL)
+		if err != nil {
+			c.logger.Printf("Error downloading %s: %v", oob.URL, err)
+			return
+		}
+		c.report(event{Type: "download", URL: oob.URL, File: name}, "Saved %s to %s\n", oob.URL, name)
+	}()
+}
+
+// download fetches rawURL into the download directory without overwriting any
+// existing files and returns the name of the new file.
+func (c *client) download(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), downloadTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	tooLarge := fmt.Errorf("file is larger than %d bytes", maxDownloadSize)
+	if resp.ContentLength > maxDownloadSize {
+		return "", tooLarge
+	}
+
+	f, err := createUnique(c.downloadDir, path.Base(u.Path))
+	if err != nil {
+		return "", err
+	}
+	n, err := io.Copy(f, io.LimitReader(resp.Body, maxDownloadSize+1))
+	if err == nil && n > maxDownloadSize {
+		err = tooLarge
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// isContact reports whether addr is in our roster, for occupants whether the
+// room told us their real JID and that is.
+func (c *client) isContact(addr jid.JID) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.rooms[addr.Bare().String()]; ok {
+		o := c.occupants[addr.Bare().String()][addr.Resourcepart()]
+		j, err := jid.Parse(o.JID)
+		if o.JID == "" || err != nil {
+			return false
+		}
+		addr = j
+	}
+	_, ok := c.roster[addr.Bare().String()]
+	return ok
+}
+
+// createUnique creates a new file called name in dir, adding a number before
+// the extension if the name is taken.
+func createUnique(dir, name string) (*os.File, error) {
+	// The name comes from the sender so make sure it stays inside dir
+	name = filepath.Base(filepath.Clean("/" + name))
+	if name == "/" || name == "." {
+		name = "download"
+	}
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for i := 0; ; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = stem + "-" + strconv.Itoa(i) + ext
+		}
+		f, err := os.OpenFile(filepath.Join(dir, candidate), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		return f, err
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"text/tabwriter"
+)
+
+// outputMu is held for every write to stdout that must not be split, so that
+// a message arriving from the server never ends up in the middle of a line or
+// a listing printed by a command.
+var outputMu sync.Mutex
+
+// printf prints a line in one write.
+func printf(format string, args ...interface{}) {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	fmt.Printf(format, args...)
+}
+
+// block collects output that takes many writes, like a table with aligned
+// columns, and prints it all at once on Flush.
+type block struct {
+	*tabwriter.Writer
+	buf bytes.Buffer
+}
+
+func newBlock() *block {
+	b := &block{}
+	b.Writer = tabwriter.NewWriter(&b.buf, 0, 4, 2, ' ', 0)
+	return b
+}
+
+func (b *block) Flush() error {
+	if err := b.Writer.Flush(); err != nil {
+		return err
+	}
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	_, err := os.Stdout.Write(b.buf.Bytes())
+	b.buf.Reset()
+	return err
+}
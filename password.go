@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// readPassword gets the password from the XMPP_PASSWORD environment variable or
+// stdin, turning off echo when stdin is a terminal.
+func readPassword() (string, error) {
+	if pass := os.Getenv("XMPP_PASSWORD"); pass != "" {
+		return pass, nil
+	}
+
+	return promptPassword("Password: ")
+}
+
+// promptPassword reads a password from stdin, showing prompt if stdin is a
+// terminal.
+func promptPassword(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return readLine(os.Stdin)
+	}
+
+	fmt.Print(prompt)
+	pass, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	return string(pass), nil
+}
+
+// readLine reads a single line one byte at a time so that nothing past the
+// newline is consumed from r.
+func readLine(r io.Reader) (string, error) {
+	var (
+		sb  strings.Builder
+		buf [1]byte
+	)
+	for {
+		_, err := r.Read(buf[:])
+		if err == io.EOF && sb.Len() > 0 {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if buf[0] == '\n' {
+			break
+		}
+		sb.WriteByte(buf[0])
+	}
+	return strings.TrimRight(sb.String(), "\r"), nil
+}
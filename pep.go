@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+const (
+	nsPubSub      = "http://jabber.org/protocol/pubsub"
+	nsPubSubEvent = "http://jabber.org/protocol/pubsub#event"
+)
+
+// Notification of items published to or retracted from a node
+type pubsubEvent struct {
+	Items struct {
+		Node    string       `xml:"node,attr"`
+		Items   []pubsubItem `xml:"item"`
+		Retract []struct {
+			ID string `xml:"id,attr"`
+		} `xml:"retract"`
+	} `xml:"items"`
+}
+
+// pubsubItem is a published item with its payload kept as tokens, since the
+// session decoder can't give us raw XML.
+type pubsubItem struct {
+	ID      string
+	payload []xml.Token
+}
+
+func (i *pubsubItem) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for _, attr := range start.Attr {
+		if attr.Name.Local == "id" {
+			i.ID = attr.Value
+		}
+	}
+	for depth := 1; ; {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch tok.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+		i.payload = append(i.payload, xml.CopyToken(tok))
+	}
+}
+
+// TokenReader returns the payload of the item.
+func (i pubsubItem) TokenReader() xml.TokenReader {
+	payload := i.payload
+	return xmlstream.ReaderFunc(func() (xml.Token, error) {
+		if len(payload) == 0 {
+			return nil, io.EOF
+		}
+		tok := payload[0]
+		payload = payload[1:]
+		return tok, nil
+	})
+}
+
+// decode unmarshals the payload of the item into v.
+func (i pubsubItem) decode(v interface{}) error {
+	return xml.NewTokenDecoder(i.TokenReader()).Decode(v)
+}
+
+// publish publishes item to node on our own XEP-0163 personal eventing
+// service.
+func (c *client) publish(ctx context.Context, node string, item xml.TokenReader) error {
+	return c.publishItem(ctx, node, "", item, nil)
+}
+
+// publishItem is like publish but with an item ID and publish options, such
+// as pubsub#access_model, that the node has to be configured with.
+func (c *client) publishItem(ctx context.Context, node, id string, item xml.TokenReader, options map[string]string) error {
+	start := xml.StartElement{Name: xml.Name{Local: "item"}}
+	if id != "" {
+		start.Attr = []xml.Attr{{Name: xml.Name{Local: "id"}, Value: id}}
+	}
+	payload := xmlstream.Wrap(
+		xmlstream.MultiReader(
+			xmlstream.Wrap(
+				xmlstream.Wrap(item, start),
+				xml.StartElement{
+					Name: xml.Name{Local: "publish"},
+					Attr: []xml.Attr{{Name: xml.Name{Local: "node"}, Value: node}},
+				},
+			),
+			publishOptions(options),
+		),
+		xml.StartElement{Name: xml.Name{Space: nsPubSub, Local: "pubsub"}},
+	)
+	return c.sendIQ(ctx, jid.JID{}, stanza.SetIQ, payload, nil)
+}
+
+// publishOptions returns the publish-options form for options, or nil if
+// there aren't any.
+func publishOptions(options map[string]string) xml.TokenReader {
+	if len(options) == 0 {
+		return nil
+	}
+	vars := make([]string, 0, len(options))
+	for v := range options {
+		vars = append(vars, v)
+	}
+	sort.Strings(vars)
+
+	field := func(v, value string, hidden bool) xml.TokenReader {
+		start := xml.StartElement{
+			Name: xml.Name{Local: "field"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "var"}, Value: v}},
+		}
+		if hidden {
+			start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "type"}, Value: "hidden"})
+		}
+		return xmlstream.Wrap(
+			xmlstream.Wrap(xmlstream.Token(xml.CharData(value)), xml.StartElement{Name: xml.Name{Local: "value"}}),
+			start,
+		)
+	}
+	fields := []xml.TokenReader{field("FORM_TYPE", nsPubSub+"#publish-options", true)}
+	for _, v := range vars {
+		fields = append(fields, field(v, options[v], false))
+	}
+	return xmlstream.Wrap(
+		xmlstream.Wrap(
+			xmlstream.MultiReader(fields...),
+			xml.StartElement{
+				Name: xml.Name{Space: "jabber:x:data", Local: "x"},
+				Attr: []xml.Attr{{Name: xml.Name{Local: "type"}, Value: "submit"}},
+			},
+		),
+		xml.StartElement{Name: xml.Name{Local: "publish-options"}},
+	)
+}
+
+// fetchItems gets the item with the given ID from node of the personal
+// eventing service of to, or the latest item if id is empty.
+func (c *client) fetchItems(ctx context.Context, to jid.JID, node, id string) ([]pubsubItem, error) {
+	items := xml.StartElement{
+		Name: xml.Name{Local: "items"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "node"}, Value: node}},
+	}
+	var inner xml.TokenReader
+	if id != "" {
+		inner = xmlstream.Wrap(nil, xml.StartElement{
+			Name: xml.Name{Local: "item"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "id"}, Value: id}},
+		})
+	} else {
+		items.Attr = append(items.Attr, xml.Attr{Name: xml.Name{Local: "max_items"}, Value: "1"})
+	}
+	payload := xmlstream.Wrap(
+		xmlstream.Wrap(inner, items),
+		xml.StartElement{Name: xml.Name{Space: nsPubSub, Local: "pubsub"}},
+	)
+
+	var resp struct {
+		Items []pubsubItem `xml:"items>item"`
+	}
+	err := c.sendIQ(ctx, to, stanza.GetIQ, payload, &resp)
+	return resp.Items, err
+}
+
+// subscribe subscribes us to node on the personal eventing service of to, or
+// our own if to is empty, and reports whether the owner still has to approve
+// the subscription.
+func (c *client) subscribe(ctx context.Context, to jid.JID, node string) (pending bool, err error) {
+	payload := xmlstream.Wrap(
+		xmlstream.Wrap(nil, xml.StartElement{
+			Name: xml.Name{Local: "subscribe"},
+			Attr: []xml.Attr{
+				{Name: xml.Name{Local: "node"}, Value: node},
+				{Name: xml.Name{Local: "jid"}, Value: c.LocalAddr().Bare().String()},
+			},
+		}),
+		xml.StartElement{Name: xml.Name{Space: nsPubSub, Local: "pubsub"}},
+	)
+	var resp struct {
+		Subscription struct {
+			State string `xml:"subscription,attr"`
+		} `xml:"subscription"`
+	}
+	err = c.sendIQ(ctx, to, stanza.SetIQ, payload, &resp)
+	return resp.Subscription.State == "pending", err
+}
+
+// parsePayload turns the argument of /publish into the payload of an item.
+// XML is published as it is, anything else as the text of a <text/> element
+// in the namespace of the node.
+func parsePayload(node, data string) (xml.TokenReader, error) {
+	if !strings.HasPrefix(data, "<") {
+		return xmlstream.Wrap(
+			xmlstream.Token(xml.CharData(data)),
+			xml.StartElement{Name: xml.Name{Space: node, Local: "text"}},
+		), nil
+	}
+
+	var item pubsubItem
+	d := xml.NewDecoder(strings.NewReader(data))
+	depth, roots := 0, 0
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch tok.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				roots++
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			if depth == 0 {
+				continue
+			}
+		case xml.ProcInst, xml.Directive:
+			return nil, errors.New("payload must be a single element")
+		}
+		item.payload = append(item.payload, xml.CopyToken(tok))
+	}
+	if roots != 1 {
+		return nil, errors.New("payload must be a single element")
+	}
+	return item.TokenReader(), nil
+}
+
+// formatXML encodes tokens for display, leaving out namespace declarations
+// that are already in scope.
+func formatXML(r xml.TokenReader) (string, error) {
+	var buf strings.Builder
+	e := xml.NewEncoder(&buf)
+	type open struct {
+		space string
+		name  xml.Name
+	}
+	var stack []open
+	for {
+		tok, err := r.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			// The encoder adds declarations for the element namespaces itself
+			var attrs []xml.Attr
+			for _, attr := range t.Attr {
+				if attr.Name.Space == "xmlns" || (attr.Name.Space == "" && attr.Name.Local == "xmlns") {
+					continue
+				}
+				attrs = append(attrs, attr)
+			}
+			t.Attr = attrs
+			space := t.Name.Space
+			if len(stack) > 0 && stack[len(stack)-1].space == space {
+				t.Name.Space = ""
+			}
+			stack = append(stack, open{space: space, name: t.Name})
+			tok = t
+		case xml.EndElement:
+			if len(stack) == 0 {
+				return "", fmt.Errorf("unexpected end element %s", t.Name.Local)
+			}
+			t.Name = stack[len(stack)-1].name
+			stack = stack[:len(stack)-1]
+			tok = t
+		}
+		err = e.EncodeToken(tok)
+		if err != nil {
+			return "", err
+		}
+	}
+	err := e.Flush()
+	return buf.String(), err
+}
+
+// handlePubSubEvent prints items published to nodes we're subscribed to.
+func (c *client) handlePubSubEvent(msg messageBody) {
+	from := msg.From.Bare()
+	node := msg.Event.Items.Node
+	if node == nodeOMEMODevices && c.omemo != nil {
+		c.handleDeviceList(from, msg.Event.Items.Items)
+		return
+	}
+	for _, item := range msg.Event.Items.Items {
+		payload, err := formatXML(item.TokenReader())
+		if err != nil {
+			c.logger.Printf("Error formatting item from %s: %v", from, err)
+			continue
+		}
+		c.report(event{Type: "pep", From: from.String(), ID: item.ID, Node: node, Body: payload},
+			"[pep] %s published to %s: %s\n", from, node, payload)
+	}
+	for _, retracted := range msg.Event.Items.Retract {
+		c.report(event{Type: "retract", From: from.String(), ID: retracted.ID, Node: node},
+			"[pep] %s retracted %s from %s\n", from, retracted.ID, node)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"mellium.im/xmpp/jid"
+)
+
+const (
+	nsOpenPGP     = "urn:xmpp:openpgp:0"
+	pgpFallback   = "This message is encrypted with OpenPGP, which your client doesn't support."
+	gpgStatusLine = "[GNUPG:] "
+)
+
+// errNoPGPKey means that there is no OpenPGP key for a contact in the keyring.
+var errNoPGPKey = errors.New("no OpenPGP key")
+
+// XEP-0373 encrypted message element, base64 of a binary OpenPGP message
+type openpgpElement struct {
+	Data string `xml:",chardata"`
+}
+
+// XEP-0373 signcrypt element, what actually gets signed and encrypted
+type signcrypt struct {
+	XMLName xml.Name `xml:"urn:xmpp:openpgp:0 signcrypt"`
+	To      struct {
+		JID string `xml:"jid,attr"`
+	} `xml:"to"`
+	Time struct {
+		Stamp string `xml:"stamp,attr"`
+	} `xml:"time"`
+	// Random padding to hide the length of the body
+	RPad    string `xml:"rpad"`
+	Payload struct {
+		Body string `xml:"jabber:client body"`
+	} `xml:"payload"`
+}
+
+// openPGP signs and encrypts messages by running gpg, see -pgp.
+type openPGP struct {
+	// Key that messages are signed with and also encrypted to, so that we can
+	// read our own messages from carbons and the archive
+	keyID string
+	// Extra keyring with the keys of contacts, used along with the default one
+	keyring string
+}
+
+// newOpenPGP checks that gpg has a secret key for keyID.
+func newOpenPGP(keyID, keyring string) (*openPGP, error) {
+	p := &openPGP{keyID: keyID}
+	if keyring != "" {
+		// gpg looks for relative keyring paths in its home directory
+		abs, err := filepath.Abs(keyring)
+		if err != nil {
+			return nil, err
+		}
+		p.keyring = abs
+	}
+	out, _, err := p.gpg(nil, "--with-colons", "--list-secret-keys", keyID)
+	if err != nil {
+		return nil, fmt.Errorf("looking up secret key %s: %w", keyID, err)
+	}
+	fingerprints := colonFingerprints(out)
+	if len(fingerprints) != 1 {
+		return nil, fmt.Errorf("%q matches %d secret keys", keyID, len(fingerprints))
+	}
+	p.keyID = fingerprints[0]
+	return p, nil
+}
+
+// gpg runs gpg with args and stdin, returning what it wrote to stdout and the
+// status lines it wrote to stderr.
+func (p *openPGP) gpg(stdin []byte, args ...string) ([]byte, []string, error) {
+	base := []string{"--batch", "--no-tty", "--status-fd", "2"}
+	if p.keyring != "" {
+		base = append(base, "--keyring", p.keyring)
+	}
+	cmd := exec.Command("gpg", append(base, args...)...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	var status, messages []string
+	scanner := bufio.NewScanner(&stderr)
+	for scanner.Scan() {
+		if line, ok := strings.CutPrefix(scanner.Text(), gpgStatusLine); ok {
+			status = append(status, line)
+		} else if line := strings.TrimSpace(scanner.Text()); line != "" {
+			messages = append(messages, line)
+		}
+	}
+	if err != nil && len(messages) > 0 {
+		err = fmt.Errorf("%w: %s", err, strings.Join(messages, "; "))
+	}
+	return stdout.Bytes(), status, err
+}
+
+// lookup returns the fingerprints of the usable keys with an xmpp: user ID for
+// the bare JID of addr, as XEP-0373 asks for.
+func (p *openPGP) lookup(addr jid.JID) ([]string, error) {
+	out, _, err := p.gpg(nil, "--with-colons", "--list-keys", "=xmpp:"+addr.Bare().String())
+	if err != nil {
+		// gpg fails when nothing matches
+		return nil, errNoPGPKey
+	}
+	fingerprints := colonFingerprints(out)
+	if len(fingerprints) == 0 {
+		return nil, errNoPGPKey
+	}
+	return fingerprints, nil
+}
+
+// colonFingerprints picks the fingerprints of primary keys that aren't
+// revoked, expired or disabled out of gpg --with-colons output.
+func colonFingerprints(out []byte) []string {
+	var fingerprints []string
+	usable := false
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, ":")
+		switch fields[0] {
+		case "pub", "sec":
+			usable = len(fields) > 11 && !strings.ContainsAny(fields[1], "rend") && !strings.Contains(fields[11], "D")
+		case "fpr":
+			if usable && len(fields) > 9 {
+				fingerprints = append(fingerprints, fields[9])
+			}
+			// Only the first fingerprint after a key is the primary one
+			usable = false
+		}
+	}
+	return fingerprints
+}
+
+// encrypt signs and encrypts body for to and ourselves.
+func (p *openPGP) encrypt(to jid.JID, body string) (*openpgpElement, error) {
+	recipients, err := p.lookup(to)
+	if err != nil {
+		return nil, err
+	}
+
+	var sc signcrypt
+	sc.To.JID = to.Bare().String()
+	sc.Time.Stamp = time.Now().UTC().Format(time.RFC3339)
+	sc.RPad = base64.StdEncoding.EncodeToString(randomBytes(int(binary.BigEndian.Uint16(randomBytes(2)) % 150)))
+	sc.Payload.Body = body
+	plaintext, err := xml.Marshal(sc)
+	if err != nil {
+		return nil, err
+	}
+
+	// The key was looked up by its xmpp: user ID, so don't ask gpg to trust it
+	args := []string{"--trust-model", "always", "--local-user", p.keyID, "--recipient", p.keyID}
+	for _, fingerprint := range recipients {
+		args = append(args, "--recipient", fingerprint)
+	}
+	args = append(args, "--sign", "--encrypt")
+	out, _, err := p.gpg(plaintext, args...)
+	if err != nil {
+		return nil, fmt.Errorf("running gpg: %w", err)
+	}
+	return &openpgpElement{Data: base64.StdEncoding.EncodeToString(out)}, nil
+}
+
+// decrypt returns the body of a message from from to to and whether it was
+// signed by a key of from that gpg trusts. Our own messages from carbons and
+// the archive are meant for whoever they were sent to, others for own.
+func (p *openPGP) decrypt(from, to, own jid.JID, enc *openpgpElement) (string, bool, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(enc.Data))
+	if err != nil {
+		return "", false, err
+	}
+	plaintext, status, err := p.gpg(data, "--decrypt")
+	if err != nil {
+		return "", false, fmt.Errorf("running gpg: %w", err)
+	}
+
+	var signer string
+	trusted := false
+	for _, line := range status {
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "BADSIG":
+			return "", false, errors.New("bad signature")
+		case "VALIDSIG":
+			// The last field is the fingerprint of the primary key
+			signer = fields[len(fields)-1]
+		case "TRUST_FULLY", "TRUST_ULTIMATE":
+			trusted = true
+		}
+	}
+
+	var sc signcrypt
+	if err := xml.Unmarshal(plaintext, &sc); err != nil {
+		return "", false, fmt.Errorf("decoding signcrypt: %w", err)
+	}
+	recipient := own.Bare()
+	if from.Bare().Equal(own.Bare()) {
+		recipient = to.Bare()
+	}
+	if to, err := jid.Parse(sc.To.JID); err != nil || !to.Equal(recipient) {
+		return "", false, fmt.Errorf("message from %s was meant for %q", from, sc.To.JID)
+	}
+
+	// Anyone can sign a message, it has to be a key of the sender to count
+	verified := false
+	if signer != "" && trusted {
+		fingerprints, _ := p.lookup(from)
+		for _, fingerprint := range fingerprints {
+			verified = verified || fingerprint == signer
+		}
+	}
+	return sc.Payload.Body, verified, nil
+}
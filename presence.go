@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+type presenceBody struct {
+	stanza.Presence
+	Show   string `xml:"show,omitempty"`
+	Status string `xml:"status,omitempty"`
+	// XEP-0172 nickname, sent with subscription requests
+	Nick string `xml:"http://jabber.org/protocol/nick nick,omitempty"`
+	// XEP-0045 role and affiliation of room occupants
+	MUC *mucUser `xml:"http://jabber.org/protocol/muc#user x,omitempty"`
+	// XEP-0115 entity capabilities of the device
+	Caps *capsElement `xml:"http://jabber.org/protocol/caps c,omitempty"`
+}
+
+// contactPresence is the last availability we've seen from a contact.
+type contactPresence struct {
+	Online bool
+	Show   string
+	Status string
+}
+
+func (p contactPresence) String() string {
+	if p.Status != "" {
+		return fmt.Sprintf("%s (%s)", p.state(), p.Status)
+	}
+	return p.state()
+}
+
+// state is offline, available or the show value.
+func (p contactPresence) state() string {
+	if !p.Online {
+		return "offline"
+	}
+	if p.Show != "" {
+		return p.Show
+	}
+	return "available"
+}
+
+func (c *client) handlePresence(t xmlstream.TokenReadEncoder, d *xml.Decoder) error {
+	p := presenceBody{}
+	err := d.Decode(&p)
+	if err != nil && err != io.EOF {
+		c.logger.Printf("Error decoding presence: %v", err)
+		return nil
+	}
+
+	if p.Type == stanza.AvailablePresence || p.Type == stanza.UnavailablePresence {
+		c.recordCaps(p)
+	}
+
+	if p.MUC != nil && p.Type != stanza.ErrorPresence {
+		c.handleOccupantPresence(p)
+		return nil
+	}
+
+	from := p.From.Bare()
+	switch p.Type {
+	case stanza.AvailablePresence, stanza.UnavailablePresence:
+		c.updatePresence(from, contactPresence{
+			Online: p.Type == stanza.AvailablePresence,
+			Show:   p.Show,
+			Status: p.Status,
+		})
+	case stanza.SubscribePresence:
+		c.mu.Lock()
+		if c.subscriptionRequests == nil {
+			c.subscriptionRequests = make(map[string]jid.JID)
+		}
+		c.subscriptionRequests[from.String()] = from
+		c.mu.Unlock()
+		c.report(subscriptionEvent(p),
+			"%s wants to subscribe to your presence, use /accept %[1]s or /deny %[1]s\n", from)
+	case stanza.SubscribedPresence:
+		c.report(subscriptionEvent(p),
+			"%s accepted your subscription request\n", from)
+	case stanza.UnsubscribePresence:
+		c.report(subscriptionEvent(p),
+			"%s unsubscribed from your presence\n", from)
+	case stanza.UnsubscribedPresence:
+		c.report(subscriptionEvent(p),
+			"%s denied or cancelled your subscription\n", from)
+	}
+	return nil
+}
+
+func subscriptionEvent(p presenceBody) event {
+	return event{Type: "subscription", From: p.From.Bare().String(), Subscription: string(p.Type)}
+}
+
+// updatePresence records the presence of a contact and reports it if it
+// changed.
+func (c *client) updatePresence(from jid.JID, p contactPresence) {
+	// Presence from our own account has its from address stripped by the
+	// session
+	if from.String() == "" || from.Equal(c.LocalAddr().Bare()) {
+		return
+	}
+
+	c.mu.Lock()
+	// Occupant presence from rooms we've joined isn't contact presence
+	if _, ok := c.rooms[from.String()]; ok {
+		c.mu.Unlock()
+		return
+	}
+	if c.contacts == nil {
+		c.contacts = make(map[string]contactPresence)
+	}
+	old, seen := c.contacts[from.String()]
+	c.contacts[from.String()] = p
+	c.mu.Unlock()
+
+	if old == p || (!seen && !p.Online) {
+		return
+	}
+	c.report(event{Type: "presence", From: from.String(), Presence: p.state(), Status: p.Status},
+		"%s is now %s\n", from, p)
+}
+
+func (c *client) printContacts() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.contacts) == 0 {
+		fmt.Println("No presence received from any contacts yet")
+		return
+	}
+
+	names := make([]string, 0, len(c.contacts))
+	for name := range c.contacts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w := newBlock()
+	fmt.Fprintln(w, "JID\tPRESENCE")
+	for _, name := range names {
+		fmt.Fprintf(w, "%s\t%s\n", name, c.contacts[name])
+	}
+	w.Flush()
+}
+
+// ownPresence returns a broadcast presence with our current show and status.
+func (c *client) ownPresence() xml.TokenReader {
+	c.mu.Lock()
+	show, status := c.show, c.status
+	c.mu.Unlock()
+
+	payload := []xml.TokenReader{ownCaps().TokenReader()}
+	if show != "" {
+		payload = append(payload, xmlstream.Wrap(
+			xmlstream.Token(xml.CharData(show)),
+			xml.StartElement{Name: xml.Name{Local: "show"}},
+		))
+	}
+	if status != "" {
+		payload = append(payload, xmlstream.Wrap(
+			xmlstream.Token(xml.CharData(status)),
+			xml.StartElement{Name: xml.Name{Local: "status"}},
+		))
+	}
+	return stanza.Presence{
+		ID:   newID(),
+		Type: stanza.AvailablePresence,
+	}.Wrap(xmlstream.MultiReader(payload...))
+}
+
+// setPresence changes our availability. An empty show means available.
+func (c *client) setPresence(ctx context.Context, show, status string) error {
+	c.mu.Lock()
+	c.show, c.status = show, status
+	c.mu.Unlock()
+	return c.Send(ctx, c.ownPresence())
+}
+
+// sendSubscription sends a presence subscription stanza of type typ to j.
+func (c *client) sendSubscription(ctx context.Context, j jid.JID, typ stanza.PresenceType) error {
+	p := presenceBody{
+		Presence: stanza.Presence{
+			ID:   newID(),
+			To:   j.Bare(),
+			From: c.LocalAddr(),
+			Type: typ,
+		},
+	}
+	if typ == stanza.SubscribePresence {
+		p.Nick = c.Nick()
+	}
+	return c.Encode(ctx, p)
+}
+
+// answerSubscription accepts or denies a pending subscription request. If j
+// is the zero JID and there is only one pending request it is answered.
+func (c *client) answerSubscription(ctx context.Context, j jid.JID, accept bool) (jid.JID, error) {
+	c.mu.Lock()
+	if j.Equal(jid.JID{}) {
+		if len(c.subscriptionRequests) != 1 {
+			n := len(c.subscriptionRequests)
+			c.mu.Unlock()
+			return j, fmt.Errorf("%d pending subscription requests, specify a JID", n)
+		}
+		for _, pending := range c.subscriptionRequests {
+			j = pending
+		}
+	}
+	delete(c.subscriptionRequests, j.Bare().String())
+	c.mu.Unlock()
+
+	typ := stanza.UnsubscribedPresence
+	if accept {
+		typ = stanza.SubscribedPresence
+	}
+	return j, c.sendSubscription(ctx, j, typ)
+}
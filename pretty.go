@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+)
+
+const (
+	colorSent  = "\x1b[32m"
+	colorRecv  = "\x1b[36m"
+	colorReset = "\x1b[0m"
+)
+
+// prettyWriter is like logWriter but puts every element on its own line,
+// indented by depth, and optionally wraps the output in an ANSI color. The
+// depth is kept between writes since the stream element stays open for the
+// whole session.
+type prettyWriter struct {
+	logger *log.Logger
+	color  string
+
+	mu    sync.Mutex
+	depth int
+	// The last thing written was a start element, so character data and the
+	// matching end element stay on the same line
+	open bool
+}
+
+func (w *prettyWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	out := w.indent(string(p))
+	w.mu.Unlock()
+
+	if out == "" {
+		return len(p), nil
+	}
+	if w.color != "" {
+		out = w.color + out + colorReset
+	}
+	w.logger.Printf("\n%s", out)
+	return len(p), nil
+}
+
+func (w *prettyWriter) indent(s string) string {
+	var b strings.Builder
+	newline := func() {
+		if b.Len() > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(strings.Repeat("  ", max(w.depth, 0)))
+	}
+
+	for s != "" {
+		i := strings.IndexByte(s, '<')
+		if i != 0 {
+			text := s
+			if i > 0 {
+				text = s[:i]
+			}
+			if text = strings.TrimSpace(text); text != "" {
+				if !w.open {
+					newline()
+				}
+				b.WriteString(text)
+			}
+			if i < 0 {
+				break
+			}
+			s = s[i:]
+		}
+
+		// Tags split across writes are printed as is
+		j := strings.IndexByte(s, '>')
+		if j < 0 {
+			newline()
+			b.WriteString(s)
+			break
+		}
+		tag := s[:j+1]
+		s = s[j+1:]
+
+		switch {
+		case strings.HasPrefix(tag, "</"):
+			w.depth--
+			if !w.open {
+				newline()
+			}
+			b.WriteString(tag)
+			w.open = false
+		case strings.HasPrefix(tag, "<?"):
+			// A new XML declaration means the stream was restarted
+			w.depth = 0
+			newline()
+			b.WriteString(tag)
+			w.open = false
+		case strings.HasSuffix(tag, "/>"):
+			newline()
+			b.WriteString(tag)
+			w.open = false
+		default:
+			newline()
+			b.WriteString(tag)
+			w.depth++
+			w.open = true
+		}
+	}
+	return b.String()
+}
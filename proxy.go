@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// contextDialer opens connections, directly or through a proxy.
+type contextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// proxyDialer connects through the proxy given with -proxy.
+type proxyDialer struct {
+	contextDialer
+	// The proxy resolves host names, so we don't look anything up ourselves,
+	// not even SRV records
+	remoteDNS bool
+}
+
+// newProxyDialer supports socks5://, socks5h:// and http:// proxy URLs. With
+// socks5h:// no DNS lookups are made locally, which Tor users want.
+func newProxyDialer(rawURL string) (*proxyDialer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	var d contextDialer
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		pd, err := proxy.FromURL(u, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		d = pd.(proxy.ContextDialer)
+	case "http":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "8080")
+		}
+		d = httpProxy{u: u}
+	default:
+		return nil, fmt.Errorf("unsupported proxy URL scheme %q, expected socks5, socks5h or http", u.Scheme)
+	}
+	return &proxyDialer{contextDialer: d, remoteDNS: u.Scheme == "socks5h"}, nil
+}
+
+// resolvesRemotely is whether d is a proxy that looks up host names itself.
+func resolvesRemotely(d contextDialer) bool {
+	p, ok := d.(*proxyDialer)
+	return ok && p.remoteDNS
+}
+
+// httpProxy tunnels connections through an HTTP proxy with CONNECT.
+type httpProxy struct {
+	u *url.URL
+}
+
+func (p httpProxy) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.u.Host)
+	if err != nil {
+		return nil, err
+	}
+	// Don't wait on a proxy that never answers longer than on the server
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if user := p.u.User; user != nil {
+		password, _ := user.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused to connect to %s: %s", address, resp.Status)
+	}
+	// XMPP clients speak first, so the proxy shouldn't have sent anything else
+	if br.Buffered() > 0 {
+		conn.Close()
+		return nil, fmt.Errorf("proxy sent data before %s did", address)
+	}
+	return conn, nil
+}
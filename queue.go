@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"mellium.im/xmpp/stanza"
+)
+
+// Messages typed while disconnected beyond this many are refused
+const maxQueued = 100
+
+var errQueueFull = errors.New("too many messages waiting for the connection")
+
+// sendMessage encrypts and sends msg, or queues it to be sent once we are
+// connected again. Messages are queued while older ones are still waiting so
+// that they arrive in the order they were typed.
+func (c *client) sendMessage(ctx context.Context, msg messageBody) (queued bool, err error) {
+	if c.dryRun == nil {
+		c.mu.Lock()
+		if c.session == nil || len(c.outbox) > 0 {
+			defer c.mu.Unlock()
+			if len(c.outbox) >= maxQueued {
+				return false, errQueueFull
+			}
+			c.outbox = append(c.outbox, msg)
+			return true, nil
+		}
+		c.mu.Unlock()
+	}
+
+	err = c.encodeMessage(ctx, msg)
+	if !errors.Is(err, errDisconnected) {
+		return false, err
+	}
+	// The connection dropped since we checked
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.outbox) >= maxQueued {
+		return false, errQueueFull
+	}
+	c.outbox = append(c.outbox, msg)
+	return true, nil
+}
+
+// encodeMessage writes msg to the session, encrypting chat messages first.
+func (c *client) encodeMessage(ctx context.Context, msg messageBody) error {
+	if msg.Type == stanza.ChatMessage {
+		if err := c.encryptBody(ctx, &msg); err != nil {
+			return err
+		}
+	}
+	return c.Encode(ctx, msg)
+}
+
+// flushQueue sends the messages that were queued while we were disconnected
+// until the queue is empty or the connection drops again.
+func (c *client) flushQueue(ctx context.Context) {
+	for {
+		c.mu.Lock()
+		if len(c.outbox) == 0 {
+			c.mu.Unlock()
+			return
+		}
+		msg := c.outbox[0]
+		c.mu.Unlock()
+
+		err := c.encodeMessage(ctx, msg)
+		if errors.Is(err, errDisconnected) || ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			c.logger.Printf("Error sending queued message to %s: %v", msg.To, err)
+			c.receipts.done(msg.ID)
+			c.markers.done(msg.ID)
+		}
+
+		c.mu.Lock()
+		c.outbox = c.outbox[1:]
+		c.mu.Unlock()
+	}
+}
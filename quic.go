@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"mellium.im/xmpp/jid"
+)
+
+const quicPort = "5222"
+
+// quicConn wraps a single bidirectional QUIC stream so that it can be used as
+// the net.Conn backing an XMPP session.
+type quicConn struct {
+	quic.Connection
+	quic.Stream
+}
+
+func (c quicConn) Close() error {
+	c.Stream.Close()
+	return c.Connection.CloseWithError(0, "")
+}
+
+func (c quicConn) SetDeadline(t time.Time) error {
+	return c.Stream.SetDeadline(t)
+}
+
+func (c quicConn) SetReadDeadline(t time.Time) error {
+	return c.Stream.SetReadDeadline(t)
+}
+
+func (c quicConn) SetWriteDeadline(t time.Time) error {
+	return c.Stream.SetWriteDeadline(t)
+}
+
+func (c quicConn) LocalAddr() net.Addr {
+	return c.Connection.LocalAddr()
+}
+
+func (c quicConn) RemoteAddr() net.Addr {
+	return c.Connection.RemoteAddr()
+}
+
+// ConnectionState lets the session pick up the TLS state of the QUIC
+// handshake for channel binding.
+func (c quicConn) ConnectionState() tls.ConnectionState {
+	return c.Connection.ConnectionState().TLS
+}
+
+// dialQUIC connects to hostport, or the JID's domain when hostport is empty.
+// QUIC requires TLS 1.3, so the minimum version of tlsConfig is raised.
+func dialQUIC(ctx context.Context, hostport string, addr jid.JID, tlsConfig *tls.Config) (net.Conn, error) {
+	if hostport == "" {
+		hostport = net.JoinHostPort(addr.Domainpart(), quicPort)
+	}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.MinVersion = tls.VersionTLS13
+	tlsConfig.NextProtos = []string{"xmpp-client"}
+	conn, err := quic.DialAddr(ctx, hostport, tlsConfig, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, err
+	}
+
+	return quicConn{Connection: conn, Stream: stream}, nil
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// The cryptography of XEP-0384 OMEMO 2: X3DH to agree on a secret with a
+// device and the Double Ratchet to encrypt the key of each message with it.
+
+// Messages we're allowed to skip in one chain, older keys are kept until the
+// skipped messages arrive
+const maxSkip = 1000
+
+var (
+	errMACMismatch = errors.New("message authentication failed")
+	errBadPadding  = errors.New("invalid padding")
+)
+
+// ratchet is a Double Ratchet session with one device of a contact.
+type ratchet struct {
+	RootKey  []byte
+	SendKey  []byte
+	RecvKey  []byte
+	SendPriv []byte
+	RecvPub  []byte
+	SendN    uint32
+	RecvN    uint32
+	PrevN    uint32
+	// Keys of skipped messages, by ratchet key and message number
+	Skipped map[string][]byte
+	// Identity keys of the initiator and the responder
+	AD []byte
+	// Set while we started the session and haven't heard back, every message
+	// has to carry the key exchange until then
+	Pending *keyExchange
+}
+
+// keyExchange is the OMEMOKeyExchange that starts a session.
+type keyExchange struct {
+	PreKeyID       uint32
+	SignedPreKeyID uint32
+	Identity       []byte
+	Ephemeral      []byte
+}
+
+// omemoMessage is the OMEMOMessage header with the encrypted key material.
+type omemoMessage struct {
+	N          uint32
+	PN         uint32
+	DH         []byte
+	Ciphertext []byte
+}
+
+func newX25519() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+func x25519Public(priv []byte) ([]byte, error) {
+	k, err := ecdh.X25519().NewPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	return k.PublicKey().Bytes(), nil
+}
+
+func dh(priv, pub []byte) ([]byte, error) {
+	k, err := ecdh.X25519().NewPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	p, err := ecdh.X25519().NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return k.ECDH(p)
+}
+
+// 2^255 - 19
+var curve25519P = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// montgomeryPublic converts an Ed25519 identity key to the X25519 key used in
+// the key agreement, u = (1 + y) / (1 - y).
+func montgomeryPublic(pub []byte) ([]byte, error) {
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid identity key")
+	}
+	// Little endian y with the sign of x in the top bit
+	be := make([]byte, len(pub))
+	for i, b := range pub {
+		be[len(pub)-1-i] = b
+	}
+	be[0] &= 0x7f
+	y := new(big.Int).SetBytes(be)
+
+	one := big.NewInt(1)
+	den := new(big.Int).Sub(one, y)
+	den.Mod(den, curve25519P)
+	if den.ModInverse(den, curve25519P) == nil {
+		return nil, errors.New("invalid identity key")
+	}
+	u := new(big.Int).Add(one, y)
+	u.Mul(u, den).Mod(u, curve25519P)
+
+	out := make([]byte, 32)
+	u.FillBytes(out)
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out, nil
+}
+
+// montgomeryPrivate converts an Ed25519 identity key to X25519, the scalar
+// is the same one Ed25519 derives from the seed.
+func montgomeryPrivate(priv ed25519.PrivateKey) []byte {
+	h := sha512.Sum512(priv.Seed())
+	return h[:32]
+}
+
+func deriveKey(secret, salt []byte, info string, n int) []byte {
+	if salt == nil {
+		salt = make([]byte, sha256.Size)
+	}
+	out := make([]byte, n)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), out); err != nil {
+		panic(err)
+	}
+	return out
+}
+
+func hmacSHA256(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+func kdfRoot(rootKey, dhOut []byte) (newRoot, chainKey []byte) {
+	out := deriveKey(dhOut, rootKey, "OMEMO Root Chain", 64)
+	return out[:32], out[32:]
+}
+
+func kdfChain(chainKey []byte) (newChain, messageKey []byte) {
+	return hmacSHA256(chainKey, []byte{2}), hmacSHA256(chainKey, []byte{1})
+}
+
+// x3dhSecret derives the shared secret from the four Diffie-Hellman outputs.
+func x3dhSecret(dhs ...[]byte) []byte {
+	km := bytes.Repeat([]byte{0xff}, 32)
+	for _, d := range dhs {
+		km = append(km, d...)
+	}
+	return deriveKey(km, nil, "OMEMO X3DH", 32)
+}
+
+// startRatchet runs X3DH with the bundle of a device and returns a session
+// whose messages carry the key exchange until the device answers.
+func startRatchet(identity ed25519.PrivateKey, theirIdentity, signedPreKey []byte, signedPreKeyID uint32, preKey []byte, preKeyID uint32) (*ratchet, error) {
+	theirIK, err := montgomeryPublic(theirIdentity)
+	if err != nil {
+		return nil, err
+	}
+	ek, err := newX25519()
+	if err != nil {
+		return nil, err
+	}
+	ourIK := montgomeryPrivate(identity)
+
+	var dhs [][]byte
+	for _, pair := range [][2][]byte{
+		{ourIK, signedPreKey},
+		{ek.Bytes(), theirIK},
+		{ek.Bytes(), signedPreKey},
+		{ek.Bytes(), preKey},
+	} {
+		out, err := dh(pair[0], pair[1])
+		if err != nil {
+			return nil, err
+		}
+		dhs = append(dhs, out)
+	}
+
+	ourPub := identity.Public().(ed25519.PublicKey)
+	r := &ratchet{
+		RecvPub: signedPreKey,
+		AD:      append(append([]byte{}, ourPub...), theirIdentity...),
+		Pending: &keyExchange{
+			PreKeyID:       preKeyID,
+			SignedPreKeyID: signedPreKeyID,
+			Identity:       ourPub,
+			Ephemeral:      ek.PublicKey().Bytes(),
+		},
+	}
+	err = r.ratchetSend(x3dhSecret(dhs...))
+	return r, err
+}
+
+// acceptRatchet runs the other side of X3DH for a key exchange we received.
+func acceptRatchet(identity ed25519.PrivateKey, signedPreKey, preKey []byte, kex keyExchange) (*ratchet, error) {
+	theirIK, err := montgomeryPublic(kex.Identity)
+	if err != nil {
+		return nil, err
+	}
+	ourIK := montgomeryPrivate(identity)
+
+	var dhs [][]byte
+	for _, pair := range [][2][]byte{
+		{signedPreKey, theirIK},
+		{ourIK, kex.Ephemeral},
+		{signedPreKey, kex.Ephemeral},
+		{preKey, kex.Ephemeral},
+	} {
+		out, err := dh(pair[0], pair[1])
+		if err != nil {
+			return nil, err
+		}
+		dhs = append(dhs, out)
+	}
+
+	ourPub := identity.Public().(ed25519.PublicKey)
+	return &ratchet{
+		RootKey:  x3dhSecret(dhs...),
+		SendPriv: signedPreKey,
+		AD:       append(append([]byte{}, kex.Identity...), ourPub...),
+	}, nil
+}
+
+// ratchetSend starts a new sending chain with a fresh ratchet key.
+func (r *ratchet) ratchetSend(rootKey []byte) error {
+	k, err := newX25519()
+	if err != nil {
+		return err
+	}
+	out, err := dh(k.Bytes(), r.RecvPub)
+	if err != nil {
+		return err
+	}
+	r.SendPriv = k.Bytes()
+	r.RootKey, r.SendKey = kdfRoot(rootKey, out)
+	return nil
+}
+
+// encrypt encrypts plaintext, the key material of a message, and returns an
+// OMEMOAuthenticatedMessage.
+func (r *ratchet) encrypt(plaintext []byte) ([]byte, error) {
+	if r.SendKey == nil {
+		return nil, errors.New("session is not ready to send")
+	}
+	k, err := ecdh.X25519().NewPrivateKey(r.SendPriv)
+	if err != nil {
+		return nil, err
+	}
+	var mk []byte
+	r.SendKey, mk = kdfChain(r.SendKey)
+	header := omemoMessage{N: r.SendN, PN: r.PrevN, DH: k.PublicKey().Bytes()}
+	r.SendN++
+
+	keys := deriveKey(mk, nil, "OMEMO Message Key Material", 80)
+	header.Ciphertext, err = cbcEncrypt(keys[:32], keys[64:], plaintext)
+	if err != nil {
+		return nil, err
+	}
+	msg := header.marshal()
+	mac := hmacSHA256(keys[32:64], r.AD, msg)[:16]
+	return marshalAuthenticated(mac, msg), nil
+}
+
+// decrypt decrypts an OMEMOAuthenticatedMessage. The session is only changed
+// if the message is authentic.
+func (r *ratchet) decrypt(authenticated []byte) ([]byte, error) {
+	mac, msg, err := parseAuthenticated(authenticated)
+	if err != nil {
+		return nil, err
+	}
+	header, err := parseOMEMOMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	next := r.clone()
+	skipped := skippedKey(header.DH, header.N)
+	mk, ok := next.Skipped[skipped]
+	if ok {
+		delete(next.Skipped, skipped)
+	} else {
+		if !bytes.Equal(header.DH, next.RecvPub) || next.RecvKey == nil {
+			if err := next.skip(header.PN); err != nil {
+				return nil, err
+			}
+			if err := next.ratchetRecv(header.DH); err != nil {
+				return nil, err
+			}
+		}
+		if err := next.skip(header.N); err != nil {
+			return nil, err
+		}
+		next.RecvKey, mk = kdfChain(next.RecvKey)
+		next.RecvN++
+	}
+
+	keys := deriveKey(mk, nil, "OMEMO Message Key Material", 80)
+	if !hmac.Equal(mac, hmacSHA256(keys[32:64], next.AD, msg)[:16]) {
+		return nil, errMACMismatch
+	}
+	plaintext, err := cbcDecrypt(keys[:32], keys[64:], header.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	// The other side has the session now
+	next.Pending = nil
+	*r = *next
+	return plaintext, nil
+}
+
+// ratchetRecv moves to the new ratchet key of the other side.
+func (r *ratchet) ratchetRecv(pub []byte) error {
+	r.PrevN, r.SendN, r.RecvN = r.SendN, 0, 0
+	r.RecvPub = pub
+	out, err := dh(r.SendPriv, r.RecvPub)
+	if err != nil {
+		return err
+	}
+	var rootKey []byte
+	rootKey, r.RecvKey = kdfRoot(r.RootKey, out)
+	return r.ratchetSend(rootKey)
+}
+
+// skip stores the keys of the messages in the receiving chain up to n.
+func (r *ratchet) skip(n uint32) error {
+	if r.RecvKey == nil {
+		return nil
+	}
+	if n > r.RecvN+maxSkip {
+		return errors.New("too many skipped messages")
+	}
+	for r.RecvN < n {
+		var mk []byte
+		r.RecvKey, mk = kdfChain(r.RecvKey)
+		r.Skipped[skippedKey(r.RecvPub, r.RecvN)] = mk
+		r.RecvN++
+	}
+	// Messages that never arrived shouldn't keep their keys forever
+	for k := range r.Skipped {
+		if len(r.Skipped) <= maxSkip {
+			break
+		}
+		delete(r.Skipped, k)
+	}
+	return nil
+}
+
+func skippedKey(pub []byte, n uint32) string {
+	return fmt.Sprintf("%s:%d", hex.EncodeToString(pub), n)
+}
+
+func (r *ratchet) clone() *ratchet {
+	c := *r
+	c.Skipped = make(map[string][]byte, len(r.Skipped))
+	for k, v := range r.Skipped {
+		c.Skipped[k] = v
+	}
+	return &c
+}
+
+// sealPayload encrypts the SCE envelope of a message with a new key and
+// returns the key and MAC that are sent through the ratchets.
+func sealPayload(plaintext []byte) (keyMaterial, ciphertext []byte, err error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+	keys := deriveKey(key, nil, "OMEMO Payload", 80)
+	ciphertext, err = cbcEncrypt(keys[:32], keys[64:], plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	mac := hmacSHA256(keys[32:64], ciphertext)[:16]
+	return append(key, mac...), ciphertext, nil
+}
+
+func openPayload(keyMaterial, ciphertext []byte) ([]byte, error) {
+	if len(keyMaterial) != 48 {
+		return nil, errors.New("invalid key material")
+	}
+	keys := deriveKey(keyMaterial[:32], nil, "OMEMO Payload", 80)
+	if !hmac.Equal(keyMaterial[32:], hmacSHA256(keys[32:64], ciphertext)[:16]) {
+		return nil, errMACMismatch
+	}
+	return cbcDecrypt(keys[:32], keys[64:], ciphertext)
+}
+
+// cbcEncrypt encrypts with AES-256-CBC and PKCS#7 padding.
+func cbcEncrypt(key, iv, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	pad := aes.BlockSize - len(plaintext)%aes.BlockSize
+	buf := append(append([]byte{}, plaintext...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(buf, buf)
+	return buf, nil
+}
+
+func cbcDecrypt(key, iv, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, errBadPadding
+	}
+	buf := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(buf, ciphertext)
+	pad := int(buf[len(buf)-1])
+	if pad == 0 || pad > aes.BlockSize || !bytes.Equal(buf[len(buf)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, errBadPadding
+	}
+	return buf[:len(buf)-pad], nil
+}
+
+// The messages are protobuf encoded, these are the only types we need so
+// they're written out by hand.
+
+func appendVarintField(b []byte, num int, v uint32) []byte {
+	b = binary.AppendUvarint(b, uint64(num)<<3)
+	return binary.AppendUvarint(b, uint64(v))
+}
+
+func appendBytesField(b []byte, num int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(num)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// parseProto returns the varint and length delimited fields of a message.
+func parseProto(b []byte) (map[int]uint32, map[int][]byte, error) {
+	varints := make(map[int]uint32)
+	fields := make(map[int][]byte)
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, nil, errors.New("invalid protobuf tag")
+		}
+		b = b[n:]
+		num := int(tag >> 3)
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, nil, errors.New("invalid protobuf field")
+		}
+		b = b[n:]
+		switch tag & 7 {
+		case 0:
+			varints[num] = uint32(v)
+		case 2:
+			if uint64(len(b)) < v {
+				return nil, nil, errors.New("truncated protobuf field")
+			}
+			fields[num] = b[:v]
+			b = b[v:]
+		default:
+			return nil, nil, fmt.Errorf("unsupported protobuf wire type %d", tag&7)
+		}
+	}
+	return varints, fields, nil
+}
+
+func (m omemoMessage) marshal() []byte {
+	b := appendVarintField(nil, 1, m.N)
+	b = appendVarintField(b, 2, m.PN)
+	b = appendBytesField(b, 3, m.DH)
+	if m.Ciphertext != nil {
+		b = appendBytesField(b, 4, m.Ciphertext)
+	}
+	return b
+}
+
+func parseOMEMOMessage(b []byte) (omemoMessage, error) {
+	varints, fields, err := parseProto(b)
+	if err != nil {
+		return omemoMessage{}, err
+	}
+	m := omemoMessage{N: varints[1], PN: varints[2], DH: fields[3], Ciphertext: fields[4]}
+	if len(m.DH) != 32 {
+		return m, errors.New("invalid ratchet key")
+	}
+	return m, nil
+}
+
+func marshalAuthenticated(mac, msg []byte) []byte {
+	return appendBytesField(appendBytesField(nil, 1, mac), 2, msg)
+}
+
+func parseAuthenticated(b []byte) (mac, msg []byte, err error) {
+	_, fields, err := parseProto(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(fields[1]) != 16 || fields[2] == nil {
+		return nil, nil, errors.New("invalid authenticated message")
+	}
+	return fields[1], fields[2], nil
+}
+
+// marshal returns the OMEMOKeyExchange carrying the authenticated message.
+func (k keyExchange) marshal(authenticated []byte) []byte {
+	b := appendVarintField(nil, 1, k.PreKeyID)
+	b = appendVarintField(b, 2, k.SignedPreKeyID)
+	b = appendBytesField(b, 3, k.Identity)
+	b = appendBytesField(b, 4, k.Ephemeral)
+	return appendBytesField(b, 5, authenticated)
+}
+
+func parseKeyExchange(b []byte) (keyExchange, []byte, error) {
+	varints, fields, err := parseProto(b)
+	if err != nil {
+		return keyExchange{}, nil, err
+	}
+	k := keyExchange{
+		PreKeyID:       varints[1],
+		SignedPreKeyID: varints[2],
+		Identity:       fields[3],
+		Ephemeral:      fields[4],
+	}
+	if len(k.Identity) != ed25519.PublicKeySize || len(k.Ephemeral) != 32 || fields[5] == nil {
+		return k, nil, errors.New("invalid key exchange")
+	}
+	return k, fields[5], nil
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// testDevice is the keys a device publishes in its bundle.
+type testDevice struct {
+	identity     ed25519.PrivateKey
+	signedPreKey []byte
+	preKey       []byte
+}
+
+func newTestDevice(t *testing.T) testDevice {
+	t.Helper()
+	_, identity, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spk, err := newX25519()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := newX25519()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testDevice{identity: identity, signedPreKey: spk.Bytes(), preKey: pk.Bytes()}
+}
+
+// newTestSessions runs X3DH between alice and bob and returns both sides of
+// the session, with Bob having decrypted the first message of Alice.
+func newTestSessions(t *testing.T) (alice, bob *ratchet) {
+	t.Helper()
+	a, b := newTestDevice(t), newTestDevice(t)
+	spk, err := x25519Public(b.signedPreKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := x25519Public(b.preKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err = startRatchet(a.identity, b.identity.Public().(ed25519.PublicKey), spk, 1, pk, 7)
+	if err != nil {
+		t.Fatalf("starting session: %v", err)
+	}
+
+	msg, err := alice.encrypt([]byte("hello"))
+	if err != nil {
+		t.Fatalf("encrypting: %v", err)
+	}
+	kex, msg, err := parseKeyExchange(alice.Pending.marshal(msg))
+	if err != nil {
+		t.Fatalf("parsing key exchange: %v", err)
+	}
+	if kex.PreKeyID != 7 || kex.SignedPreKeyID != 1 {
+		t.Errorf("key exchange names prekey %d and signed prekey %d, want 7 and 1", kex.PreKeyID, kex.SignedPreKeyID)
+	}
+	bob, err = acceptRatchet(b.identity, b.signedPreKey, b.preKey, kex)
+	if err != nil {
+		t.Fatalf("accepting session: %v", err)
+	}
+	expectDecrypt(t, bob, msg, "hello")
+	return alice, bob
+}
+
+func encryptAll(t *testing.T, r *ratchet, texts ...string) [][]byte {
+	t.Helper()
+	var msgs [][]byte
+	for _, text := range texts {
+		msg, err := r.encrypt([]byte(text))
+		if err != nil {
+			t.Fatalf("encrypting %q: %v", text, err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func expectDecrypt(t *testing.T, r *ratchet, msg []byte, want string) {
+	t.Helper()
+	got, err := r.decrypt(msg)
+	if err != nil {
+		t.Fatalf("decrypting %q: %v", want, err)
+	}
+	if string(got) != want {
+		t.Fatalf("decrypted %q, want %q", got, want)
+	}
+}
+
+func TestRatchetRoundTrip(t *testing.T) {
+	alice, bob := newTestSessions(t)
+	if alice.Pending == nil {
+		t.Fatal("key exchange isn't pending before Bob answered")
+	}
+	if !bytes.Equal(alice.AD, bob.AD) {
+		t.Fatalf("associated data differs: %x and %x", alice.AD, bob.AD)
+	}
+
+	// Alice keeps sending the key exchange until Bob answers
+	for i, msg := range encryptAll(t, alice, "still there?", "hello?") {
+		expectDecrypt(t, bob, msg, []string{"still there?", "hello?"}[i])
+	}
+	expectDecrypt(t, alice, encryptAll(t, bob, "hi")[0], "hi")
+	if alice.Pending != nil {
+		t.Error("key exchange is still pending after Bob answered")
+	}
+
+	// Every turn moves the ratchet forward
+	for i := 0; i < 5; i++ {
+		text := fmt.Sprintf("from Alice %d", i)
+		expectDecrypt(t, bob, encryptAll(t, alice, text)[0], text)
+		text = fmt.Sprintf("from Bob %d", i)
+		expectDecrypt(t, alice, encryptAll(t, bob, text)[0], text)
+	}
+}
+
+func TestRatchetResponderCantSendFirst(t *testing.T) {
+	b := newTestDevice(t)
+	a := newTestDevice(t)
+	ephemeral, err := newX25519()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := acceptRatchet(b.identity, b.signedPreKey, b.preKey, keyExchange{
+		Identity:  a.identity.Public().(ed25519.PublicKey),
+		Ephemeral: ephemeral.PublicKey().Bytes(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.encrypt([]byte("hi")); err == nil {
+		t.Error("encrypted before receiving a message")
+	}
+}
+
+func TestRatchetOutOfOrder(t *testing.T) {
+	alice, bob := newTestSessions(t)
+	msgs := encryptAll(t, alice, "m0", "m1", "m2", "m3")
+	expectDecrypt(t, bob, msgs[3], "m3")
+	expectDecrypt(t, bob, msgs[0], "m0")
+
+	// Bob answers, so that Alice's next messages are in a new chain and m1 and
+	// m2 are left behind in the old one
+	expectDecrypt(t, alice, encryptAll(t, bob, "ok")[0], "ok")
+	later := encryptAll(t, alice, "n0", "n1")
+	expectDecrypt(t, bob, later[1], "n1")
+	expectDecrypt(t, bob, msgs[2], "m2")
+	expectDecrypt(t, bob, later[0], "n0")
+	expectDecrypt(t, bob, msgs[1], "m1")
+	if len(bob.Skipped) != 0 {
+		t.Errorf("%d skipped message keys left after all messages arrived", len(bob.Skipped))
+	}
+}
+
+func TestRatchetReplay(t *testing.T) {
+	alice, bob := newTestSessions(t)
+	msgs := encryptAll(t, alice, "m0", "m1", "m2")
+	expectDecrypt(t, bob, msgs[2], "m2")
+	expectDecrypt(t, bob, msgs[0], "m0")
+	// m0 came from the skipped keys and m2 from the chain
+	for _, i := range []int{0, 2} {
+		if _, err := bob.decrypt(msgs[i]); err == nil {
+			t.Errorf("m%d decrypted twice", i)
+		}
+	}
+	expectDecrypt(t, bob, msgs[1], "m1")
+}
+
+func TestRatchetTooManySkipped(t *testing.T) {
+	alice, bob := newTestSessions(t)
+	msgs := encryptAll(t, alice, make([]string, maxSkip+2)...)
+	if _, err := bob.decrypt(msgs[maxSkip+1]); err == nil {
+		t.Errorf("skipped %d messages, want at most %d", maxSkip+1, maxSkip)
+	}
+	expectDecrypt(t, bob, msgs[maxSkip], "")
+}
+
+func TestRatchetBadMAC(t *testing.T) {
+	alice, bob := newTestSessions(t)
+	// A message after a ratchet step too, where a forgery could move the session
+	// to a new chain
+	expectDecrypt(t, alice, encryptAll(t, bob, "ok")[0], "ok")
+	for _, msg := range encryptAll(t, alice, "m0", "m1") {
+		for i := range msg {
+			forged := append([]byte{}, msg...)
+			forged[i] ^= 0x01
+			before := bob.clone()
+			if _, err := bob.decrypt(forged); err == nil {
+				t.Fatalf("decrypted the message with byte %d flipped", i)
+			}
+			if !reflect.DeepEqual(bob, before) {
+				t.Fatalf("the message with byte %d flipped changed the session", i)
+			}
+		}
+	}
+
+	// The real messages still decrypt, in the new chain and skipping one
+	msgs := encryptAll(t, alice, "m2", "m3")
+	before := bob.clone()
+	if _, err := bob.decrypt(alteredMAC(t, msgs[1])); !errors.Is(err, errMACMismatch) {
+		t.Errorf("got error %v for a wrong MAC, want %v", err, errMACMismatch)
+	}
+	if !reflect.DeepEqual(bob, before) {
+		t.Error("a message with a wrong MAC changed the session")
+	}
+	expectDecrypt(t, bob, msgs[1], "m3")
+	expectDecrypt(t, bob, msgs[0], "m2")
+}
+
+// alteredMAC returns msg with a MAC that is well-formed but wrong.
+func alteredMAC(t *testing.T, msg []byte) []byte {
+	t.Helper()
+	mac, body, err := parseAuthenticated(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac = append([]byte{}, mac...)
+	mac[0] ^= 0x80
+	return marshalAuthenticated(mac, body)
+}
+
+func TestMontgomeryConversion(t *testing.T) {
+	// From the tests of crypto_sign_ed25519_pk_to_curve25519 and
+	// crypto_sign_ed25519_sk_to_curve25519 in libsodium
+	for _, tc := range []struct {
+		seed, edPublic, public, private string
+	}{{
+		seed:     "421151a459faeade3d247115f94aedae42318124095afabe4d1451a559faedee",
+		edPublic: "b5076a8474a832daee4dd5b4040983b6623b5f344aca57d4d6ee4baf3f259e6e",
+		public:   "f1814f0e8ff1043d8a44d25babff3cedcae6c22c3edaa48f857ae70de2baae50",
+		private:  "8052030376d47112be7f73ed7a019293dd12ad910b654455798b4667d73de166",
+	}} {
+		seed, _ := hex.DecodeString(tc.seed)
+		priv := ed25519.NewKeyFromSeed(seed)
+		if got := hex.EncodeToString(priv.Public().(ed25519.PublicKey)); got != tc.edPublic {
+			t.Fatalf("Ed25519 public key is %s, want %s", got, tc.edPublic)
+		}
+		pub, err := montgomeryPublic(priv.Public().(ed25519.PublicKey))
+		if err != nil {
+			t.Fatalf("converting public key: %v", err)
+		}
+		if got := hex.EncodeToString(pub); got != tc.public {
+			t.Errorf("X25519 public key is %s, want %s", got, tc.public)
+		}
+		// libsodium clamps the scalar, X25519 does that itself when it's used
+		k := montgomeryPrivate(priv)
+		k[0] &= 248
+		k[31] &= 127
+		k[31] |= 64
+		if got := hex.EncodeToString(k); got != tc.private {
+			t.Errorf("X25519 private key is %s, want %s", got, tc.private)
+		}
+	}
+}
+
+func TestMontgomeryKeysMatch(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := montgomeryPublic(pub)
+		if err != nil {
+			t.Fatalf("converting public key: %v", err)
+		}
+		got, err := x25519Public(montgomeryPrivate(priv))
+		if err != nil {
+			t.Fatalf("deriving public key: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("public key of the converted private key is %x, want %x", got, want)
+		}
+	}
+}
+
+func TestMontgomeryPublicInvalid(t *testing.T) {
+	for _, pub := range [][]byte{nil, make([]byte, 31), make([]byte, 33)} {
+		if _, err := montgomeryPublic(pub); err == nil {
+			t.Errorf("converted a public key of %d bytes", len(pub))
+		}
+	}
+	// y = 1 has no Montgomery form
+	one := make([]byte, 32)
+	one[0] = 1
+	if _, err := montgomeryPublic(one); err == nil {
+		t.Error("converted the public key with y = 1")
+	}
+}
+
+func TestPayload(t *testing.T) {
+	for _, n := range []int{0, 1, 15, 16, 17, 1000} {
+		plaintext := bytes.Repeat([]byte{'a'}, n)
+		keyMaterial, ciphertext, err := sealPayload(plaintext)
+		if err != nil {
+			t.Fatalf("sealing %d bytes: %v", n, err)
+		}
+		got, err := openPayload(keyMaterial, ciphertext)
+		if err != nil {
+			t.Fatalf("opening %d bytes: %v", n, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Fatalf("opened %q, want %q", got, plaintext)
+		}
+
+		ciphertext[len(ciphertext)-1] ^= 0x01
+		if _, err := openPayload(keyMaterial, ciphertext); !errors.Is(err, errMACMismatch) {
+			t.Errorf("got error %v for a changed payload of %d bytes, want %v", err, n, errMACMismatch)
+		}
+	}
+}
+
+func TestCBCPadding(t *testing.T) {
+	key, iv := make([]byte, 32), make([]byte, 16)
+	ciphertext, err := cbcEncrypt(key, iv, []byte("yellow submarine"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ciphertext) != 32 {
+		t.Errorf("a full block encrypted to %d bytes, want a block of padding added", len(ciphertext))
+	}
+	for _, c := range [][]byte{nil, ciphertext[:17], ciphertext[:16]} {
+		if _, err := cbcDecrypt(key, iv, c); !errors.Is(err, errBadPadding) {
+			t.Errorf("got error %v for %d bytes, want %v", err, len(c), errBadPadding)
+		}
+	}
+}
+
+func TestProtoEncoding(t *testing.T) {
+	// Tags are the field number shifted left by three or'ed with the wire type,
+	// 300 is the varint ac 02
+	dh := bytes.Repeat([]byte{0xaa}, 32)
+	m := omemoMessage{N: 300, PN: 1, DH: dh, Ciphertext: []byte{1, 2}}
+	want := append(append([]byte{0x08, 0xac, 0x02, 0x10, 0x01, 0x1a, 0x20}, dh...), 0x22, 0x02, 0x01, 0x02)
+	b := m.marshal()
+	if !bytes.Equal(b, want) {
+		t.Fatalf("encoded %x, want %x", b, want)
+	}
+	got, err := parseOMEMOMessage(b)
+	if err != nil {
+		t.Fatalf("parsing: %v", err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("parsed %+v, want %+v", got, m)
+	}
+
+	for i := 1; i < len(b); i++ {
+		// Cut right after the ratchet key it's only missing the ciphertext
+		if i == len(b)-4 {
+			continue
+		}
+		if _, err := parseOMEMOMessage(b[:i]); err == nil {
+			t.Errorf("parsed the message cut to %d bytes", i)
+		}
+	}
+	if _, err := parseOMEMOMessage(append(b, 0x2d, 0, 0, 0, 0)); err == nil {
+		t.Error("parsed a field of wire type 5")
+	}
+}
+
+func TestKeyExchangeEncoding(t *testing.T) {
+	k := keyExchange{
+		PreKeyID:       42,
+		SignedPreKeyID: 3,
+		Identity:       bytes.Repeat([]byte{1}, ed25519.PublicKeySize),
+		Ephemeral:      bytes.Repeat([]byte{2}, 32),
+	}
+	mac, msg := bytes.Repeat([]byte{3}, 16), []byte{4, 5}
+	got, authenticated, err := parseKeyExchange(k.marshal(marshalAuthenticated(mac, msg)))
+	if err != nil {
+		t.Fatalf("parsing: %v", err)
+	}
+	if !reflect.DeepEqual(got, k) {
+		t.Errorf("parsed %+v, want %+v", got, k)
+	}
+	gotMAC, gotMsg, err := parseAuthenticated(authenticated)
+	if err != nil {
+		t.Fatalf("parsing authenticated message: %v", err)
+	}
+	if !bytes.Equal(gotMAC, mac) || !bytes.Equal(gotMsg, msg) {
+		t.Errorf("parsed MAC %x and message %x, want %x and %x", gotMAC, gotMsg, mac, msg)
+	}
+
+	if _, _, err := parseAuthenticated(marshalAuthenticated(mac[:15], msg)); err == nil {
+		t.Error("parsed a MAC of 15 bytes")
+	}
+	k.Identity = k.Identity[:31]
+	if _, _, err := parseKeyExchange(k.marshal(authenticated)); err == nil {
+		t.Error("parsed an identity key of 31 bytes")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/stanza"
+)
+
+// rawStanza is a stanza typed in by the user
+type rawStanza []xml.Token
+
+func (s rawStanza) TokenReader() xml.TokenReader {
+	return xmlstream.ReaderFunc(func() (xml.Token, error) {
+		if len(s) == 0 {
+			return nil, io.EOF
+		}
+		tok := s[0]
+		s = s[1:]
+		return tok, nil
+	})
+}
+
+// parseStanza parses the argument of /raw, which must be a single complete
+// message, presence or iq. Stanzas without a namespace get the one of the
+// stream, as if they had been typed into it.
+func parseStanza(data string) (rawStanza, error) {
+	d := xml.NewDecoder(strings.NewReader(data))
+	var toks rawStanza
+	depth := 0
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				if len(toks) > 0 {
+					return nil, errors.New("only one stanza can be sent at a time")
+				}
+				switch t.Name.Local {
+				case "message", "presence", "iq":
+				default:
+					return nil, fmt.Errorf("<%s> is not a stanza, send a message, presence or iq", t.Name.Local)
+				}
+				if t.Name.Space == "" {
+					t.Name.Space = stanza.NSClient
+				}
+				tok = t
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+			if depth == 0 && t.Name.Space == "" {
+				t.Name.Space = stanza.NSClient
+				tok = t
+			}
+		case xml.CharData:
+			if depth == 0 {
+				if len(strings.TrimSpace(string(t))) != 0 {
+					return nil, errors.New("text outside of the stanza")
+				}
+				continue
+			}
+		case xml.Comment:
+			continue
+		case xml.ProcInst, xml.Directive:
+			return nil, errors.New("only a stanza can be sent")
+		}
+		toks = append(toks, xml.CopyToken(tok))
+	}
+	if len(toks) == 0 {
+		return nil, errors.New("no stanza given")
+	}
+	return toks, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// XEP-0184 delivery receipt
+type receipt struct {
+	ID string `xml:"id,attr"`
+}
+
+// receiptTracker remembers the body of each sent message that is still
+// waiting for a delivery receipt.
+type receiptTracker struct {
+	mu      sync.Mutex
+	pending map[string]string
+	waiting map[string]chan struct{}
+}
+
+func (r *receiptTracker) add(id, body string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pending == nil {
+		r.pending = make(map[string]string)
+	}
+	r.pending[id] = body
+}
+
+// wait is like add but also returns a channel that is closed once the receipt
+// arrives.
+func (r *receiptTracker) wait(id, body string) <-chan struct{} {
+	r.add(id, body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.waiting == nil {
+		r.waiting = make(map[string]chan struct{})
+	}
+	ch := make(chan struct{})
+	r.waiting[id] = ch
+	return ch
+}
+
+func (r *receiptTracker) done(id string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	body, ok := r.pending[id]
+	delete(r.pending, id)
+	if ch, ok := r.waiting[id]; ok {
+		close(ch)
+		delete(r.waiting, id)
+	}
+	return body, ok
+}
+
+// sendOnce sends body to to and waits up to timeout for a delivery receipt,
+// for -message.
+func (c *client) sendOnce(ctx context.Context, to jid.JID, body string, timeout time.Duration) error {
+	id := newID()
+	delivered := c.receipts.wait(id, body)
+	msg := messageBody{
+		Message: stanza.Message{
+			ID:   id,
+			To:   to,
+			From: c.LocalAddr(),
+			Type: stanza.ChatMessage,
+		},
+		Body:    body,
+		Request: &struct{}{},
+		Nick:    c.Nick(),
+	}
+	err := c.encryptBody(ctx, &msg)
+	if err == nil {
+		err = c.Encode(ctx, msg)
+	}
+	if err != nil {
+		c.receipts.done(id)
+		return err
+	}
+	c.recordHistory("out", to, body)
+	// Nothing will answer in a dry run
+	if c.dryRun != nil {
+		c.receipts.done(id)
+		return nil
+	}
+
+	select {
+	case <-delivered:
+		return nil
+	case <-time.After(timeout):
+		c.receipts.done(id)
+		return fmt.Errorf("no delivery receipt from %s after %v", to, timeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
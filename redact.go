@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"sync"
+)
+
+const redacted = "[REDACTED]"
+
+// redactWriter hides what we send in SASL auth and response elements, XEP-0077
+// passwords and the values of private form fields before it reaches the XML
+// log, since with PLAIN that is the password in base64 and verbose logs get
+// shared when asking for help. Like traceWriter it keeps its
+// state between writes in case an element is split.
+type redactWriter struct {
+	w io.Writer
+
+	mu sync.Mutex
+	// Inside an element whose content is hidden, and whether the placeholder
+	// was written for it yet
+	hiding bool
+	hidden bool
+	// Inside a text-private data form field
+	private bool
+	// A tag split across writes, which can't be told apart from a secret one
+	// until it is complete
+	partial string
+}
+
+func (w *redactWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	out := w.redact(string(p))
+	w.mu.Unlock()
+
+	if out == "" {
+		return len(p), nil
+	}
+	if _, err := io.WriteString(w.w, out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *redactWriter) redact(s string) string {
+	var b strings.Builder
+	s, w.partial = w.partial+s, ""
+	for s != "" {
+		i := strings.IndexByte(s, '<')
+		if w.hiding {
+			if i != 0 && !w.hidden {
+				b.WriteString(redacted)
+				w.hidden = true
+			}
+			if i < 0 {
+				break
+			}
+			w.hiding = false
+			s = s[i:]
+			continue
+		}
+		if i < 0 {
+			b.WriteString(s)
+			break
+		}
+		b.WriteString(s[:i])
+		s = s[i:]
+
+		j := strings.IndexByte(s, '>')
+		if j < 0 {
+			w.partial = s
+			break
+		}
+		tag := s[:j+1]
+		b.WriteString(tag)
+		s = s[j+1:]
+		switch name := tagName(tag); {
+		case isSecret(tag) || w.private && name == "value" && !strings.HasSuffix(tag, "/>"):
+			w.hiding, w.hidden = true, false
+		case name == "field":
+			w.private = strings.Contains(tag, "text-private") && !strings.HasSuffix(tag, "/>")
+		case name == "/field":
+			w.private = false
+		}
+	}
+	return b.String()
+}
+
+// isSecret reports whether tag starts a SASL element with data from us or the
+// password of a registration, which inherits its namespace from the query.
+func isSecret(tag string) bool {
+	if strings.HasSuffix(tag, "/>") {
+		return false
+	}
+	name := tagName(tag)
+	if name == "password" {
+		return true
+	}
+	return strings.Contains(tag, nsSASL) && (name == "auth" || name == "response")
+}
+
+// tagName returns the name of the element tag starts or, with a leading slash,
+// ends.
+func tagName(tag string) string {
+	name := strings.TrimPrefix(tag, "<")
+	end := strings.HasPrefix(name, "/")
+	name = strings.TrimPrefix(name, "/")
+	if i := strings.IndexAny(name, " \t\r\n/>"); i >= 0 {
+		name = name[:i]
+	}
+	if end {
+		return "/" + name
+	}
+	return name
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactWriterSplitWrites(t *testing.T) {
+	const secret = "AGp1bGlldABzZWNyZXQ="
+	stanzas := []string{
+		`<auth xmlns="urn:ietf:params:xml:ns:xmpp-sasl" mechanism="PLAIN">` + secret + `</auth>`,
+		`<response xmlns="urn:ietf:params:xml:ns:xmpp-sasl">` + secret + `</response>`,
+		`<iq type="set" id="reg1"><query xmlns="jabber:iq:register"><username>juliet</username><password>` + secret + `</password></query></iq>`,
+	}
+	for _, stanza := range stanzas {
+		for size := 1; size <= len(stanza); size++ {
+			var b strings.Builder
+			w := &redactWriter{w: &b}
+			for s := stanza; s != ""; {
+				n := min(size, len(s))
+				if _, err := w.Write([]byte(s[:n])); err != nil {
+					t.Fatalf("writing: %v", err)
+				}
+				s = s[n:]
+			}
+			out := b.String()
+			if strings.Contains(out, secret) {
+				t.Fatalf("%s written in pieces of %d bytes leaked the secret: %s", tagName(stanza), size, out)
+			}
+			if !strings.Contains(out, redacted) {
+				t.Fatalf("%s written in pieces of %d bytes was not redacted: %s", tagName(stanza), size, out)
+			}
+		}
+	}
+}
+
+func TestRedactWriterKeepsOthers(t *testing.T) {
+	const stanza = `<message to="romeo@example.net"><body>hi</body></message>`
+	var b strings.Builder
+	w := &redactWriter{w: &b}
+	for _, s := range []string{stanza[:5], stanza[5:30], stanza[30:]} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatalf("writing: %v", err)
+		}
+	}
+	if out := b.String(); out != stanza {
+		t.Errorf("got %s, want %s", out, stanza)
+	}
+}
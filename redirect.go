@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"html"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/stream"
+)
+
+// maxRedirects is how many see-other-host errors in a row we follow, so that
+// servers sending us to each other don't keep us going round for ever
+const maxRedirects = 5
+
+// Enough of the stream to hold a whole stream error
+const maxRedirectTail = 2048
+
+var seeOtherHost = regexp.MustCompile(`<(?:[\w-]+:)?see-other-host[^>]*>([^<]*)</`)
+
+// redirectWatcher picks the host out of see-other-host stream errors, which
+// stream.Error doesn't keep. It is written everything we receive.
+type redirectWatcher struct {
+	mu   sync.Mutex
+	tail string
+	host string
+}
+
+func (w *redirectWatcher) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.tail += string(p)
+	if m := seeOtherHost.FindStringSubmatch(w.tail); m != nil {
+		w.host = strings.TrimSpace(html.UnescapeString(m[1]))
+		w.tail = ""
+	}
+	if len(w.tail) > maxRedirectTail {
+		w.tail = w.tail[len(w.tail)-maxRedirectTail:]
+	}
+	return len(p), nil
+}
+
+// take returns the host of the last see-other-host error and forgets it.
+func (w *redirectWatcher) take() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	host := w.host
+	w.host, w.tail = "", ""
+	return host
+}
+
+// redirectedTo returns where a see-other-host error sends us, or "" if err is
+// not one.
+func (c *client) redirectedTo(err error) string {
+	var se stream.Error
+	if c.redirects == nil || !errors.As(err, &se) || se.Err != "see-other-host" {
+		return ""
+	}
+	return c.redirects.take()
+}
+
+// dialServer connects to where the server last sent us or, if it hasn't or
+// that fails, to where we usually do.
+func (c *client) dialServer(ctx context.Context) (net.Conn, xmpp.SessionState, error) {
+	c.mu.Lock()
+	host := c.otherHost
+	c.mu.Unlock()
+	if host == "" {
+		return c.dial(ctx)
+	}
+	if c.dialHost == nil {
+		return nil, 0, errors.New("the server sent us to " + host + ", which can't be done with this transport")
+	}
+	conn, state, err := c.dialHost(ctx, host)
+	if err == nil {
+		return conn, state, nil
+	}
+	c.logger.Printf("Error connecting to %s, where the server sent us, trying the usual address: %v", host, err)
+	c.mu.Lock()
+	c.otherHost = ""
+	c.mu.Unlock()
+	return c.dial(ctx)
+}
+
+// withDefaultPort adds port to host if it doesn't have one. IPv6 addresses
+// come in brackets in see-other-host errors.
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
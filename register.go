@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/stanza"
+)
+
+const nsRegister = "jabber:iq:register"
+
+// registerQuery returns a XEP-0077 query with the given username and password.
+func registerQuery(username, password string) xml.TokenReader {
+	return xmlstream.Wrap(
+		xmlstream.MultiReader(
+			xmlstream.Wrap(xmlstream.Token(xml.CharData(username)), xml.StartElement{Name: xml.Name{Local: "username"}}),
+			xmlstream.Wrap(xmlstream.Token(xml.CharData(password)), xml.StartElement{Name: xml.Name{Local: "password"}}),
+		),
+		xml.StartElement{Name: xml.Name{Space: nsRegister, Local: "query"}},
+	)
+}
+
+// Password returns the password we log in with.
+func (c *client) Password() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.password
+}
+
+// changePassword changes the password of our account on the server and uses
+// the new one from then on when reconnecting.
+func (c *client) changePassword(ctx context.Context, password string) error {
+	err := c.sendIQ(ctx, c.addr.Domain(), stanza.SetIQ, registerQuery(c.addr.Localpart(), password), nil)
+	var se stanza.Error
+	if errors.As(err, &se) {
+		switch se.Condition {
+		case stanza.NotAuthorized, stanza.Forbidden:
+			return fmt.Errorf("the server wants more than the new password, e.g. the old one, which isn't supported: %s", explainError(err))
+		case stanza.NotAllowed, stanza.FeatureNotImplemented, stanza.ServiceUnavailable:
+			return fmt.Errorf("the server doesn't let passwords be changed here: %s", explainError(err))
+		case stanza.NotAcceptable:
+			return fmt.Errorf("the server refused the new password, it may be too weak: %s", explainError(err))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.password = password
+	c.mu.Unlock()
+	return nil
+}
+
+// XEP-0077 registration fields, either the original ones or a data form
+type registerFields struct {
+	XMLName      xml.Name   `xml:"jabber:iq:register query"`
+	Instructions string     `xml:"instructions"`
+	Registered   *struct{}  `xml:"registered"`
+	Form         *form.Data `xml:"jabber:x:data x"`
+	Fields       []struct {
+		XMLName xml.Name
+		Value   string `xml:",chardata"`
+	} `xml:",any"`
+}
+
+// register creates our account on the server, asking for what it wants to know
+// besides our username and password. The client must have been set up to
+// negotiate a stream without logging in.
+func (c *client) register(ctx context.Context, password string, ask prompter) error {
+	dialCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	conn, state, err := c.dial(dialCtx)
+	if err != nil {
+		return fmt.Errorf("error dialing connection: %w", err)
+	}
+	session, err := xmpp.NewSession(dialCtx, c.addr.Domain(), c.addr, conn, state, c.negotiator)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("error negotiating stream: %w", err)
+	}
+	defer session.Close()
+	c.mu.Lock()
+	c.session = session
+	c.mu.Unlock()
+	go session.Serve(c)
+
+	domain := c.addr.Domain()
+	var fields registerFields
+	err = c.sendIQ(ctx, domain, stanza.GetIQ, xmlstream.Wrap(nil, xml.StartElement{Name: xml.Name{Space: nsRegister, Local: "query"}}), &fields)
+	var se stanza.Error
+	if errors.As(err, &se) && (se.Condition == stanza.NotAllowed || se.Condition == stanza.FeatureNotImplemented || se.Condition == stanza.ServiceUnavailable) {
+		return fmt.Errorf("%s doesn't allow creating accounts from the client, it may have a website for that: %s", domain, explainError(err))
+	}
+	if err != nil {
+		return fmt.Errorf("fetching registration fields: %w", err)
+	}
+	if fields.Instructions != "" && fields.Form == nil {
+		fmt.Println(fields.Instructions)
+	}
+
+	var inner xml.TokenReader
+	if fields.Form != nil {
+		err = fillForm(fields.Form, ask, map[string]string{
+			"username": c.addr.Localpart(),
+			"password": password,
+		})
+		if err != nil {
+			return err
+		}
+		inner, _ = fields.Form.Submit()
+	} else {
+		var values []xml.TokenReader
+		for _, field := range fields.Fields {
+			v := field.Value
+			switch field.XMLName.Local {
+			case "username":
+				v = c.addr.Localpart()
+			case "password":
+				v = password
+			default:
+				for v == "" {
+					if v, err = ask(field.XMLName.Local+": ", false); err != nil {
+						return err
+					}
+				}
+			}
+			values = append(values, xmlstream.Wrap(xmlstream.Token(xml.CharData(v)), xml.StartElement{Name: xml.Name{Local: field.XMLName.Local}}))
+		}
+		inner = xmlstream.MultiReader(values...)
+	}
+
+	err = c.sendIQ(ctx, domain, stanza.SetIQ, xmlstream.Wrap(inner, xml.StartElement{Name: xml.Name{Space: nsRegister, Local: "query"}}), nil)
+	if errors.As(err, &se) {
+		switch se.Condition {
+		case stanza.Conflict:
+			return fmt.Errorf("%s is already taken", c.addr.Bare())
+		case stanza.NotAcceptable, stanza.BadRequest:
+			return fmt.Errorf("the server refused the registration, something may be missing or invalid: %s", explainError(err))
+		}
+	}
+	return err
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"sort"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/roster"
+	"mellium.im/xmpp/stanza"
+)
+
+// rosterQuery is the roster or a roster push
+type rosterQuery struct {
+	XMLName xml.Name
+	Ver     *string       `xml:"ver,attr"`
+	Items   []roster.Item `xml:"item"`
+}
+
+// fetchRoster gets the roster from the server. If the server does roster
+// versioning and we have a cached copy, it only sends the roster if it changed
+// since.
+func (c *client) fetchRoster(ctx context.Context) ([]roster.Item, error) {
+	session := c.Session()
+	if session == nil {
+		return nil, errDisconnected
+	}
+
+	c.mu.Lock()
+	ver := c.rosterVer
+	c.mu.Unlock()
+	start := xml.StartElement{Name: xml.Name{Space: roster.NS, Local: "query"}}
+	// Servers that don't advertise versioning may not like the attribute
+	_, versioning := session.Feature(roster.NSFeatures)
+	if versioning {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "ver"}, Value: ver})
+	}
+
+	var q rosterQuery
+	err := c.sendIQ(ctx, jid.JID{}, stanza.GetIQ, xmlstream.Wrap(nil, start), &q)
+	if err != nil {
+		return nil, err
+	}
+
+	// An empty result means the cached roster is still current
+	if q.XMLName.Local == "" && versioning {
+		return c.rosterItems(), nil
+	}
+	ver = ""
+	if q.Ver != nil {
+		ver = *q.Ver
+	}
+	c.mu.Lock()
+	c.roster = make(map[string]roster.Item, len(q.Items))
+	for _, item := range q.Items {
+		c.roster[item.JID.Bare().String()] = item
+	}
+	c.rosterVer = ver
+	c.mu.Unlock()
+	c.saveRoster()
+	return c.rosterItems(), nil
+}
+
+// handleRosterPush applies a change our server made to the roster, because
+// we or another of our clients changed it.
+func (c *client) handleRosterPush(t xmlstream.TokenReadEncoder, iq stanza.IQ, payload xml.StartElement) error {
+	// Anyone else could use pushes to add themselves to our roster
+	if iq.Type != stanza.SetIQ || (iq.From.String() != "" && !iq.From.Equal(c.LocalAddr().Bare())) {
+		return nil
+	}
+
+	var q rosterQuery
+	d := xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(payload), t))
+	if err := d.Decode(&q); err != nil {
+		c.logger.Printf("Error decoding roster push: %v", err)
+		return nil
+	}
+	// Pushes have exactly one item
+	if len(q.Items) != 1 {
+		_, err := xmlstream.Copy(t, iq.Error(stanza.Error{Type: stanza.Modify, Condition: stanza.BadRequest}))
+		return err
+	}
+
+	item := q.Items[0]
+	key := item.JID.Bare().String()
+	c.mu.Lock()
+	if c.roster == nil {
+		c.roster = make(map[string]roster.Item)
+	}
+	_, known := c.roster[key]
+	change := "updated"
+	switch {
+	case item.Subscription == "remove":
+		delete(c.roster, key)
+		change = "removed"
+	case !known:
+		change = "added"
+		fallthrough
+	default:
+		c.roster[key] = item
+	}
+	if q.Ver != nil {
+		c.rosterVer = *q.Ver
+	}
+	c.mu.Unlock()
+	c.saveRoster()
+
+	// Pushes for contacts we don't have are only the server catching up
+	if known || change != "removed" {
+		e := event{Type: "roster", From: key, Subscription: item.Subscription, Status: change}
+		if item.Name != "" && change != "removed" {
+			c.report(e, "Contact %s (%s) %s\n", key, item.Name, change)
+		} else {
+			c.report(e, "Contact %s %s\n", key, change)
+		}
+	}
+
+	_, err := xmlstream.Copy(t, iq.Result(nil))
+	return err
+}
+
+// rosterItems returns the roster we know of sorted by JID.
+func (c *client) rosterItems() []roster.Item {
+	c.mu.Lock()
+	items := make([]roster.Item, 0, len(c.roster))
+	for _, item := range c.roster {
+		items = append(items, item)
+	}
+	c.mu.Unlock()
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].JID.String() < items[j].JID.String()
+	})
+	return items
+}
+
+// loadRoster starts out with the cached roster, if there is one.
+func (c *client) loadRoster() {
+	if c.rosterCache == nil {
+		return
+	}
+	items, ver := c.rosterCache.load(c.addr)
+	c.mu.Lock()
+	c.roster, c.rosterVer = items, ver
+	c.mu.Unlock()
+}
+
+// saveRoster writes the roster to the cache, if there is one.
+func (c *client) saveRoster() {
+	if c.rosterCache == nil {
+		return
+	}
+	c.mu.Lock()
+	ver := c.rosterVer
+	c.mu.Unlock()
+	if err := c.rosterCache.store(c.addr, ver, c.rosterItems()); err != nil {
+		c.logger.Printf("Error saving roster cache: %v", err)
+	}
+}
+
+func printRoster(items []roster.Item) {
+	if len(items) == 0 {
+		fmt.Println("Your roster is empty")
+		return
+	}
+
+	w := newBlock()
+	fmt.Fprintln(w, "JID\tNAME\tSUBSCRIPTION")
+	for _, item := range items {
+		sub := item.Subscription
+		if sub == "" {
+			sub = "none"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", item.JID, item.Name, sub)
+	}
+	w.Flush()
+}
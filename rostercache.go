@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/roster"
+)
+
+// rosterCache keeps the roster of each account and its XEP-0237 version in a
+// JSON file, so that the roster can be shown before we are connected and the
+// server only has to send what changed since.
+type rosterCache struct {
+	mu   sync.Mutex
+	path string
+	// Keyed by the bare JID of the account
+	Accounts map[string]*cachedRoster
+}
+
+type cachedRoster struct {
+	// Empty if the server doesn't do roster versioning
+	Ver   string
+	Items []cachedItem
+}
+
+type cachedItem struct {
+	JID          string
+	Name         string   `json:",omitempty"`
+	Subscription string   `json:",omitempty"`
+	Groups       []string `json:",omitempty"`
+}
+
+// openRosterCache loads the cache at path, which doesn't have to exist yet.
+func openRosterCache(path string) (*rosterCache, error) {
+	rc := &rosterCache{path: path, Accounts: make(map[string]*cachedRoster)}
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return rc, nil
+	case err != nil:
+		return nil, err
+	}
+	if err := json.Unmarshal(data, rc); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if rc.Accounts == nil {
+		rc.Accounts = make(map[string]*cachedRoster)
+	}
+	return rc, nil
+}
+
+// load returns the cached roster of account and its version.
+func (rc *rosterCache) load(account jid.JID) (map[string]roster.Item, string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	cached := rc.Accounts[account.Bare().String()]
+	if cached == nil {
+		return nil, ""
+	}
+	items := make(map[string]roster.Item, len(cached.Items))
+	for _, item := range cached.Items {
+		addr, err := jid.Parse(item.JID)
+		if err != nil {
+			continue
+		}
+		items[addr.Bare().String()] = roster.Item{
+			JID:          addr,
+			Name:         item.Name,
+			Subscription: item.Subscription,
+			Group:        item.Groups,
+		}
+	}
+	return items, cached.Ver
+}
+
+// store replaces the cached roster of account and writes the file.
+func (rc *rosterCache) store(account jid.JID, ver string, items []roster.Item) error {
+	cached := &cachedRoster{Ver: ver, Items: make([]cachedItem, 0, len(items))}
+	for _, item := range items {
+		cached.Items = append(cached.Items, cachedItem{
+			JID:          item.JID.String(),
+			Name:         item.Name,
+			Subscription: item.Subscription,
+			Groups:       item.Group,
+		})
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.Accounts[account.Bare().String()] = cached
+	data, err := json.MarshalIndent(rc, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(rc.path), 0o700); err != nil {
+		return err
+	}
+	// A partial write would lose the version along with the roster
+	tmp := rc.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, rc.path)
+}
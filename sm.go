@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+	"mellium.im/xmpp/stream"
+)
+
+const (
+	nsSM = "urn:xmpp:sm:3"
+	// Sent stanzas kept until the server acknowledges them, older ones are
+	// dropped if it never does
+	maxUnacked = 500
+	// How often to ask the server to acknowledge what we sent
+	ackInterval = 30 * time.Second
+)
+
+// unackedStanza is a stanza the server hasn't acknowledged yet, kept as it
+// was written so that it can be sent again.
+type unackedStanza struct {
+	seq  uint32
+	name string
+	raw  []byte
+}
+
+// streamManagement keeps the XEP-0198 state, which outlives a connection so
+// that the next one can resume the stream. Stanzas are counted by decoding the
+// XML going both ways, the library answers some of them and reads IQ
+// responses without going through our handler.
+type streamManagement struct {
+	logger *log.Logger
+	// Sends an acknowledgement, set once the client exists
+	send func(context.Context, xml.TokenReader) error
+
+	mu sync.Mutex
+	// Resumption id, empty if the stream can't be resumed
+	id string
+	// Full JID the stream was bound to, which a resumed stream keeps
+	addr jid.JID
+	// Whether stream management is on for the current connection, and if it
+	// was resumed instead of bound
+	enabled bool
+	resumed bool
+	// Stanzas are only counted after enable or resume went by
+	countOut bool
+	countIn  bool
+	sent     uint32
+	handled  uint32
+	acked    uint32
+	unacked  []unackedStanza
+	// Stanzas to send again once the new session is up
+	resend []unackedStanza
+
+	in  *smParser
+	out *smParser
+}
+
+// In and Out return writers for the XML that is read and written on the
+// connection, to be used as tees of the stream config.
+func (sm *streamManagement) In() io.Writer  { return smTee{sm: sm, in: true} }
+func (sm *streamManagement) Out() io.Writer { return smTee{sm: sm} }
+
+type smTee struct {
+	sm *streamManagement
+	in bool
+}
+
+// Write hands p to the parser of the current connection. It never fails, so
+// that it can't break the connection it is watching.
+func (t smTee) Write(p []byte) (int, error) {
+	t.sm.mu.Lock()
+	parser := t.sm.out
+	if t.in {
+		parser = t.sm.in
+	}
+	t.sm.mu.Unlock()
+	if parser != nil {
+		parser.pw.Write(p)
+	}
+	return len(p), nil
+}
+
+// reset starts watching a new connection, the stream of the last one can
+// still be resumed.
+func (sm *streamManagement) reset() {
+	sm.mu.Lock()
+	in, out := sm.in, sm.out
+	sm.in, sm.out = nil, nil
+	sm.mu.Unlock()
+	// Wait for the last stanzas of the old connection to be counted
+	for _, p := range []*smParser{in, out} {
+		if p != nil {
+			p.pw.Close()
+			<-p.done
+		}
+	}
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.enabled = false
+	sm.resumed = false
+	sm.countIn = false
+	sm.countOut = false
+	sm.in = newSMParser(sm.received)
+	sm.out = newSMParser(sm.wrote)
+}
+
+// received is called for every element the server sends at the top level of
+// the stream.
+func (sm *streamManagement) received(start xml.StartElement, _ []byte) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	switch start.Name {
+	case xml.Name{Space: nsSM, Local: "enabled"}:
+		sm.countIn = true
+		sm.handled = 0
+	case xml.Name{Space: nsSM, Local: "resumed"}:
+		sm.countIn = true
+	case xml.Name{Space: nsSM, Local: "r"}:
+		if sm.countIn && sm.send != nil {
+			go sm.answer(sm.handled)
+		}
+	case xml.Name{Space: nsSM, Local: "a"}:
+		if h, ok := smAttrH(start); ok {
+			sm.ack(h)
+		}
+	default:
+		if sm.countIn && isStanza(start.Name) {
+			sm.handled++
+		}
+	}
+}
+
+// wrote is called for every element we send at the top level of the stream.
+func (sm *streamManagement) wrote(start xml.StartElement, raw []byte) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	switch {
+	case start.Name == xml.Name{Space: nsSM, Local: "enable"} || start.Name == xml.Name{Space: nsSM, Local: "resume"}:
+		sm.countOut = true
+	case sm.countOut && isStanza(start.Name):
+		sm.sent++
+		if len(sm.unacked) >= maxUnacked {
+			sm.unacked = sm.unacked[1:]
+		}
+		sm.unacked = append(sm.unacked, unackedStanza{seq: sm.sent, name: start.Name.Local, raw: raw})
+	}
+}
+
+// ack drops the stanzas the server says it has handled. The caller must hold
+// sm.mu.
+func (sm *streamManagement) ack(h uint32) {
+	if h > sm.sent {
+		sm.logger.Printf("Server acknowledged %d stanzas but we only sent %d", h, sm.sent)
+		return
+	}
+	sm.acked = h
+	i := 0
+	for i < len(sm.unacked) && sm.unacked[i].seq <= h {
+		i++
+	}
+	sm.unacked = sm.unacked[i:]
+}
+
+// answer acknowledges the stanzas we handled.
+func (sm *streamManagement) answer(h uint32) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	err := sm.send(ctx, xmlstream.Wrap(nil, xml.StartElement{
+		Name: xml.Name{Space: nsSM, Local: "a"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "h"}, Value: strconv.FormatUint(uint64(h), 10)}},
+	}))
+	if err != nil {
+		sm.logger.Printf("Error acknowledging stanzas: %v", err)
+	}
+}
+
+// requestAck asks the server to acknowledge what we sent if there is
+// anything it hasn't acknowledged yet.
+func (sm *streamManagement) requestAck(ctx context.Context) error {
+	sm.mu.Lock()
+	pending := sm.enabled && len(sm.unacked) > 0
+	sm.mu.Unlock()
+	if !pending {
+		return nil
+	}
+	return sm.send(ctx, xmlstream.Wrap(nil, xml.StartElement{Name: xml.Name{Space: nsSM, Local: "r"}}))
+}
+
+// isResumed reports whether the current connection resumed the previous
+// stream instead of starting a new session.
+func (sm *streamManagement) isResumed() bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.resumed
+}
+
+// takeResend returns the stanzas to send again on the new session and forgets
+// them.
+func (sm *streamManagement) takeResend() []unackedStanza {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	resend := sm.resend
+	sm.resend = nil
+	return resend
+}
+
+// negotiate resumes the previous stream if possible and otherwise binds a
+// resource with bind and enables stream management on the new stream. It is
+// called after authentication.
+func (sm *streamManagement) negotiate(session *xmpp.Session, bind func() error) error {
+	if _, ok := session.Feature(nsSM); !ok {
+		return bind()
+	}
+
+	sm.mu.Lock()
+	id, addr, handled := sm.id, sm.addr, sm.handled
+	sm.mu.Unlock()
+	if id != "" {
+		start, err := sm.request(session, xml.StartElement{
+			Name: xml.Name{Space: nsSM, Local: "resume"},
+			Attr: []xml.Attr{
+				{Name: xml.Name{Local: "previd"}, Value: id},
+				{Name: xml.Name{Local: "h"}, Value: strconv.FormatUint(uint64(handled), 10)},
+			},
+		})
+		if err != nil {
+			// Only try again with the same stream if the connection was at fault
+			if !connError(err) {
+				sm.mu.Lock()
+				sm.id = ""
+				sm.mu.Unlock()
+			}
+			return err
+		}
+		h, hasH := smAttrH(start)
+		sm.mu.Lock()
+		if hasH {
+			sm.ack(h)
+		}
+		switch start.Name.Local {
+		case "resumed":
+			// The server only counts what we send again from here
+			sm.sent = sm.acked
+			sm.resend = sm.unacked
+			sm.unacked = nil
+			sm.enabled = true
+			sm.resumed = true
+			sm.mu.Unlock()
+			session.UpdateAddr(addr)
+			return nil
+		case "failed":
+			sm.id = ""
+			sm.mu.Unlock()
+			sm.logger.Printf("Server could not resume the previous session, starting a new one")
+		default:
+			sm.id = ""
+			sm.mu.Unlock()
+			return stream.BadFormat
+		}
+	}
+
+	if err := bind(); err != nil {
+		return err
+	}
+
+	// Messages the old stream may have lost are sent again, anything else
+	// would be out of date by now
+	sm.mu.Lock()
+	for _, s := range sm.unacked {
+		if s.name == "message" {
+			sm.resend = append(sm.resend, s)
+		}
+	}
+	sm.unacked = nil
+	sm.sent, sm.acked = 0, 0
+	sm.mu.Unlock()
+
+	start, err := sm.request(session, xml.StartElement{
+		Name: xml.Name{Space: nsSM, Local: "enable"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "resume"}, Value: "true"}},
+	})
+	if err != nil {
+		return err
+	}
+	if start.Name.Local != "enabled" {
+		sm.logger.Printf("Server refused to enable stream management")
+		return nil
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.enabled = true
+	sm.id = ""
+	for _, a := range start.Attr {
+		if a.Name.Local == "id" {
+			sm.id = a.Value
+		}
+	}
+	for _, a := range start.Attr {
+		if a.Name.Local == "resume" && a.Value != "true" && a.Value != "1" {
+			sm.id = ""
+		}
+	}
+	sm.addr = session.LocalAddr()
+	return nil
+}
+
+// request sends a nonza during negotiation and returns the start of the reply
+// after skipping the rest of it.
+func (sm *streamManagement) request(session *xmpp.Session, start xml.StartElement) (xml.StartElement, error) {
+	w := session.TokenWriter()
+	_, err := xmlstream.Copy(w, xmlstream.Wrap(nil, start))
+	if err == nil {
+		err = w.Flush()
+	}
+	w.Close()
+	if err != nil {
+		return xml.StartElement{}, err
+	}
+
+	r := session.TokenReader()
+	defer r.Close()
+	d := xml.NewTokenDecoder(r)
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		reply, ok := tok.(xml.StartElement)
+		if !ok {
+			// Whitespace keepalives
+			continue
+		}
+		if reply.Name.Space != nsSM {
+			return xml.StartElement{}, fmt.Errorf("unexpected %s in reply to %s", reply.Name.Local, start.Name.Local)
+		}
+		return reply, d.Skip()
+	}
+}
+
+// smAttrH returns the h attribute of an element if it has one.
+func smAttrH(start xml.StartElement) (uint32, bool) {
+	for _, a := range start.Attr {
+		if a.Name.Local == "h" {
+			h, err := strconv.ParseUint(a.Value, 10, 32)
+			return uint32(h), err == nil
+		}
+	}
+	return 0, false
+}
+
+// isStanza reports whether name is that of a message, presence or IQ.
+func isStanza(name xml.Name) bool {
+	return name.Space == stanza.NSClient && (name.Local == "message" || name.Local == "presence" || name.Local == "iq")
+}
+
+// smParser decodes the XML going one way on a connection and calls element
+// for everything at the top level of the stream.
+type smParser struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+}
+
+func newSMParser(element func(start xml.StartElement, raw []byte)) *smParser {
+	pr, pw := io.Pipe()
+	p := &smParser{pw: pw, done: make(chan struct{})}
+	go p.run(pr, element)
+	return p
+}
+
+func (p *smParser) run(pr *io.PipeReader, element func(start xml.StartElement, raw []byte)) {
+	defer close(p.done)
+	// Writes on the connection must not block if we stop early
+	defer io.Copy(io.Discard, pr)
+
+	// What was read but not handed to element yet, buf starts at offset base
+	var buf bytes.Buffer
+	var base int64
+	d := xml.NewDecoder(io.TeeReader(pr, &buf))
+	// Stanzas are children of the stream, except over WebSocket where each one
+	// is a document of its own
+	level, depth := 0, 0
+	var start xml.StartElement
+	var startOffset int64
+	for {
+		offset := d.InputOffset()
+		tok, err := d.Token()
+		if err != nil {
+			return
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			if tok.Name == (xml.Name{Space: stream.NS, Local: "stream"}) {
+				// Restarts begin a new stream inside the old one
+				level, depth = 1, 1
+				break
+			}
+			if depth == level {
+				start, startOffset = tok.Copy(), offset
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+			if depth == level {
+				raw := bytes.TrimSpace(buf.Bytes()[startOffset-base : d.InputOffset()-base])
+				element(start, bytes.Clone(raw))
+			}
+		}
+		if depth <= level {
+			consumed := d.InputOffset() - base
+			buf.Next(int(consumed))
+			base += consumed
+		}
+	}
+}
+
+// resendUnacked sends the stanzas the server didn't acknowledge on the last
+// connection again.
+func (c *client) resendUnacked(ctx context.Context) {
+	for _, s := range c.sm.takeResend() {
+		err := c.Send(ctx, xml.NewDecoder(bytes.NewReader(s.raw)))
+		if err != nil {
+			c.logger.Printf("Error resending %s: %v", s.name, err)
+			return
+		}
+	}
+}
+
+// requestAcks asks the server to acknowledge what we sent every ackInterval.
+func (c *client) requestAcks(ctx context.Context) {
+	ticker := time.NewTicker(ackInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := c.sm.requestAck(ctx); err != nil && ctx.Err() == nil {
+			c.logger.Printf("Error requesting acknowledgement: %v", err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/ping"
+)
+
+// ping pings our server and records the round trip for /status.
+func (c *client) ping(ctx context.Context, session *xmpp.Session) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	start := time.Now()
+	if err := ping.Send(ctx, session, c.addr.Domain()); err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	c.mu.Lock()
+	c.lastPing, c.pingRTT = time.Now(), rtt
+	c.mu.Unlock()
+	return rtt, nil
+}
+
+// printStatus pings the server and shows how healthy the connection is.
+func (c *client) printStatus(ctx context.Context) {
+	session := c.Session()
+	var pingErr error
+	if session != nil {
+		_, pingErr = c.ping(ctx, session)
+	}
+
+	c.mu.Lock()
+	connectedAt, lastReceived := c.connectedAt, c.lastReceived
+	lastPing, rtt := c.lastPing, c.pingRTT
+	c.mu.Unlock()
+
+	w := newBlock()
+	defer w.Flush()
+	if session == nil {
+		fmt.Fprintln(w, "Connection:\tnot connected")
+	} else {
+		fmt.Fprintf(w, "Connected as:\t%s for %s\n", session.LocalAddr(), since(connectedAt))
+		fmt.Fprintf(w, "Server:\t%s\n", session.Conn().RemoteAddr())
+	}
+	if lastReceived.IsZero() {
+		fmt.Fprintln(w, "Last stanza:\tnone received yet")
+	} else {
+		fmt.Fprintf(w, "Last stanza:\t%s ago\n", since(lastReceived))
+	}
+	switch {
+	case pingErr != nil:
+		fmt.Fprintf(w, "Ping:\tfailed: %s\n", explainError(pingErr))
+	case !lastPing.IsZero():
+		fmt.Fprintf(w, "Ping:\t%s round trip, %s ago\n", rtt.Round(time.Microsecond*100), since(lastPing))
+	}
+	if session != nil {
+		if state := session.ConnectionState(); state.Version != 0 {
+			fmt.Fprintf(w, "TLS:\t%s, %s\n", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+		} else {
+			fmt.Fprintln(w, "TLS:\tnone or not known for this transport")
+		}
+	}
+	if used := c.saslUsed.mechanism(); used != "" {
+		fmt.Fprintf(w, "SASL:\t%s\n", used)
+	}
+}
+
+// since is how long ago t was, to the second.
+func since(t time.Time) time.Duration {
+	return time.Since(t).Round(time.Second)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// setSubject changes the topic of a room, or the subject of a chat with to if
+// groupchat isn't set. An empty subject clears it.
+func (c *client) setSubject(ctx context.Context, to jid.JID, groupchat bool, subject string) error {
+	typ := stanza.ChatMessage
+	if groupchat {
+		typ = stanza.GroupChatMessage
+	}
+	return c.Encode(ctx, messageBody{
+		Message: stanza.Message{
+			ID:   newID(),
+			To:   to,
+			From: c.LocalAddr(),
+			Type: typ,
+		},
+		Subject: &subject,
+	})
+}
+
+// handleSubject reports the topic of a room, which rooms send when we join and
+// whenever it changes, or the subject of a chat.
+func (c *client) handleSubject(msg messageBody) {
+	subject := *msg.Subject
+	e := event{Type: "subject", Time: sentAt(msg), From: msg.From.String(), Subject: subject}
+	if msg.Type != stanza.GroupChatMessage {
+		c.report(e, "%s%s set the subject to: %s\n", c.chatPrefix(msg), msg.From.Bare(), subject)
+		return
+	}
+
+	// The room itself sets the topic when it's configured that way
+	by := ""
+	if nick := msg.From.Resourcepart(); nick != "" {
+		by = " (set by " + nick + ")"
+	}
+	if subject == "" {
+		c.report(e, "[%s] No topic%s\n", msg.From.Bare(), by)
+		return
+	}
+	c.report(e, "[%s] Topic: %s%s\n", msg.From.Bare(), subject, by)
+}
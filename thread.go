@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// XEP-0201 thread a message belongs to
+type thread struct {
+	ID     string `xml:",chardata"`
+	Parent string `xml:"parent,attr,omitempty"`
+}
+
+// threadTag is a short name for a thread to show next to its messages, thread
+// IDs are often long random strings.
+func threadTag(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return "#" + hex.EncodeToString(sum[:3])
+}
+
+// threadPrefix goes in front of a message that belongs to a thread.
+func (c *client) threadPrefix(msg messageBody) string {
+	if msg.Thread == nil || msg.Thread.ID == "" {
+		return ""
+	}
+	return threadTag(msg.Thread.ID) + " "
+}
+
+// rememberThread makes the thread of a message from the bare JID peer the one
+// our replies to peer go in, as XEP-0201 asks for, and lets /thread find it
+// by its tag.
+func (c *client) rememberThread(peer string, msg messageBody) {
+	if msg.Thread == nil || msg.Thread.ID == "" {
+		return
+	}
+	c.setThread(peer, msg.Thread.ID)
+}
+
+// setThread sets the thread our messages to the bare JID peer go in, or stops
+// using one if id is empty.
+func (c *client) setThread(peer, id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.threads == nil {
+		c.threads = make(map[string]string)
+		c.threadTags = make(map[string]string)
+	}
+	if id == "" {
+		delete(c.threads, peer)
+		return
+	}
+	c.threads[peer] = id
+	c.threadTags[threadTag(id)] = id
+}
+
+// currentThread returns the thread our messages to the bare JID peer go in,
+// if any.
+func (c *client) currentThread(peer string) *thread {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if id, ok := c.threads[peer]; ok {
+		return &thread{ID: id}
+	}
+	return nil
+}
+
+// lookupThread returns the ID of a thread we have seen by its tag, or tag
+// itself if it isn't one so that any thread can be joined by its ID.
+func (c *client) lookupThread(tag string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if id, ok := c.threadTags[tag]; ok {
+		return id
+	}
+	return tag
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// knownHosts maps server names to the SHA-256 fingerprint of the certificate
+// we saw the first time we connected to them.
+type knownHosts struct {
+	mu   sync.Mutex
+	path string
+}
+
+func defaultKnownHostsPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "xmpp-client", "known_hosts"), nil
+}
+
+func fingerprint(raw []byte) string {
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func (k *knownHosts) lookup(host string) (string, error) {
+	f, err := os.Open(k.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name, fp, ok := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		if ok && name == host {
+			return fp, nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+func (k *knownHosts) add(host, fp string) error {
+	err := os.MkdirAll(filepath.Dir(k.path), 0o700)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(k.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s %s\n", host, fp)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// verify is used as tls.Config.VerifyConnection with InsecureSkipVerify set.
+// The first certificate presented by a server is trusted and remembered, after
+// that only the same certificate is accepted.
+func (k *knownHosts) verify(logger *log.Logger) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("server did not present a certificate")
+		}
+		fp := fingerprint(cs.PeerCertificates[0].Raw)
+
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		known, err := k.lookup(cs.ServerName)
+		if err != nil {
+			return err
+		}
+		switch known {
+		case "":
+			logger.Printf("Trusting certificate of %s on first use (SHA-256 %s)", cs.ServerName, fp)
+			return k.add(cs.ServerName, fp)
+		case fp:
+			return nil
+		}
+
+		logger.Printf("WARNING: THE CERTIFICATE OF %s HAS CHANGED!", cs.ServerName)
+		logger.Printf("WARNING: someone could be intercepting your connection.")
+		logger.Printf("WARNING: expected SHA-256 %s", known)
+		logger.Printf("WARNING: got      SHA-256 %s", fp)
+		logger.Printf("WARNING: if the change is expected, remove %s from %s", cs.ServerName, k.path)
+		return fmt.Errorf("certificate fingerprint of %s does not match %s", cs.ServerName, k.path)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// traceFilter matches top level elements of the stream by name and, if set,
+// by their type attribute, e.g. iq@set.
+type traceFilter struct {
+	name string
+	typ  string
+}
+
+// parseTraceFilters parses the comma separated filters of -trace.
+func parseTraceFilters(s string) ([]traceFilter, error) {
+	var filters []traceFilter
+	for _, f := range strings.Split(s, ",") {
+		name, typ, _ := strings.Cut(strings.TrimSpace(f), "@")
+		if name == "" {
+			return nil, fmt.Errorf("%q does not say which elements to show, e.g. message or iq@set", f)
+		}
+		filters = append(filters, traceFilter{name: name, typ: typ})
+	}
+	return filters, nil
+}
+
+var typeAttr = regexp.MustCompile(`\stype\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+
+// matchTrace reports whether the start tag of an element matches any of filters.
+func matchTrace(filters []traceFilter, tag string) bool {
+	name := tagName(tag)
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		name = name[i+1:]
+	}
+	typ := ""
+	if m := typeAttr.FindStringSubmatch(tag); m != nil {
+		typ = m[1] + m[2]
+	}
+	for _, f := range filters {
+		if f.name == name && (f.typ == "" || f.typ == typ) {
+			return true
+		}
+	}
+	return false
+}
+
+// traceWriter passes the stanzas and other top level elements of the stream
+// that match its filters on to w, each in one write, and drops everything
+// else. Like prettyWriter it keeps its place in the stream between writes.
+type traceWriter struct {
+	w       io.Writer
+	filters []traceFilter
+
+	mu sync.Mutex
+	// Depth of the elements in the stream, which is 1 inside <stream:stream>
+	// and stays 0 with WebSocket where there is no such element
+	depth int
+	top   int
+	// A tag split across writes
+	partial string
+	// The element being written and whether it matched
+	match bool
+	cur   strings.Builder
+}
+
+func (w *traceWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	out := w.filter(string(p))
+	w.mu.Unlock()
+
+	for _, s := range out {
+		if _, err := io.WriteString(w.w, s); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// filter returns the matching elements that s completes.
+func (w *traceWriter) filter(s string) []string {
+	var out []string
+	s, w.partial = w.partial+s, ""
+	for s != "" {
+		i := strings.IndexByte(s, '<')
+		if i != 0 {
+			if w.match && w.depth > w.top {
+				if i < 0 {
+					w.cur.WriteString(s)
+				} else {
+					w.cur.WriteString(s[:i])
+				}
+			}
+			if i < 0 {
+				break
+			}
+			s = s[i:]
+		}
+		j := strings.IndexByte(s, '>')
+		if j < 0 {
+			w.partial = s
+			break
+		}
+		tag := s[:j+1]
+		s = s[j+1:]
+
+		switch name := tagName(tag); {
+		case strings.HasPrefix(tag, "<?"):
+			// A new XML declaration means the stream was restarted
+			w.depth, w.top = 0, 0
+		case strings.HasPrefix(tag, "</"):
+			if w.depth > w.top && w.match {
+				w.cur.WriteString(tag)
+			}
+			w.depth--
+			if w.depth == w.top && w.match {
+				out = append(out, w.cur.String())
+				w.match = false
+			}
+			if w.depth < w.top {
+				w.depth, w.top = 0, 0
+			}
+		case w.depth == 0 && (name == "stream:stream" || name == "stream") && !strings.HasSuffix(tag, "/>"):
+			w.depth, w.top = 1, 1
+		default:
+			if w.depth == w.top {
+				w.match = matchTrace(w.filters, tag)
+				w.cur.Reset()
+			}
+			if w.match {
+				w.cur.WriteString(tag)
+			}
+			if !strings.HasSuffix(tag, "/>") {
+				w.depth++
+			} else if w.depth == w.top && w.match {
+				out = append(out, w.cur.String())
+				w.match = false
+			}
+		}
+	}
+	return out
+}
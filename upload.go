@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+	"mellium.im/xmpp/upload"
+)
+
+const uploadTimeout = 5 * time.Minute
+
+// Files at least this large show how far along the upload is
+const progressThreshold = 1 << 20
+
+// uploadService is a XEP-0363 HTTP file upload service, maxSize is 0 if it
+// didn't say how large files may be.
+type uploadService struct {
+	addr    jid.JID
+	maxSize int64
+}
+
+// findUploadService looks for an upload service on our server and the items it
+// lists.
+func (c *client) findUploadService(ctx context.Context) (uploadService, error) {
+	domain := c.LocalAddr().Domain()
+	info, err := c.discoInfo(ctx, domain)
+	if err != nil {
+		return uploadService{}, err
+	}
+	if s, ok := uploadServiceInfo(domain, info); ok {
+		return s, nil
+	}
+	found, err := c.discoItems(ctx, domain)
+	if err != nil {
+		return uploadService{}, err
+	}
+	for _, item := range found {
+		info, err := c.discoInfo(ctx, item.JID)
+		if err != nil {
+			c.logger.Printf("Error querying %s: %v", item.JID, err)
+			continue
+		}
+		if s, ok := uploadServiceInfo(item.JID, info); ok {
+			return s, nil
+		}
+	}
+	return uploadService{}, fmt.Errorf("%s has no HTTP upload service", domain)
+}
+
+// uploadServiceInfo reports whether info is of an upload service and reads the
+// largest file size it accepts from its extended information (XEP-0128).
+func uploadServiceInfo(addr jid.JID, info disco.Info) (uploadService, bool) {
+	ok := false
+	for _, f := range info.Features {
+		if f.Var == upload.NS {
+			ok = true
+		}
+	}
+	if !ok {
+		return uploadService{}, false
+	}
+	s := uploadService{addr: addr}
+	for _, form := range info.Form {
+		typ, _ := form.Raw("FORM_TYPE")
+		if len(typ) == 0 || typ[0] != upload.NS {
+			continue
+		}
+		if limit, _ := form.Raw("max-file-size"); len(limit) > 0 {
+			s.maxSize, _ = strconv.ParseInt(limit[0], 10, 64)
+		}
+	}
+	return s, true
+}
+
+// uploadFile uploads the file at name and returns the URL it can be fetched
+// from.
+func (c *client) uploadFile(ctx context.Context, name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if !fi.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", name)
+	}
+	size := fi.Size()
+
+	service, err := c.findUploadService(ctx)
+	if err != nil {
+		return "", err
+	}
+	if service.maxSize > 0 && size > service.maxSize {
+		return "", fmt.Errorf("file is %d bytes, %s only accepts files up to %d bytes", size, service.addr, service.maxSize)
+	}
+
+	file := upload.File{
+		Name: filepath.Base(name),
+		Size: int(size),
+		Type: mime.TypeByExtension(filepath.Ext(name)),
+	}
+	var slot upload.Slot
+	err = c.sendIQ(ctx, service.addr, stanza.GetIQ, file.TokenReader(), &slot)
+	var se stanza.Error
+	switch {
+	case errors.As(err, &se) && se.Condition == stanza.NotAcceptable:
+		return "", fmt.Errorf("%s refused the file, it may be too large: %s", service.addr, explainError(err))
+	case errors.As(err, &se) && se.Condition == stanza.ResourceConstraint:
+		return "", fmt.Errorf("%s refused the file, your upload quota may be used up: %s", service.addr, explainError(err))
+	case err != nil:
+		return "", fmt.Errorf("requesting upload slot: %w", err)
+	}
+	if slot.PutURL == nil || slot.GetURL == nil {
+		return "", errors.New("upload slot is missing a URL")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, uploadTimeout)
+	defer cancel()
+	var body io.Reader = f
+	if size >= progressThreshold && c.events == nil {
+		body = &progressReader{r: f, name: file.Name, size: size}
+	}
+	req, err := slot.Put(ctx, body)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = size
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	if file.Type != "" {
+		req.Header.Set("Content-Type", file.Type)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return slot.GetURL.String(), nil
+}
+
+// progressReader prints how much of a file has been read every 10 percent.
+type progressReader struct {
+	r    io.Reader
+	name string
+	size int64
+	read int64
+	// Last percentage printed
+	shown int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if percent := p.read * 100 / p.size / 10 * 10; percent > p.shown {
+		p.shown = percent
+		printf("Uploading %s: %d%%\n", p.name, percent)
+	}
+	return n, err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+const nsVCard = "vcard-temp"
+
+// XEP-0054 vCard, only the fields we show
+type vCard struct {
+	FullName string `xml:"FN"`
+	Name     struct {
+		Given  string `xml:"GIVEN"`
+		Family string `xml:"FAMILY"`
+	} `xml:"N"`
+	Nickname string `xml:"NICKNAME"`
+	Email    []struct {
+		UserID string `xml:"USERID"`
+	} `xml:"EMAIL"`
+	Org struct {
+		Name string `xml:"ORGNAME"`
+		Unit string `xml:"ORGUNIT"`
+	} `xml:"ORG"`
+	Title    string `xml:"TITLE"`
+	URL      string `xml:"URL"`
+	Birthday string `xml:"BDAY"`
+	Desc     string `xml:"DESC"`
+	Photo    struct {
+		Type   string `xml:"TYPE"`
+		BinVal string `xml:"BINVAL"`
+	} `xml:"PHOTO"`
+}
+
+// fetchVCard gets the vCard of to, or our own if to is empty. A missing vCard
+// is returned as an empty one.
+func (c *client) fetchVCard(ctx context.Context, to jid.JID) (vCard, error) {
+	var card vCard
+	query := xmlstream.Wrap(nil, xml.StartElement{Name: xml.Name{Space: nsVCard, Local: "vCard"}})
+	err := c.sendIQ(ctx, to, stanza.GetIQ, query, &card)
+	var se stanza.Error
+	if errors.As(err, &se) && se.Condition == stanza.ItemNotFound {
+		return vCard{}, nil
+	}
+	return card, err
+}
+
+func printVCard(owner jid.JID, card vCard) {
+	var emails []string
+	for _, email := range card.Email {
+		if email.UserID != "" {
+			emails = append(emails, email.UserID)
+		}
+	}
+	name := strings.TrimSpace(card.Name.Given + " " + card.Name.Family)
+	org := card.Org.Name
+	if card.Org.Unit != "" {
+		org = strings.TrimSpace(org + ", " + card.Org.Unit)
+	}
+
+	fields := []struct{ label, value string }{
+		{"Full name", card.FullName},
+		{"Name", name},
+		{"Nickname", card.Nickname},
+		{"Email", strings.Join(emails, ", ")},
+		{"Organization", org},
+		{"Title", card.Title},
+		{"Website", card.URL},
+		{"Birthday", card.Birthday},
+		{"About", card.Desc},
+	}
+
+	w := newBlock()
+	empty := true
+	for _, f := range fields {
+		if f.value == "" {
+			continue
+		}
+		if empty {
+			fmt.Fprintf(w, "vCard of %s:\n", owner)
+			empty = false
+		}
+		fmt.Fprintf(w, "  %s:\t%s\n", f.label, f.value)
+	}
+	if empty {
+		fmt.Fprintf(w, "%s has no vCard\n", owner)
+	}
+	w.Flush()
+}
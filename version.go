@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+	"mellium.im/xmpp/version"
+)
+
+const clientName = "xmpp-client"
+
+// clientVersion is set when building releases with
+// -ldflags "-X main.clientVersion=v1.2.3".
+var clientVersion = "dev"
+
+func (c *client) fetchVersion(ctx context.Context, to jid.JID) (version.Query, error) {
+	var q version.Query
+	err := c.sendIQ(ctx, to, stanza.GetIQ, version.Query{}.TokenReader(), &q)
+	return q, err
+}
+
+// handleVersionRequest answers XEP-0092 software version requests.
+func handleVersionRequest(t xmlstream.TokenReadEncoder, iq stanza.IQ) error {
+	if iq.Type != stanza.GetIQ {
+		return nil
+	}
+	_, err := xmlstream.Copy(t, iq.Result(version.Query{
+		Name:    clientName,
+		Version: clientVersion,
+		OS:      runtime.GOOS,
+	}.TokenReader()))
+	return err
+}
+
+func printVersion(to jid.JID, q version.Query) {
+	if q.Name == "" {
+		fmt.Printf("%s did not say which software it runs\n", to)
+		return
+	}
+	software := strings.TrimSpace(q.Name + " " + q.Version)
+	if q.OS != "" {
+		fmt.Printf("%s runs %s on %s\n", to, software, q.OS)
+	} else {
+		fmt.Printf("%s runs %s\n", to, software)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/websocket"
+)
+
+// dialWebSocket opens an RFC 7395 WebSocket connection to rawURL. Only wss:
+// connections are secure, so SASL will refuse to run over plain ws:.
+func dialWebSocket(ctx context.Context, rawURL string, tlsConfig *tls.Config) (net.Conn, xmpp.SessionState, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, 0, err
+	}
+	var (
+		state  xmpp.SessionState
+		origin = url.URL{Scheme: "http", Host: u.Host}
+	)
+	switch u.Scheme {
+	case "wss":
+		state = xmpp.Secure
+		origin.Scheme = "https"
+	case "ws":
+	default:
+		return nil, 0, fmt.Errorf("unsupported WebSocket URL scheme %q", u.Scheme)
+	}
+
+	// The certificate is for the host serving the endpoint, which need not be
+	// the JID's domain
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.ServerName = u.Hostname()
+	d := websocket.Dialer{
+		Origin:    origin.String(),
+		TLSConfig: tlsConfig,
+	}
+	conn, err := d.DialDirect(ctx, u.String())
+	return conn, state, err
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+	"mellium.im/xmpp/xtime"
+)
+
+// fetchTime asks to for its XEP-0202 entity time. The result is in the time
+// zone of the entity.
+func (c *client) fetchTime(ctx context.Context, to jid.JID) (time.Time, error) {
+	var t xtime.Time
+	query := xmlstream.Wrap(nil, xml.StartElement{Name: xml.Name{Space: xtime.NS, Local: "time"}})
+	err := c.sendIQ(ctx, to, stanza.GetIQ, query, &t)
+	var se stanza.Error
+	if errors.As(err, &se) && (se.Condition == stanza.ServiceUnavailable || se.Condition == stanza.FeatureNotImplemented) {
+		// Accounts don't have a time, their clients do
+		if to.Localpart() != "" && to.Resourcepart() == "" {
+			return time.Time{}, errors.New("entity time not supported, try the full JID of a client")
+		}
+		return time.Time{}, errors.New("entity time not supported")
+	}
+	if err == nil && t.IsZero() {
+		return time.Time{}, errors.New("no time in the response")
+	}
+	return t.Time, err
+}
+
+func printTime(to jid.JID, t time.Time) {
+	fmt.Printf("It is %s (UTC%s) for %s, %s UTC\n",
+		t.Format("Mon 15:04:05"), t.Format("-07:00"), to, t.UTC().Format("15:04:05"))
+}